@@ -96,7 +96,7 @@ func (c *Connection) d1ApiCall(ctx context.Context, apiOps apiOps, method string
 	if reqBody != nil {
 		bodyReader = bytes.NewBuffer(reqBody)
 	}
-	var api = fmt.Sprintf("%s%s", v4base, endpoint)
+	var api = fmt.Sprintf("%s%s", c.base, endpoint)
 	req, err := http.NewRequestWithContext(ctx, method, api, bodyReader)
 	if err != nil {
 		return
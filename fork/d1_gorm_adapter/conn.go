@@ -22,6 +22,7 @@ type Connection struct {
 	accountId  string
 	apiToken   string
 	databaseId string
+	base       string // api地址，默认为v4base
 
 	// variables below this line need to be initialized in Open()
 	hasBeenClosed bool   //   false
@@ -91,6 +92,12 @@ func (conn *Connection) init(dsn string) error {
 		timeout = customTimeout
 	}
 
+	conn.base = v4base
+	if query.Get("endpoint") != "" {
+		// 用于兼容d1 api的代理或本地测试
+		conn.base = strings.TrimRight(query.Get("endpoint"), "/")
+	}
+
 	// Initialize http client for connection
 	conn.client = http.Client{
 		Transport: http.DefaultTransport,
@@ -26,6 +26,8 @@ var (
 // The dsn looks like:
 //
 //	d1://apiToken:accountId@databaseId?timeout=10
+//
+// endpoint可以替换默认的api地址，例如 d1://apiToken:accountId@databaseId?endpoint=http://127.0.0.1:8787/client/v4
 func Open(dsn string) (conn *Connection, err error) {
 	conn = &Connection{}
 
@@ -0,0 +1,241 @@
+package xlog
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intmian/mian_go_lib/tool/misc"
+)
+
+// IPusher 告警的推送方式，xpush.XPush实现了这个接口
+type IPusher interface {
+	Push(title string, content string, markDown bool) error
+}
+
+// QuietHours 一天中不推送的时间段，Start与End为距离0点的时间，End小于Start时跨过0点，相等时不生效
+type QuietHours struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func (q QuietHours) in(t time.Time) bool {
+	if q.Start == q.End {
+		return false
+	}
+	y, m, d := t.Date()
+	since := t.Sub(time.Date(y, m, d, 0, 0, 0, 0, t.Location()))
+	if q.Start < q.End {
+		return since >= q.Start && since < q.End
+	}
+	return since >= q.Start || since < q.End
+}
+
+// AlertSetting 告警聚合的配置
+type AlertSetting struct {
+	Pusher IPusher
+	Tag    string        // 不为空时加在标题前，用于区分来源
+	Window time.Duration // 聚合窗口，窗口内相同的日志合并为一条，每个窗口最多推送一次，<=0时为1分钟
+	// Thresholds 各级别在一个窗口内至少出现多少次才推送，不在其中的级别不推送，为空时ERROR与WARNING出现1次即推送
+	Thresholds map[LogLevel]int
+	// Quiet 期间不推送，聚合的日志保留到结束后推送
+	Quiet QuietHours
+	// MaxGroups 一个窗口内最多保留的不同日志数量，超出的只按级别计数，同样需要达到级别的阈值才推送，<=0时为100
+	MaxGroups int
+}
+
+const (
+	defaultAlertWindow    = time.Minute
+	defaultAlertMaxGroups = 100
+)
+
+// alertGroup 一个窗口内级别、来源与内容都相同的日志
+type alertGroup struct {
+	level LogLevel
+	from  string
+	msg   string
+	count int
+	first time.Time
+	last  time.Time
+}
+
+type alertKey struct {
+	level LogLevel
+	from  string
+	msg   string
+}
+
+// AlertSink 聚合ERROR、WARNING等日志后按窗口推送汇总，避免出错的循环刷屏并触发推送方的频率限制
+type AlertSink struct {
+	setting  AlertSetting
+	lock     sync.Mutex
+	groups   map[alertKey]*alertGroup
+	overflow map[LogLevel]int // 超出MaxGroups的日志按级别的数量
+	pushErr  error            // 后台推送的错误，在下一次Write时返回
+	now      func() time.Time
+	stop     chan struct{}
+	exit     chan struct{}
+	once     sync.Once
+}
+
+func NewAlertSink(setting AlertSetting) (*AlertSink, error) {
+	if setting.Pusher == nil {
+		return nil, ErrPusherIsNil
+	}
+	if setting.Window <= 0 {
+		setting.Window = defaultAlertWindow
+	}
+	if setting.MaxGroups <= 0 {
+		setting.MaxGroups = defaultAlertMaxGroups
+	}
+	if len(setting.Thresholds) == 0 {
+		setting.Thresholds = map[LogLevel]int{LogLevelError: 1, LogLevelWarning: 1}
+	}
+	s := &AlertSink{
+		setting:  setting,
+		groups:   make(map[alertKey]*alertGroup),
+		overflow: make(map[LogLevel]int),
+		now:      time.Now,
+		stop:     make(chan struct{}),
+		exit:     make(chan struct{}),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *AlertSink) Name() string {
+	return "alert"
+}
+
+func (s *AlertSink) Write(entry *Entry) error {
+	if _, ok := s.setting.Thresholds[entry.Level]; !ok {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	k := alertKey{level: entry.Level, from: entry.From, msg: entry.Msg}
+	g, ok := s.groups[k]
+	if !ok {
+		if len(s.groups) >= s.setting.MaxGroups {
+			s.overflow[entry.Level]++
+			return s.takeErr()
+		}
+		g = &alertGroup{level: entry.Level, from: entry.From, msg: entry.Msg, first: entry.Time}
+		s.groups[k] = g
+	}
+	g.count++
+	g.last = entry.Time
+	return s.takeErr()
+}
+
+// takeErr 返回并清空后台推送的错误，调用时需要持有锁
+func (s *AlertSink) takeErr() error {
+	err := s.pushErr
+	s.pushErr = nil
+	if err != nil {
+		return errors.Join(ErrPushFail, err)
+	}
+	return nil
+}
+
+func (s *AlertSink) run() {
+	defer close(s.exit)
+	ticker := time.NewTicker(s.setting.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			err := s.flush(false)
+			if err != nil {
+				s.lock.Lock()
+				s.pushErr = err
+				s.lock.Unlock()
+			}
+		}
+	}
+}
+
+// Flush 立即推送当前窗口的汇总，免打扰期间不推送
+func (s *AlertSink) Flush() error {
+	return s.flush(false)
+}
+
+// Close 停止后台推送并推送剩余的汇总，即使在免打扰期间，避免告警丢失
+func (s *AlertSink) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.stop)
+		<-s.exit
+		err = s.flush(true)
+	})
+	return err
+}
+
+// flush 结束当前窗口，达到阈值的日志合并为一条markdown推送
+func (s *AlertSink) flush(force bool) error {
+	now := s.now()
+	s.lock.Lock()
+	if !force && s.setting.Quiet.in(now) {
+		s.lock.Unlock()
+		return nil
+	}
+	groups := make([]*alertGroup, 0, len(s.groups))
+	for _, g := range s.groups {
+		if g.count >= s.setting.Thresholds[g.level] {
+			groups = append(groups, g)
+		}
+	}
+	// 超出的日志同样按级别的阈值判断
+	overflow := make(map[LogLevel]int)
+	for level, n := range s.overflow {
+		if n >= s.setting.Thresholds[level] {
+			overflow[level] = n
+		}
+	}
+	s.groups = make(map[alertKey]*alertGroup)
+	s.overflow = make(map[LogLevel]int)
+	s.lock.Unlock()
+	if len(groups) == 0 && len(overflow) == 0 {
+		return nil
+	}
+	title, content := s.digest(groups, overflow)
+	return s.setting.Pusher.Push(title, content, true)
+}
+
+// digest 按级别与首次出现的时间排序，每条为 N× [级别] [来源] 内容 与首次、最后出现的时间
+func (s *AlertSink) digest(groups []*alertGroup, overflow map[LogLevel]int) (string, string) {
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].level != groups[j].level {
+			return groups[i].level < groups[j].level
+		}
+		return groups[i].first.Before(groups[j].first)
+	})
+	total := 0
+	for _, g := range groups {
+		total += g.count
+	}
+	levels := make([]LogLevel, 0, len(overflow))
+	for level, n := range overflow {
+		levels = append(levels, level)
+		total += n
+	}
+	sort.Slice(levels, func(i, j int) bool {
+		return levels[i] < levels[j]
+	})
+	title := strings.TrimSpace(fmt.Sprintf("%s alert %d×", s.setting.Tag, total))
+	md := misc.MarkdownTool{}
+	md.AddTitle(title, 2)
+	for _, g := range groups {
+		md.AddList(fmt.Sprintf("**%d×** [%s] [%s] %s", g.count, g.level, g.from, g.msg), 1)
+		md.AddList(fmt.Sprintf("first %s, last %s", g.first.Format("2006-01-02 15:04:05"), g.last.Format("2006-01-02 15:04:05")), 2)
+	}
+	for _, level := range levels {
+		md.AddList(fmt.Sprintf("**%d×** other [%s] logs", overflow[level], level), 1)
+	}
+	return title, md.ToStr()
+}
@@ -0,0 +1,185 @@
+package xlog
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type AsyncFullPolicy uint8
+
+const (
+	AsyncFullBlock AsyncFullPolicy = iota // 队列满时等待，不会丢失日志
+	AsyncFullDrop                         // 队列满时丢弃新的日志，计入Dropped
+)
+
+const (
+	defaultAsyncQueueSize = 1024
+	defaultAsyncBatchSize = 128
+)
+
+type asyncItem struct {
+	entry *Entry
+	done  chan struct{} // 不为nil时为Flush的标记，写入之前的日志后关闭
+}
+
+// asyncWriter 有界队列与后台写入的goroutine，队列中的日志按批交给XLog.write
+type asyncWriter struct {
+	log     *XLog
+	setting LogAsync
+	c       chan asyncItem
+	// push时持有读锁，close时持有写锁，保证关闭channel时没有正在写入的push
+	lock    sync.RWMutex
+	closed  bool
+	exit    chan struct{}
+	dropped [LogLevelBusiness + 1]atomic.Uint64
+	// 已经记录过的丢弃数量，只在后台goroutine中使用
+	reported uint64
+}
+
+func newAsyncWriter(log *XLog, setting LogAsync) *asyncWriter {
+	if setting.QueueSize <= 0 {
+		setting.QueueSize = defaultAsyncQueueSize
+	}
+	if setting.BatchSize <= 0 {
+		setting.BatchSize = defaultAsyncBatchSize
+	}
+	w := &asyncWriter{
+		log:     log,
+		setting: setting,
+		c:       make(chan asyncItem, setting.QueueSize),
+		exit:    make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+// push 放入队列，已经关闭时返回false，由调用者同步写入
+func (w *asyncWriter) push(entry *Entry) bool {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.closed {
+		return false
+	}
+	item := asyncItem{entry: entry}
+	if w.setting.FullPolicy == AsyncFullDrop {
+		select {
+		case w.c <- item:
+		default:
+			if int(entry.Level) < len(w.dropped) {
+				w.dropped[entry.Level].Add(1)
+			}
+		}
+		return true
+	}
+	w.c <- item
+	return true
+}
+
+func (w *asyncWriter) flush() {
+	w.lock.RLock()
+	if w.closed {
+		w.lock.RUnlock()
+		return
+	}
+	done := make(chan struct{})
+	w.c <- asyncItem{done: done}
+	w.lock.RUnlock()
+	<-done
+}
+
+// close 停止接收新的日志，等待队列中的日志写入完成
+func (w *asyncWriter) close() {
+	w.lock.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.c)
+	}
+	w.lock.Unlock()
+	<-w.exit
+}
+
+func (w *asyncWriter) run() {
+	defer close(w.exit)
+	batch := make([]*Entry, 0, w.setting.BatchSize)
+	var done []chan struct{}
+	for item := range w.c {
+		// 取出队列中已有的日志，凑成一批写入
+		for {
+			if item.done != nil {
+				done = append(done, item.done)
+			} else {
+				batch = append(batch, item.entry)
+			}
+			if len(batch) >= w.setting.BatchSize {
+				break
+			}
+			var ok bool
+			select {
+			case item, ok = <-w.c:
+			default:
+			}
+			if !ok {
+				break
+			}
+		}
+		if len(batch) > 0 {
+			w.log.write(batch)
+			batch = batch[:0]
+		}
+		w.reportDropped()
+		for _, d := range done {
+			close(d)
+		}
+		done = done[:0]
+	}
+}
+
+// reportDropped 有新的丢弃时记录一条警告
+func (w *asyncWriter) reportDropped() {
+	total := w.droppedTotal()
+	if total <= w.reported {
+		return
+	}
+	n := total - w.reported
+	w.reported = total
+	w.log.write([]*Entry{{
+		Level:  LogLevelWarning,
+		Time:   time.Now(),
+		From:   "LOG",
+		Msg:    "async queue is full, logs dropped",
+		Fields: []Field{F("dropped", n)},
+	}})
+}
+
+func (w *asyncWriter) droppedTotal() uint64 {
+	var total uint64
+	for i := range w.dropped {
+		total += w.dropped[i].Load()
+	}
+	return total
+}
+
+// Dropped 异步模式下因为队列已满被丢弃的日志数量
+func (receiver *XLog) Dropped() uint64 {
+	root := receiver.rootLog()
+	if root.async == nil {
+		return 0
+	}
+	return root.async.droppedTotal()
+}
+
+// DroppedByLevel 按级别统计的被丢弃的日志数量，只包含有丢弃的级别
+func (receiver *XLog) DroppedByLevel() map[LogLevel]uint64 {
+	ret := make(map[LogLevel]uint64)
+	root := receiver.rootLog()
+	if root.async == nil {
+		return ret
+	}
+	for i := range root.async.dropped {
+		if n := root.async.dropped[i].Load(); n > 0 {
+			ret[LogLevel(i)] = n
+		}
+	}
+	return ret
+}
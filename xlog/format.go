@@ -0,0 +1,167 @@
+package xlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Field 结构化日志中的一个键值对，使用F创建
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F 创建一个字段，可以直接混在Info等函数的参数中，例如 log.Info("NEWS", "fetch %s done", url, xlog.F("cost", cost))
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// splitFields 将参数中的Field与格式化参数分开
+func splitFields(a []interface{}) ([]interface{}, []Field) {
+	var args []interface{}
+	var fields []Field
+	for i, v := range a {
+		f, ok := v.(Field)
+		if !ok {
+			if fields != nil {
+				args = append(args, v)
+			}
+			continue
+		}
+		if fields == nil {
+			fields = make([]Field, 0, len(a)-i)
+			args = append(make([]interface{}, 0, len(a)), a[:i]...)
+		}
+		fields = append(fields, f)
+	}
+	if fields == nil {
+		return a, nil
+	}
+	return args, fields
+}
+
+type LogFormat uint8
+
+const (
+	LogFormatText   LogFormat = iota // [级别]\t[日期]\t[发起人]\t内容 key=value\n
+	LogFormatJSON                    // 每行一个json对象
+	LogFormatLogfmt                  // time=... level=... from=... msg=... key=value\n
+)
+
+// Entry 一条日志
+type Entry struct {
+	Level  LogLevel
+	Time   time.Time
+	From   string
+	Msg    string
+	Fields []Field
+}
+
+// Format 按格式输出一条日志，以换行结尾
+func (e *Entry) Format(format LogFormat) string {
+	switch format {
+	case LogFormatJSON:
+		return e.json()
+	case LogFormatLogfmt:
+		return e.logfmt()
+	default:
+		return e.text()
+	}
+}
+
+func (e *Entry) text() string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("[%s]\t[%s]\t[%s]\t%s", logLevel2Str[e.Level], e.Time.Format("2006-01-02 15:04:05"), e.From, e.Msg))
+	for _, f := range e.Fields {
+		b.WriteByte(' ')
+		writeLogfmtPair(&b, f.Key, fieldString(f.Value))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+func (e *Entry) logfmt() string {
+	var b strings.Builder
+	writeLogfmtPair(&b, "time", e.Time.Format(time.RFC3339Nano))
+	b.WriteByte(' ')
+	writeLogfmtPair(&b, "level", logLevel2Str[e.Level])
+	b.WriteByte(' ')
+	writeLogfmtPair(&b, "from", e.From)
+	b.WriteByte(' ')
+	writeLogfmtPair(&b, "msg", e.Msg)
+	for _, f := range e.Fields {
+		b.WriteByte(' ')
+		writeLogfmtPair(&b, f.Key, fieldString(f.Value))
+	}
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// json 固定的键在前，字段按传入顺序排列，与固定的键重名的字段加上"fields."前缀
+func (e *Entry) json() string {
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeJSONValue(&b, e.Time.Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeJSONValue(&b, logLevel2Str[e.Level])
+	b.WriteString(`,"from":`)
+	writeJSONValue(&b, e.From)
+	b.WriteString(`,"msg":`)
+	writeJSONValue(&b, e.Msg)
+	for _, f := range e.Fields {
+		key := f.Key
+		switch key {
+		case "time", "level", "from", "msg":
+			key = "fields." + key
+		}
+		b.WriteByte(',')
+		writeJSONValue(&b, key)
+		b.WriteByte(':')
+		writeJSONValue(&b, fieldValue(f.Value))
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// fieldValue error与Stringer输出为字符串，其他的值按json的规则输出
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func fieldString(v interface{}) string {
+	switch v := fieldValue(v).(type) {
+	case string:
+		return v
+	case nil:
+		return "null"
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func writeJSONValue(b *bytes.Buffer, v interface{}) {
+	s, err := json.Marshal(v)
+	if err != nil {
+		s, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(s)
+}
+
+func writeLogfmtPair(b *strings.Builder, key string, value string) {
+	b.WriteString(key)
+	b.WriteByte('=')
+	if value == "" || strings.ContainsAny(value, " =\"\t\r\n") {
+		value = strconv.Quote(value)
+	}
+	b.WriteString(value)
+}
@@ -0,0 +1,214 @@
+package xlog
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func (l LogLevel) String() string {
+	if s, ok := logLevel2Str[l]; ok {
+		return s
+	}
+	if l == LogLevelBusiness {
+		return "BUSINESS"
+	}
+	return "UNKNOWN"
+}
+
+// ParseLevel 将ERROR、warning等级别名转换为LogLevel，不区分大小写
+func ParseLevel(s string) (LogLevel, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	for level, name := range logLevel2Str {
+		if name == s {
+			return level, nil
+		}
+	}
+	if s == "BUSINESS" {
+		return LogLevelBusiness, nil
+	}
+	return 0, ErrLevelInvalid
+}
+
+// levelTable 按来源设置的级别上限，可以在运行时修改
+type levelTable struct {
+	lock   sync.RWMutex
+	levels map[string]LogLevel
+}
+
+func newLevelTable(levels map[string]LogLevel) *levelTable {
+	t := &levelTable{levels: make(map[string]LogLevel, len(levels))}
+	for from, level := range levels {
+		t.levels[from] = level
+	}
+	return t
+}
+
+func (t *levelTable) get(from string) (LogLevel, bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	level, ok := t.levels[from]
+	return level, ok
+}
+
+func (t *levelTable) set(from string, level LogLevel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.levels[from] = level
+}
+
+func (t *levelTable) reset(from string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.levels, from)
+}
+
+func (t *levelTable) all() map[string]LogLevel {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	ret := make(map[string]LogLevel, len(t.levels))
+	for from, level := range t.levels {
+		ret[from] = level
+	}
+	return ret
+}
+
+// enabled 来源设置了级别上限时只记录不超过上限的日志，否则由IfMisc、IfDebug决定
+func (receiver *XLog) enabled(level LogLevel, from string) bool {
+	if limit, ok := receiver.levels.get(from); ok {
+		return level <= limit
+	}
+	if !receiver.IfMisc && level == LogLevelMisc {
+		return false
+	}
+	if !receiver.IfDebug && level == LogLevelDebug {
+		return false
+	}
+	return true
+}
+
+// SetLevel 设置来源的级别上限，例如SetLevel("NEWS", LogLevelDebug)会记录NEWS的DEBUG及更重要的日志，立即生效
+func (receiver *XLog) SetLevel(from string, level LogLevel) {
+	receiver.rootLog().levels.set(from, level)
+}
+
+// ResetLevel 去掉来源的级别上限，恢复由IfMisc、IfDebug决定
+func (receiver *XLog) ResetLevel(from string) {
+	receiver.rootLog().levels.reset(from)
+}
+
+// Levels 返回所有设置了级别上限的来源
+func (receiver *XLog) Levels() map[string]LogLevel {
+	return receiver.rootLog().levels.all()
+}
+
+type levelJson struct {
+	From  string `json:"from"`
+	Level string `json:"level"`
+}
+
+// LevelHandler 查看与修改各来源的级别上限。
+// GET返回所有设置，PUT或POST ?from=NEWS&level=DEBUG 设置，DELETE ?from=NEWS 恢复默认。
+// 没有鉴权，需要由调用者挂在受保护的路由下
+func (receiver *XLog) LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		from := r.URL.Query().Get("from")
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			level, err := ParseLevel(r.URL.Query().Get("level"))
+			if from == "" || err != nil {
+				http.Error(w, "need from and a valid level", http.StatusBadRequest)
+				return
+			}
+			receiver.SetLevel(from, level)
+		case http.MethodDelete:
+			if from == "" {
+				http.Error(w, "need from", http.StatusBadRequest)
+				return
+			}
+			receiver.ResetLevel(from)
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		levels := receiver.Levels()
+		ret := make([]levelJson, 0, len(levels))
+		for f, level := range levels {
+			ret = append(ret, levelJson{From: f, Level: level.String()})
+		}
+		sort.Slice(ret, func(i, j int) bool {
+			return ret[i].From < ret[j].From
+		})
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(ret)
+	})
+}
+
+type limitKey struct {
+	from  string
+	level LogLevel
+}
+
+type limitBucket struct {
+	tokens     float64
+	last       time.Time
+	over       uint64 // 超出限制的次数，用于采样
+	suppressed uint64 // 上一条通过的日志之后被丢弃的数量
+}
+
+// limiter 按来源与级别的令牌桶
+type limiter struct {
+	setting LogLimit
+	lock    sync.Mutex
+	buckets map[limitKey]*limitBucket
+}
+
+func newLimiter(setting LogLimit) *limiter {
+	if setting.Rate <= 0 {
+		return nil
+	}
+	if setting.Burst <= 0 {
+		setting.Burst = 1
+	}
+	return &limiter{
+		setting: setting,
+		buckets: make(map[limitKey]*limitBucket),
+	}
+}
+
+// allow 返回是否记录，以及记录时之前被丢弃的数量
+func (l *limiter) allow(from string, level LogLevel, now time.Time) (bool, uint64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	k := limitKey{from: from, level: level}
+	b, ok := l.buckets[k]
+	if !ok {
+		b = &limitBucket{tokens: float64(l.setting.Burst), last: now}
+		l.buckets[k] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.setting.Rate
+	if b.tokens > float64(l.setting.Burst) {
+		b.tokens = float64(l.setting.Burst)
+	}
+	b.last = now
+	pass := false
+	if b.tokens >= 1 {
+		b.tokens--
+		pass = true
+	} else {
+		b.over++
+		pass = l.setting.SampleEvery > 0 && b.over%uint64(l.setting.SampleEvery) == 0
+	}
+	if !pass {
+		b.suppressed++
+		return false, 0
+	}
+	suppressed := b.suppressed
+	b.suppressed = 0
+	return true, suppressed
+}
@@ -4,8 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/intmian/mian_go_lib/tool/misc"
+	"io"
 	"os"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,6 +15,15 @@ import (
 type XLog struct {
 	LogSetting
 	misc.InitTag
+	root   *XLog   // With创建的子日志指向根日志，记录时使用根日志的配置
+	fields []Field // With预设的字段，会加在每条日志上
+	sinks  []ISink // Init时根据IfPrint、IfPush、IfFile与Sinks创建
+	async  *asyncWriter
+	levels *levelTable
+	limit  *limiter // 没有设置Limit时为nil
+	// 记录时持有读锁，Close时持有写锁，保证关闭输出时没有正在进行的记录
+	closeLock sync.RWMutex
+	closed    bool
 }
 
 // NewXLog 创建一个日志管理器
@@ -26,90 +37,223 @@ func NewXLog(setting LogSetting) (*XLog, error) {
 }
 
 func (receiver *XLog) Init(setting LogSetting) error {
-	if !setting.IfPrint && !setting.IfPush && !setting.IfFile {
+	var sinks []ISink
+	if setting.IfPrint {
+		sinks = append(sinks, &PrintSink{Printer: setting.Printer, Format: setting.PrintFormat})
+	}
+	var alert *AlertSink
+	if setting.IfPush && setting.Alert != nil {
+		alertSetting := *setting.Alert
+		if alertSetting.Pusher == nil && setting.PushMgr != nil {
+			alertSetting.Pusher = setting.PushMgr
+		}
+		if alertSetting.Tag == "" {
+			alertSetting.Tag = setting.LogTag
+		}
+		var err error
+		alert, err = NewAlertSink(alertSetting)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, alert)
+	} else if setting.IfPush {
+		sinks = append(sinks, &PushSink{PushMgr: setting.PushMgr, Tag: setting.LogTag})
+	}
+	if setting.IfFile {
+		sinks = append(sinks, &FileSink{Dir: setting.LogAddr, Format: setting.FileFormat})
+	}
+	sinks = append(sinks, setting.Sinks...)
+	if len(sinks) == 0 {
 		return ErrNoLogWay
 	}
 	receiver.LogSetting = setting
+	receiver.sinks = sinks
+	receiver.levels = newLevelTable(setting.Levels)
+	receiver.limit = newLimiter(setting.Limit)
 	// 如果文件夹不存在则创建
 	_, err := os.Stat(receiver.LogAddr)
 	if errors.Is(err, os.ErrNotExist) {
 		err = os.MkdirAll(receiver.LogAddr, os.ModePerm)
 		if err != nil {
+			if alert != nil {
+				_ = alert.Close()
+			}
 			return err
 		}
 	}
+	if setting.Async {
+		receiver.async = newAsyncWriter(receiver, setting.LogAsync)
+	}
 	receiver.SetInitialized()
 	return nil
 }
 
+// With 创建一个带有预设字段的子日志，子日志与根日志共用配置，之后根日志的修改对子日志同样生效
+func (receiver *XLog) With(fields ...Field) *XLog {
+	child := &XLog{
+		LogSetting: receiver.LogSetting,
+		root:       receiver.rootLog(),
+	}
+	child.fields = make([]Field, 0, len(receiver.fields)+len(fields))
+	child.fields = append(child.fields, receiver.fields...)
+	child.fields = append(child.fields, fields...)
+	return child
+}
+
+func (receiver *XLog) rootLog() *XLog {
+	if receiver.root != nil {
+		return receiver.root
+	}
+	return receiver
+}
+
 // Log 记录一条日志， from 中应填入来源模块的大写，
 // 例如from = "TEST"，则日志中会显示[TEST]，用于区分来源
 // 因为别的模块的error处理等都是通过日志模块来进行的，所以日志模块的错误处理只能通过print来进行
 func (receiver *XLog) Log(level LogLevel, from string, info string) {
-	if !receiver.IsInitialized() {
+	receiver.LogFields(level, from, info)
+}
+
+// LogFields 记录一条带有字段的日志，With预设的字段在前
+func (receiver *XLog) LogFields(level LogLevel, from string, info string, fields ...Field) {
+	root := receiver.rootLog()
+	if !root.IsInitialized() {
 		fmt.Println("日志模块未初始化！")
 		return
 	}
-	err := receiver.detailLog(level, from, info, receiver.IfMisc, receiver.IfDebug, receiver.IfPrint, receiver.IfPush, receiver.IfFile)
-
-	// 如果有错误，则排除发生错误的那一种记录方式并将剩余的记录方式记录，同时发送一个日志错误日志
-	canPrint := receiver.IfPrint
-	canPush := receiver.IfPush
-	canFile := receiver.IfFile
-	errorReason := ""
-	// 如果日志出现记录失败，则需要去除掉失败的方式重新记录记录失败
-	if err != nil {
-		if errors.Is(err, ErrPrintFail) {
-			canPrint = false
-			errorReason += "print failed;"
-		}
-		if errors.Is(err, ErrPushFail) || errors.Is(err, ErrPushPushDeerFail) || errors.Is(err, ErrPushEmailFail) || errors.Is(err, ErrPushDingFail) {
-			canPush = false
-			errorReason += "push failed;"
+	if len(receiver.fields) > 0 {
+		fields = append(append(make([]Field, 0, len(receiver.fields)+len(fields)), receiver.fields...), fields...)
+	}
+	entry := &Entry{
+		Level:  level,
+		Time:   time.Now(),
+		From:   from,
+		Msg:    info,
+		Fields: fields,
+	}
+	if !root.enabled(level, from) {
+		return
+	}
+	root.closeLock.RLock()
+	defer root.closeLock.RUnlock()
+	if root.closed {
+		return
+	}
+	if root.limit != nil {
+		ok, suppressed := root.limit.allow(from, level, entry.Time)
+		if !ok {
+			return
 		}
-		if errors.Is(err, ErrFileFail) {
-			canFile = false
-			errorReason += "file failed;"
+		if suppressed > 0 {
+			entry.Fields = append(entry.Fields[:len(entry.Fields):len(entry.Fields)], F("suppressed", suppressed))
 		}
-		errorReason = strings.TrimRight(errorReason, ";")
-		// 如果所有的记录方式都失败了，那么就直接print
-		if !canPrint && !canPush && !canFile {
-			fmt.Println("日志模块出现问题，无法记录日志！")
-			return
+	}
+	if root.async != nil && root.async.push(entry) {
+		return
+	}
+	root.write([]*Entry{entry})
+}
+
+// write 将日志写入所有输出，如果日志出现记录失败，则排除失败的输出，在剩余的输出中记录失败的原因
+func (receiver *XLog) write(entries []*Entry) {
+	errs := receiver.detailLog(entries, receiver.sinks)
+	if errs == nil {
+		return
+	}
+	var remain []ISink
+	var reasons []string
+	var fields []Field
+	for i, sink := range receiver.sinks {
+		err := errs[i]
+		if err == nil {
+			remain = append(remain, sink)
+			continue
 		}
-		err = receiver.detailLog(LogLevelError, "LOG", errorReason, true, true, canPrint, canPush, canFile)
-		if err != nil {
-			fmt.Println("日志模块出现问题，无法记录日志！")
+		reasons = append(reasons, sink.Name()+" failed")
+		fields = append(fields, F(sink.Name(), err))
+	}
+	// 如果所有的记录方式都失败了，那么就直接print
+	if len(remain) == 0 {
+		fmt.Println("日志模块出现问题，无法记录日志！")
+		return
+	}
+	errEntry := &Entry{
+		Level:  LogLevelError,
+		Time:   time.Now(),
+		From:   "LOG",
+		Msg:    strings.Join(reasons, ";"),
+		Fields: fields,
+	}
+	if receiver.detailLog([]*Entry{errEntry}, remain) != nil {
+		fmt.Println("日志模块出现问题，无法记录日志！")
+	}
+}
+
+// Flush 等待异步队列中已有的日志写入完成，同步模式下直接返回
+func (receiver *XLog) Flush() {
+	root := receiver.rootLog()
+	if root.async != nil {
+		root.async.flush()
+	}
+}
+
+// Close 写入异步队列中剩余的日志，并关闭所有实现了io.Closer的输出。
+// 关闭后的日志会被丢弃，重复关闭直接返回nil
+func (receiver *XLog) Close() error {
+	root := receiver.rootLog()
+	if !root.IsInitialized() {
+		return misc.ErrNotInit
+	}
+	root.closeLock.Lock()
+	defer root.closeLock.Unlock()
+	if root.closed {
+		return nil
+	}
+	root.closed = true
+	if root.async != nil {
+		root.async.close()
+	}
+	var err error
+	for _, sink := range root.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			err = errors.Join(err, closer.Close())
 		}
 	}
+	return err
 }
 
+// Error 等函数的参数中可以混入F创建的字段，字段不参与格式化
 func (receiver *XLog) Error(from string, format string, a ...interface{}) {
-	receiver.Log(LogLevelError, from, fmt.Sprintf(format, a...))
+	args, fields := splitFields(a)
+	receiver.LogFields(LogLevelError, from, fmt.Sprintf(format, args...), fields...)
 }
 
-func (receiver *XLog) ErrorErr(from string, err error) {
-	receiver.Log(LogLevelError, from, err.Error())
+func (receiver *XLog) ErrorErr(from string, err error, fields ...Field) {
+	receiver.LogFields(LogLevelError, from, err.Error(), fields...)
 }
 
 func (receiver *XLog) Warning(from string, format string, a ...interface{}) {
-	receiver.Log(LogLevelWarning, from, fmt.Sprintf(format, a...))
+	args, fields := splitFields(a)
+	receiver.LogFields(LogLevelWarning, from, fmt.Sprintf(format, args...), fields...)
 }
 
-func (receiver *XLog) WarningErr(from string, err error) {
-	receiver.Log(LogLevelWarning, from, err.Error())
+func (receiver *XLog) WarningErr(from string, err error, fields ...Field) {
+	receiver.LogFields(LogLevelWarning, from, err.Error(), fields...)
 }
 
 func (receiver *XLog) Info(from string, format string, a ...interface{}) {
-	receiver.Log(LogLevelInfo, from, fmt.Sprintf(format, a...))
+	args, fields := splitFields(a)
+	receiver.LogFields(LogLevelInfo, from, fmt.Sprintf(format, args...), fields...)
 }
 
 func (receiver *XLog) Misc(from string, format string, a ...interface{}) {
-	receiver.Log(LogLevelMisc, from, fmt.Sprintf(format, a...))
+	args, fields := splitFields(a)
+	receiver.LogFields(LogLevelMisc, from, fmt.Sprintf(format, args...), fields...)
 }
 
 func (receiver *XLog) Debug(from string, format string, a ...interface{}) {
-	receiver.Log(LogLevelDebug, from, fmt.Sprintf(format, a...))
+	args, fields := splitFields(a)
+	receiver.LogFields(LogLevelDebug, from, fmt.Sprintf(format, args...), fields...)
 }
 
 func GoWaitError(log *XLog, c <-chan error, from string, s string) {
@@ -132,78 +276,32 @@ var logLevel2Str = map[LogLevel]string{
 	LogLevelDebug:   "DEBUG",
 }
 
-// detailLog 根据日志配置，记录详细日志，并返回失败的模块
-func (receiver *XLog) detailLog(level LogLevel, from string, info string, ifMisc, ifDebug, ifPrint, ifPush, ifFile bool) error {
-	var err error
-	if !ifMisc && level == LogLevelMisc {
-		return nil
-	}
-	if !ifDebug && level == LogLevelDebug {
-		return nil
-	}
-
-	// log 格式为[级别]\t[日期]\t[发起人] 内容\n
-	sLevel := logLevel2Str[level]
-
-	t := time.Now()
-	ts := t.Format("2006-01-02 15:04:05")
-
-	content := parseLog(sLevel, ts, from, info)
-	receiver.OnLog(content)
-	if ifPrint {
-		var printContent string
-		switch level {
-		case LogLevelError:
-			printContent = misc.Red(content)
-		case LogLevelWarning:
-			printContent = misc.Yellow(content)
-		case LogLevelDebug:
-			printContent = misc.Green(content)
-		default:
-			printContent = content
-		}
-
-		if !receiver.Printer(printContent) {
-			err = errors.Join(err, ErrPrintFail)
+// detailLog 将日志写入sinks，实现了IBatchSink的输出一次写入。有输出失败时返回与sinks一一对应的错误，否则返回nil
+func (receiver *XLog) detailLog(entries []*Entry, sinks []ISink) []error {
+	if receiver.OnLog != nil {
+		for _, entry := range entries {
+			receiver.OnLog(entry.Format(receiver.OnLogFormat))
 		}
 	}
-
-	if ifPush && level <= LogLevelWarning {
-		err2 := receiver.PushMgr.Push(receiver.LogTag+" "+sLevel+" log", content, false)
-		if err2 != nil {
-			err = errors.Join(err, ErrPushFail)
-			err = errors.Join(err, err2)
+	var errs []error
+	for i, sink := range sinks {
+		var err error
+		if batch, ok := sink.(IBatchSink); ok && len(entries) > 1 {
+			err = batch.WriteBatch(entries)
+		} else {
+			for _, entry := range entries {
+				err = errors.Join(err, sink.Write(entry))
+			}
 		}
-	}
-
-	if ifFile {
-		fp, err2 := os.OpenFile(receiver.LogAddr+`/`+geneLogAddr(t),
-			os.O_WRONLY|os.O_APPEND|os.O_CREATE,
-			0666)
-		isErr := false
-		if err2 != nil {
-			isErr = true
-		}
-		_, err2 = fp.Write([]byte(content))
-		if err2 != nil {
-			isErr = true
+		if err == nil {
+			continue
 		}
-		err2 = fp.Close()
-		if err2 != nil {
-			isErr = true
-		}
-		if isErr {
-			err = errors.Join(err, ErrFileFail)
+		if errs == nil {
+			errs = make([]error, len(sinks))
 		}
+		errs[i] = err
 	}
-
-	return err
-}
-
-func parseLog(sLevel string, ts string, from string, info string) string {
-	perm := "[%s]\t[%s]\t[%s]\t%s\n"
-	perm = fmt.Sprintf(perm, sLevel, ts, from, info)
-	return perm
+	return errs
 }
 
 func geneLogAddr(t time.Time) string {
@@ -212,13 +310,17 @@ func geneLogAddr(t time.Time) string {
 }
 
 const (
-	ErrPrintFail        = misc.ErrStr("print failed")
-	ErrPushFail         = misc.ErrStr("push failed")
-	ErrPushPushDeerFail = misc.ErrStr("push failed")
-	ErrPushEmailFail    = misc.ErrStr("push failed")
-	ErrPushDingFail     = misc.ErrStr("push failed")
-	ErrFileFail         = misc.ErrStr("file failed")
-	ErrNoLogWay         = misc.ErrStr("no log way")
+	ErrPrintFail           = misc.ErrStr("print failed")
+	ErrPushFail            = misc.ErrStr("push failed")
+	ErrPushPushDeerFail    = misc.ErrStr("push failed")
+	ErrPushEmailFail       = misc.ErrStr("push failed")
+	ErrPushDingFail        = misc.ErrStr("push failed")
+	ErrFileFail            = misc.ErrStr("file failed")
+	ErrNoLogWay            = misc.ErrStr("no log way")
+	ErrLevelInvalid        = misc.ErrStr("log level invalid")
+	ErrSinkClosed          = misc.ErrStr("sink closed")
+	ErrRotateDirEmpty      = misc.ErrStr("rotate file dir is empty")
+	ErrSqliteSinkAddrEmpty = misc.ErrStr("sqlite sink addr is empty")
+	ErrSqliteSinkFields    = misc.ErrStr("sqlite sink fields format error")
+	ErrPusherIsNil         = misc.ErrStr("alert pusher is nil")
 )
-
-// TODO: 考虑一下接入更多的全量日志落盘、例如kafka或者sqlite，开放接口出去
@@ -1,7 +1,15 @@
 package xlog
 
 import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLog(t *testing.T) {
@@ -16,3 +24,440 @@ func TestLog(t *testing.T) {
 	l.Log(LogLevelMisc, "TEST", "testMisc")
 	l.Log(LogLevelDebug, "TEST", "testDebug")
 }
+
+func TestLogFields(t *testing.T) {
+	var contents []string
+	setting := DefaultSetting()
+	setting.LogAddr = t.TempDir()
+	setting.IfFile = false
+	setting.Printer = func(s string) bool {
+		return true
+	}
+	setting.OnLog = func(content string) {
+		contents = append(contents, content)
+	}
+	setting.OnLogFormat = LogFormatJSON
+	l, err := NewXLog(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	child := l.With(F("req", 7))
+	child.Info("TEST", "fetch %s done", "url", F("cost", 12), F("msg", "dup"))
+	var m map[string]interface{}
+	err = json.Unmarshal([]byte(contents[0]), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["level"] != "INFO" || m["from"] != "TEST" || m["msg"] != "fetch url done" || m["req"] != 7.0 || m["cost"] != 12.0 || m["fields.msg"] != "dup" {
+		t.Fatalf("json error %s", contents[0])
+	}
+	if !strings.HasPrefix(contents[0], `{"time":`) || !strings.HasSuffix(contents[0], "}\n") {
+		t.Fatalf("json order error %s", contents[0])
+	}
+
+	entry := &Entry{Level: LogLevelWarning, Time: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), From: "TEST", Msg: "a b", Fields: []Field{F("err", errors.New("x=1")), F("n", 1)}}
+	if s := entry.Format(LogFormatText); s != "[WARNING]\t[2024-01-02 03:04:05]\t[TEST]\ta b err=\"x=1\" n=1\n" {
+		t.Fatalf("text error %q", s)
+	}
+	if s := entry.Format(LogFormatLogfmt); s != "time=2024-01-02T03:04:05Z level=WARNING from=TEST msg=\"a b\" err=\"x=1\" n=1\n" {
+		t.Fatalf("logfmt error %q", s)
+	}
+	entry.Fields = nil
+	if s := entry.Format(LogFormatText); s != "[WARNING]\t[2024-01-02 03:04:05]\t[TEST]\ta b\n" {
+		t.Fatalf("text without fields error %q", s)
+	}
+}
+
+type failSink struct{}
+
+func (failSink) Name() string {
+	return "fail"
+}
+
+func (failSink) Write(entry *Entry) error {
+	return errors.New("disk full")
+}
+
+func TestLogSink(t *testing.T) {
+	dir := t.TempDir()
+	var printed []string
+	setting := DefaultSetting()
+	setting.LogAddr = dir
+	setting.IfFile = false
+	setting.Printer = func(s string) bool {
+		printed = append(printed, s)
+		return true
+	}
+	setting.PrintFormat = LogFormatLogfmt
+
+	rotate, err := NewRotateFileSink(RotateFileSetting{
+		Dir:        dir,
+		FileName:   "app.log",
+		MaxSize:    200,
+		Compress:   true,
+		MaxBackups: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewSqliteSink(dir + "/log.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting.Sinks = []ISink{failSink{}, rotate, db}
+	l, err := NewXLog(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 失败的输出被排除，在其他输出中记录原因
+	l.Error("TEST", "boom")
+	if len(printed) != 2 || !strings.Contains(printed[1], `msg="fail failed"`) || !strings.Contains(printed[1], `fail="disk full"`) {
+		t.Fatalf("fail sink not reported %q", printed)
+	}
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		from := "NEWS"
+		if i%2 == 0 {
+			from = "STORAGE"
+		}
+		l.Info(from, "line %d", i, F("i", i))
+	}
+	l.Warning("NEWS", "slow")
+	err = l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	gz := 0
+	for _, f := range files {
+		if strings.HasPrefix(f.Name(), "app-") {
+			if !strings.HasSuffix(f.Name(), ".log.gz") {
+				t.Fatalf("backup should be compressed %s", f.Name())
+			}
+			gz++
+		}
+	}
+	if gz != 2 {
+		t.Fatalf("backups should be limited to 2, got %d", gz)
+	}
+	info, err := os.Stat(dir + "/app.log")
+	if err != nil || info.Size() > 200 {
+		t.Fatalf("current file error %v %v", info, err)
+	}
+
+	db, err = NewSqliteSink(dir + "/log.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	entries, err := db.Query(LogQuery{From: "NEWS", Levels: []LogLevel{LogLevelInfo}, Start: start})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 || entries[0].Msg != "line 1" || entries[0].Fields[0].Key != "i" || entries[0].Fields[0].Value != 1.0 {
+		t.Fatalf("query error %+v", entries)
+	}
+	entries, _ = db.Query(LogQuery{From: "NEWS", Desc: true, Limit: 1})
+	if len(entries) != 1 || entries[0].Msg != "slow" {
+		t.Fatalf("query desc error %+v", entries)
+	}
+	entries, _ = db.Query(LogQuery{End: start, From: "LOG"})
+	if len(entries) != 1 || entries[0].Msg != "fail failed" {
+		t.Fatalf("query end error %+v", entries)
+	}
+}
+
+type gateSink struct {
+	gate    chan struct{}
+	lock    sync.Mutex
+	entries []*Entry
+	batches int
+}
+
+func (s *gateSink) Name() string {
+	return "gate"
+}
+
+func (s *gateSink) Write(entry *Entry) error {
+	return s.WriteBatch([]*Entry{entry})
+}
+
+func (s *gateSink) WriteBatch(entries []*Entry) error {
+	<-s.gate
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.entries = append(s.entries, entries...)
+	s.batches++
+	return nil
+}
+
+func (s *gateSink) count(msg string) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	n := 0
+	for _, e := range s.entries {
+		if strings.HasPrefix(e.Msg, msg) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLogAsync(t *testing.T) {
+	dir := t.TempDir()
+	newLog := func(sink ISink, async LogAsync) *XLog {
+		setting := DefaultSetting()
+		setting.LogAddr = dir
+		setting.IfPrint = false
+		setting.Sinks = []ISink{sink}
+		setting.LogAsync = async
+		l, err := NewXLog(setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+
+	// 阻塞模式不丢失日志，并且按批写入
+	gate := make(chan struct{})
+	close(gate)
+	sink := &gateSink{gate: gate}
+	l := newLog(sink, LogAsync{Async: true, QueueSize: 16, BatchSize: 8})
+	for i := 0; i < 100; i++ {
+		l.With(F("i", i)).Info("TEST", "line")
+	}
+	l.Flush()
+	if sink.count("line") != 100 || sink.batches >= 100 {
+		t.Fatalf("block mode error %d %d", sink.count("line"), sink.batches)
+	}
+	err := l.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Info("TEST", "after close")
+	if sink.count("after close") != 0 {
+		t.Fatal("log after close should be dropped")
+	}
+	if l.Close() != nil {
+		t.Fatal("close twice should return nil")
+	}
+	b, _ := os.ReadFile(dir + "/" + geneLogAddr(time.Now()))
+	if strings.Count(string(b), "line") != 100 {
+		t.Fatalf("file sink should keep all lines, got %d", strings.Count(string(b), "line"))
+	}
+
+	// 丢弃模式下调用者不会被慢的输出阻塞
+	sink = &gateSink{gate: make(chan struct{})}
+	l = newLog(sink, LogAsync{Async: true, QueueSize: 4, BatchSize: 1, FullPolicy: AsyncFullDrop})
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 20; i++ {
+			l.Info("TEST", "drop")
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("drop mode should not block")
+	}
+	dropped := l.Dropped()
+	if dropped < 15 || l.DroppedByLevel()[LogLevelInfo] != dropped {
+		t.Fatalf("dropped error %d %v", dropped, l.DroppedByLevel())
+	}
+	close(sink.gate)
+	l.Flush()
+	if uint64(sink.count("drop")) != 20-dropped || sink.count("async queue is full") != 1 {
+		t.Fatalf("written error %d %d", sink.count("drop"), sink.count("async queue is full"))
+	}
+	_ = l.Close()
+}
+
+func TestLogLevel(t *testing.T) {
+	var contents []string
+	setting := DefaultSetting()
+	setting.LogAddr = t.TempDir()
+	setting.IfFile = false
+	setting.Printer = func(s string) bool {
+		contents = append(contents, s)
+		return true
+	}
+	setting.PrintFormat = LogFormatLogfmt
+	setting.Levels = map[string]LogLevel{"NEWS": LogLevelDebug, "STORAGE": LogLevelWarning}
+	setting.Limit = LogLimit{Rate: 0.001, Burst: 2, SampleEvery: 5}
+	l, err := NewXLog(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := func() int {
+		n := len(contents)
+		contents = nil
+		return n
+	}
+	l.Debug("NEWS", "debug")
+	l.Info("STORAGE", "info")
+	l.Warning("STORAGE", "warning")
+	l.Debug("OTHER", "debug")
+	if n := count(); n != 2 {
+		t.Fatalf("per module level error %d", n)
+	}
+
+	// 运行时通过http修改
+	h := l.LevelHandler()
+	req := httptest.NewRequest(http.MethodPut, "/?from=STORAGE&level=info", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `{"from":"STORAGE","level":"INFO"}`) {
+		t.Fatalf("set level error %d %s", rec.Code, rec.Body.String())
+	}
+	l.With(F("a", 1)).Info("STORAGE", "info")
+	if n := count(); n != 1 {
+		t.Fatalf("level change should take effect %d", n)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/?from=NEWS", nil))
+	if _, ok := l.Levels()["NEWS"]; ok || rec.Code != http.StatusOK {
+		t.Fatal("reset level error")
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/?from=NEWS&level=LOUD", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatal("invalid level should fail")
+	}
+
+	// 同一来源与级别的日志超出限制后按采样记录，记录时带上丢弃的数量
+	for i := 0; i < 12; i++ {
+		l.Error("HOT", "boom")
+	}
+	if len(contents) != 4 || !strings.Contains(contents[2], "suppressed=4") || !strings.Contains(contents[3], "suppressed=4") {
+		t.Fatalf("limit error %q", contents)
+	}
+	contents = nil
+	l.Warning("HOT", "other level")
+	if n := count(); n != 1 {
+		t.Fatal("limit should be per level")
+	}
+}
+
+type fakePusher struct {
+	lock     sync.Mutex
+	titles   []string
+	contents []string
+}
+
+func (p *fakePusher) Push(title string, content string, markDown bool) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.titles = append(p.titles, title)
+	p.contents = append(p.contents, content)
+	return nil
+}
+
+func (p *fakePusher) take() []string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	ret := p.contents
+	p.titles = nil
+	p.contents = nil
+	return ret
+}
+
+func TestLogAlert(t *testing.T) {
+	pusher := &fakePusher{}
+	setting := DefaultSetting()
+	setting.LogAddr = t.TempDir()
+	setting.IfPrint = false
+	setting.IfFile = false
+	setting.IfPush = true
+	setting.LogTag = "TEST"
+	setting.Alert = &AlertSetting{
+		Pusher:     pusher,
+		Window:     time.Hour,
+		Thresholds: map[LogLevel]int{LogLevelError: 1, LogLevelWarning: 3},
+		Quiet:      QuietHours{Start: 23 * time.Hour, End: 7 * time.Hour},
+	}
+	l, err := NewXLog(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alert := l.sinks[0].(*AlertSink)
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.Local)
+	alert.now = func() time.Time { return now }
+
+	// 相同的日志合并，未达到阈值的级别不推送
+	for i := 0; i < 5; i++ {
+		l.Error("NEWS", "fetch failed")
+	}
+	l.Warning("NEWS", "slow")
+	l.Warning("NEWS", "slow")
+	l.Info("NEWS", "info")
+	if err := alert.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	contents := pusher.take()
+	if len(contents) != 1 || !strings.Contains(contents[0], "**5×** [ERROR] [NEWS] fetch failed") ||
+		strings.Contains(contents[0], "slow") || !strings.Contains(contents[0], "TEST alert 5×") {
+		t.Fatalf("alert digest error %q", contents)
+	}
+
+	// 免打扰期间保留，结束后推送
+	now = time.Date(2024, 1, 1, 23, 30, 0, 0, time.Local)
+	l.Warning("NEWS", "slow")
+	l.Warning("NEWS", "slow")
+	_ = alert.Flush()
+	now = time.Date(2024, 1, 2, 6, 59, 0, 0, time.Local)
+	l.Warning("NEWS", "slow")
+	_ = alert.Flush()
+	if len(pusher.take()) != 0 {
+		t.Fatal("quiet hours should not push")
+	}
+	now = time.Date(2024, 1, 2, 7, 0, 0, 0, time.Local)
+	_ = alert.Flush()
+	contents = pusher.take()
+	if len(contents) != 1 || !strings.Contains(contents[0], "**3×** [WARNING] [NEWS] slow") {
+		t.Fatalf("alert after quiet hours error %q", contents)
+	}
+
+	// Close时推送剩余的汇总
+	l.Error("NEWS", "last")
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+	contents = pusher.take()
+	if len(contents) != 1 || !strings.Contains(contents[0], "**1×** [ERROR] [NEWS] last") {
+		t.Fatalf("alert close error %q", contents)
+	}
+
+	// 超出MaxGroups的日志按级别计数，同样需要达到阈值
+	s, err := NewAlertSink(AlertSetting{
+		Pusher:     pusher,
+		Window:     time.Hour,
+		Thresholds: map[LogLevel]int{LogLevelError: 1, LogLevelWarning: 3},
+		MaxGroups:  1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	write := func(level LogLevel, msg string) {
+		_ = s.Write(&Entry{Level: level, Time: time.Now(), From: "NEWS", Msg: msg})
+	}
+	write(LogLevelWarning, "w0")
+	write(LogLevelWarning, "w1")
+	write(LogLevelWarning, "w2")
+	_ = s.Flush()
+	if contents = pusher.take(); len(contents) != 0 {
+		t.Fatalf("overflow under threshold should not push %q", contents)
+	}
+	write(LogLevelError, "e0")
+	write(LogLevelError, "e1")
+	write(LogLevelWarning, "w1")
+	_ = s.Flush()
+	contents = pusher.take()
+	if len(contents) != 1 || !strings.Contains(contents[0], "**1×** other [ERROR] logs") || strings.Contains(contents[0], "WARNING") {
+		t.Fatalf("overflow digest error %q", contents)
+	}
+}
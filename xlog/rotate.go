@@ -0,0 +1,293 @@
+package xlog
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotateFileSetting 文件超过MaxSize或者打开超过MaxAge后切分，旧文件重命名为 名称-时间.扩展名，可以压缩为.gz
+type RotateFileSetting struct {
+	Dir        string
+	FileName   string // 当前写入的文件名，为空时为xlog.log
+	Format     LogFormat
+	MaxSize    int64         // 单个文件的最大字节数，<=0时不按大小切分
+	MaxAge     time.Duration // 单个文件的最长写入时间，<=0时不按时间切分
+	Compress   bool          // 是否将旧文件压缩为gzip
+	MaxBackups int           // 最多保留的旧文件数量，<=0时不限制
+	Retention  time.Duration // 旧文件的保留时间，<=0时不限制
+}
+
+// backupTimeFormat 旧文件名中的时间，不使用:以兼容windows
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// RotateFileSink 按大小与时间切分的文件输出，文件保持打开，压缩与清理旧文件在后台进行
+type RotateFileSink struct {
+	setting RotateFileSetting
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	openAt  time.Time
+	closed  bool
+	// 压缩与清理同时只进行一个
+	millLock sync.Mutex
+	millWg   sync.WaitGroup
+}
+
+func NewRotateFileSink(setting RotateFileSetting) (*RotateFileSink, error) {
+	if setting.Dir == "" {
+		return nil, ErrRotateDirEmpty
+	}
+	if setting.FileName == "" {
+		setting.FileName = "xlog.log"
+	}
+	err := os.MkdirAll(setting.Dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &RotateFileSink{setting: setting}, nil
+}
+
+func (s *RotateFileSink) Name() string {
+	return "rotate file"
+}
+
+func (s *RotateFileSink) Write(entry *Entry) error {
+	return s.WriteBytes([]byte(entry.Format(s.setting.Format)))
+}
+
+// WriteBatch 多条日志只加一次锁，每条写入前判断是否需要切分
+func (s *RotateFileSink) WriteBatch(entries []*Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, entry := range entries {
+		err := s.write([]byte(entry.Format(s.setting.Format)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteBytes 写入已经格式化的内容，写入前判断是否需要切分
+func (s *RotateFileSink) WriteBytes(b []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.write(b)
+}
+
+// write 调用时需要持有锁
+func (s *RotateFileSink) write(b []byte) error {
+	if s.closed {
+		return ErrSinkClosed
+	}
+	if s.file == nil {
+		err := s.open()
+		if err != nil {
+			return err
+		}
+	}
+	needRotate := s.setting.MaxSize > 0 && s.size > 0 && s.size+int64(len(b)) > s.setting.MaxSize
+	needRotate = needRotate || s.setting.MaxAge > 0 && time.Since(s.openAt) >= s.setting.MaxAge
+	if needRotate {
+		err := s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+// Rotate 立即切分
+func (s *RotateFileSink) Rotate() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return ErrSinkClosed
+	}
+	if s.file == nil {
+		err := s.open()
+		if err != nil {
+			return err
+		}
+	}
+	return s.rotate()
+}
+
+// Close 关闭文件并等待后台的压缩与清理完成
+func (s *RotateFileSink) Close() error {
+	s.lock.Lock()
+	var err error
+	if !s.closed {
+		s.closed = true
+		if s.file != nil {
+			err = s.file.Close()
+			s.file = nil
+		}
+	}
+	s.lock.Unlock()
+	s.millWg.Wait()
+	return err
+}
+
+func (s *RotateFileSink) filename() string {
+	return filepath.Join(s.setting.Dir, s.setting.FileName)
+}
+
+func (s *RotateFileSink) open() error {
+	f, err := os.OpenFile(s.filename(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	s.file = f
+	s.size = info.Size()
+	s.openAt = time.Now()
+	return nil
+}
+
+// rotate 将当前文件重命名为旧文件并打开新文件，调用时需要持有锁
+func (s *RotateFileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+	if s.size > 0 {
+		ext := filepath.Ext(s.setting.FileName)
+		prefix := strings.TrimSuffix(s.setting.FileName, ext) + "-"
+		t := time.Now()
+		name := filepath.Join(s.setting.Dir, prefix+t.Format(backupTimeFormat)+ext)
+		// 同一毫秒内多次切分时顺延
+		for exists(name) || exists(name+".gz") {
+			t = t.Add(time.Millisecond)
+			name = filepath.Join(s.setting.Dir, prefix+t.Format(backupTimeFormat)+ext)
+		}
+		err = os.Rename(s.filename(), name)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.open()
+	if err != nil {
+		return err
+	}
+	s.millWg.Add(1)
+	go s.mill()
+	return nil
+}
+
+type backupFile struct {
+	path string
+	t    time.Time
+	gz   bool
+}
+
+// mill 压缩旧文件并按数量与时间清理
+func (s *RotateFileSink) mill() {
+	defer s.millWg.Done()
+	s.millLock.Lock()
+	defer s.millLock.Unlock()
+	backups, err := s.backups()
+	if err != nil {
+		return
+	}
+	var remain []backupFile
+	for i, b := range backups {
+		expired := s.setting.Retention > 0 && time.Since(b.t) > s.setting.Retention
+		if expired || s.setting.MaxBackups > 0 && i >= s.setting.MaxBackups {
+			_ = os.Remove(b.path)
+			continue
+		}
+		remain = append(remain, b)
+	}
+	if !s.setting.Compress {
+		return
+	}
+	for _, b := range remain {
+		if b.gz {
+			continue
+		}
+		_ = gzipFile(b.path)
+	}
+}
+
+// backups 返回所有旧文件，新的在前
+func (s *RotateFileSink) backups() ([]backupFile, error) {
+	entries, err := os.ReadDir(s.setting.Dir)
+	if err != nil {
+		return nil, err
+	}
+	ext := filepath.Ext(s.setting.FileName)
+	prefix := strings.TrimSuffix(s.setting.FileName, ext) + "-"
+	var ret []backupFile
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		b := backupFile{path: filepath.Join(s.setting.Dir, name)}
+		rest := strings.TrimPrefix(name, prefix)
+		if strings.HasSuffix(rest, ext+".gz") {
+			b.gz = true
+			rest = strings.TrimSuffix(rest, ext+".gz")
+		} else if strings.HasSuffix(rest, ext) {
+			rest = strings.TrimSuffix(rest, ext)
+		} else {
+			continue
+		}
+		t, err := time.ParseInLocation(backupTimeFormat, rest, time.Local)
+		if err != nil {
+			continue
+		}
+		b.t = t
+		ret = append(ret, b)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].t.After(ret[j].t)
+	})
+	return ret, nil
+}
+
+// gzipFile 压缩为path.gz后删除原文件，失败时保留原文件
+func gzipFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	_, err = io.Copy(zw, src)
+	err = errors.Join(err, zw.Close(), dst.Close())
+	if err != nil {
+		_ = os.Remove(path + ".gz")
+		return err
+	}
+	_ = src.Close()
+	return os.Remove(path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
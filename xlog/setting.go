@@ -7,12 +7,14 @@ type LogSetting struct {
 	LogPrint
 	LogStrategy
 	LogRecordStrategy
+	LogOutputFormat
+	LogAsync
 	PushInfo
 	Extend
 }
 
 type Extend struct {
-	OnLog func(content string)
+	OnLog func(content string) // 每条日志都会调用，可以为nil
 }
 
 type Printer func(string) bool
@@ -20,16 +22,46 @@ type Printer func(string) bool
 type LogStrategy struct {
 	IfMisc  bool
 	IfDebug bool
+	// Levels 按来源设置的级别上限，只记录不超过上限的日志，例如{"NEWS": LogLevelDebug, "STORAGE": LogLevelWarning}。
+	// 没有设置的来源由IfMisc、IfDebug决定，运行时可以通过SetLevel、LevelHandler修改
+	Levels map[string]LogLevel
+	Limit  LogLimit
+}
+
+// LogLimit 按来源与级别限制日志的频率，超出的日志在所有输出前被丢弃，之后第一条记录的日志带上suppressed字段
+type LogLimit struct {
+	Rate        float64 // 每秒平均允许的条数，<=0时不限制
+	Burst       int     // 允许的突发条数，<=0时为1
+	SampleEvery int     // 超出限制后每SampleEvery条仍然记录一条，<=0时全部丢弃
+}
+
+// LogOutputFormat 各输出的格式，默认为文本格式，推送固定使用文本格式
+type LogOutputFormat struct {
+	PrintFormat LogFormat
+	FileFormat  LogFormat
+	OnLogFormat LogFormat // Extend.OnLog收到的格式
+}
+
+// LogAsync 异步记录，日志先放入有界队列，由后台goroutine按批写入各个输出，调用者不会被慢的输出阻塞。
+// 开启后需要在退出前调用XLog.Close，否则队列中的日志会丢失
+type LogAsync struct {
+	Async      bool
+	QueueSize  int             // 队列长度，<=0时为1024
+	BatchSize  int             // 每批最多写入的条数，<=0时为128
+	FullPolicy AsyncFullPolicy // 队列满时的处理方式
 }
 
 type LogRecordStrategy struct {
 	IfPrint bool
 	IfPush  bool
 	IfFile  bool
+	Sinks   []ISink // 额外的输出，例如RotateFileSink、SqliteSink
 }
 
 type PushInfo struct {
 	PushMgr *xpush.XPush
+	// Alert 不为nil时推送经过聚合，按窗口合并相同的日志后推送汇总，Pusher为空时使用PushMgr，Tag为空时使用LogTag
+	Alert *AlertSetting
 }
 
 type LogPrint struct {
@@ -0,0 +1,151 @@
+package xlog
+
+import (
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/intmian/mian_go_lib/tool/misc"
+	"github.com/intmian/mian_go_lib/xpush"
+)
+
+// ISink 日志的输出目标。Write返回错误时，XLog会在其他输出中记录一条错误日志。
+// 实现了io.Closer的输出会在XLog.Close时关闭
+type ISink interface {
+	// Name 用于在错误日志中标识输出
+	Name() string
+	Write(entry *Entry) error
+}
+
+// IBatchSink 可以一次写入多条日志的输出，异步模式下按批写入
+type IBatchSink interface {
+	ISink
+	WriteBatch(entries []*Entry) error
+}
+
+// PrintSink 输出到Printer，文本格式时按级别加上颜色
+type PrintSink struct {
+	Printer Printer
+	Format  LogFormat
+}
+
+func (s *PrintSink) Name() string {
+	return "print"
+}
+
+func (s *PrintSink) Write(entry *Entry) error {
+	content := entry.Format(s.Format)
+	// 只有文本格式加颜色，其他格式需要保持可以被解析
+	if s.Format == LogFormatText {
+		switch entry.Level {
+		case LogLevelError:
+			content = misc.Red(content)
+		case LogLevelWarning:
+			content = misc.Yellow(content)
+		case LogLevelDebug:
+			content = misc.Green(content)
+		}
+	}
+	if !s.Printer(content) {
+		return ErrPrintFail
+	}
+	return nil
+}
+
+// PushSink 推送ERROR与WARNING，固定使用文本格式
+type PushSink struct {
+	PushMgr *xpush.XPush
+	Tag     string // 不为空时加在标题前，用于区分来源
+}
+
+func (s *PushSink) Name() string {
+	return "push"
+}
+
+func (s *PushSink) Write(entry *Entry) error {
+	if entry.Level > LogLevelWarning {
+		return nil
+	}
+	err := s.PushMgr.Push(s.Tag+" "+logLevel2Str[entry.Level]+" log", entry.Format(LogFormatText), false)
+	if err != nil {
+		return errors.Join(ErrPushFail, err)
+	}
+	return nil
+}
+
+// FileSink 按天写入Dir下的文件，文件名为年_月_日.log，文件保持打开，日期变化时切换
+type FileSink struct {
+	Dir    string
+	Format LogFormat
+	lock   sync.Mutex
+	file   *os.File
+	name   string // 当前打开的文件名
+}
+
+func (s *FileSink) Name() string {
+	return "file"
+}
+
+func (s *FileSink) Write(entry *Entry) error {
+	return s.WriteBatch([]*Entry{entry})
+}
+
+// WriteBatch 同一天的日志合并为一次写入
+func (s *FileSink) WriteBatch(entries []*Entry) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var buf []byte
+	name := ""
+	for _, entry := range entries {
+		n := geneLogAddr(entry.Time)
+		if n != name && len(buf) > 0 {
+			err := s.writeTo(name, buf)
+			if err != nil {
+				return err
+			}
+			buf = buf[:0]
+		}
+		name = n
+		buf = append(buf, entry.Format(s.Format)...)
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	return s.writeTo(name, buf)
+}
+
+func (s *FileSink) writeTo(name string, b []byte) error {
+	if s.file == nil || s.name != name {
+		if s.file != nil {
+			_ = s.file.Close()
+			s.file = nil
+		}
+		fp, err := os.OpenFile(s.Dir+`/`+name,
+			os.O_WRONLY|os.O_APPEND|os.O_CREATE,
+			0666)
+		if err != nil {
+			return errors.Join(ErrFileFail, err)
+		}
+		s.file = fp
+		s.name = name
+	}
+	_, err := s.file.Write(b)
+	if err != nil {
+		// 下次写入时重新打开
+		_ = s.file.Close()
+		s.file = nil
+		return errors.Join(ErrFileFail, err)
+	}
+	return nil
+}
+
+func (s *FileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
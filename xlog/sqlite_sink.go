@@ -0,0 +1,189 @@
+package xlog
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// LogModel SqliteSink中的一行
+type LogModel struct {
+	ID     uint64   `gorm:"primaryKey;autoIncrement"`
+	Time   int64    `gorm:"index"` // 纳秒时间戳
+	Level  LogLevel `gorm:"index"`
+	From   string   `gorm:"index;size:64"`
+	Msg    string
+	Fields string // json数组，保持字段的顺序
+}
+
+func (LogModel) TableName() string {
+	return "xlog"
+}
+
+type fieldModel struct {
+	K string      `json:"k"`
+	V interface{} `json:"v"`
+}
+
+// SqliteSink 将日志写入sqlite，可以按时间、级别与来源查询
+type SqliteSink struct {
+	db     *gorm.DB
+	lock   sync.RWMutex
+	closed bool
+}
+
+func NewSqliteSink(addr string) (*SqliteSink, error) {
+	if addr == "" {
+		return nil, ErrSqliteSinkAddrEmpty
+	}
+	db, err := gorm.Open(sqlite.Open(addr), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = db.AutoMigrate(&LogModel{})
+	if err != nil {
+		return nil, err
+	}
+	return &SqliteSink{db: db}, nil
+}
+
+func (s *SqliteSink) Name() string {
+	return "sqlite"
+}
+
+func (s *SqliteSink) Write(entry *Entry) error {
+	return s.WriteBatch([]*Entry{entry})
+}
+
+// WriteBatch 在一个事务中写入多条日志
+func (s *SqliteSink) WriteBatch(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	models := make([]LogModel, 0, len(entries))
+	for _, entry := range entries {
+		fields := make([]fieldModel, 0, len(entry.Fields))
+		for _, f := range entry.Fields {
+			fields = append(fields, fieldModel{K: f.Key, V: fieldValue(f.Value)})
+		}
+		b, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		models = append(models, LogModel{
+			Time:   entry.Time.UnixNano(),
+			Level:  entry.Level,
+			From:   entry.From,
+			Msg:    entry.Msg,
+			Fields: string(b),
+		})
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return ErrSinkClosed
+	}
+	return s.db.Create(&models).Error
+}
+
+// LogQuery 查询条件，所有条件取交集
+type LogQuery struct {
+	Start  time.Time  // 包含，零值时不限制
+	End    time.Time  // 不包含，零值时不限制
+	Levels []LogLevel // 为空时不限制
+	From   string     // 为空时不限制
+	Limit  int        // <=0时不限制
+	Offset int
+	Desc   bool // 是否按时间倒序
+}
+
+// Query 按条件查询日志，默认按时间升序
+func (s *SqliteSink) Query(q LogQuery) ([]Entry, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return nil, ErrSinkClosed
+	}
+	db := s.db.Model(&LogModel{})
+	if !q.Start.IsZero() {
+		db = db.Where("time >= ?", q.Start.UnixNano())
+	}
+	if !q.End.IsZero() {
+		db = db.Where("time < ?", q.End.UnixNano())
+	}
+	if len(q.Levels) > 0 {
+		db = db.Where("level IN ?", q.Levels)
+	}
+	if q.From != "" {
+		db = db.Where("`from` = ?", q.From)
+	}
+	if q.Desc {
+		db = db.Order("time DESC, id DESC")
+	} else {
+		db = db.Order("time, id")
+	}
+	if q.Limit > 0 {
+		db = db.Limit(q.Limit)
+	}
+	if q.Offset > 0 {
+		db = db.Offset(q.Offset)
+	}
+	var models []LogModel
+	err := db.Find(&models).Error
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]Entry, 0, len(models))
+	for _, m := range models {
+		e := Entry{
+			Level: m.Level,
+			Time:  time.Unix(0, m.Time),
+			From:  m.From,
+			Msg:   m.Msg,
+		}
+		var fields []fieldModel
+		if m.Fields != "" {
+			err = json.Unmarshal([]byte(m.Fields), &fields)
+			if err != nil {
+				return nil, errors.Join(ErrSqliteSinkFields, err)
+			}
+		}
+		for _, f := range fields {
+			e.Fields = append(e.Fields, F(f.K, f.V))
+		}
+		ret = append(ret, e)
+	}
+	return ret, nil
+}
+
+// DeleteBefore 删除t之前的日志，返回删除的数量
+func (s *SqliteSink) DeleteBefore(t time.Time) (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if s.closed {
+		return 0, ErrSinkClosed
+	}
+	result := s.db.Where("time < ?", t.UnixNano()).Delete(&LogModel{})
+	return result.RowsAffected, result.Error
+}
+
+func (s *SqliteSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	sqlDB, err := s.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
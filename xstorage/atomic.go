@@ -0,0 +1,191 @@
+package xstorage
+
+import (
+	"errors"
+	"github.com/intmian/mian_go_lib/tool/misc"
+	"time"
+)
+
+// Update 原子的读改写。无论是否开启MultiSafe都会加锁，使用数据库时读写在同一个事务中完成，
+// 所以与其他同样使用Update的进程之间也不会丢失修改。返回写入后的值，fn返回nil时不做修改并返回当前值
+func (m *XStorage) Update(key string, fn UpdateFunc) (*ValueUnit, error) {
+	if !m.observers.has() {
+		ret, _, err := m.update(key, fn)
+		return ret, err
+	}
+	start := time.Now()
+	ret, written, err := m.update(key, fn)
+	// 没有写入时不算一次Set，例如CompareAndSwap不匹配
+	if written || err != nil {
+		m.observers.publish(OpEvent{Op: OpSet, Source: m.directSource(), Key: key, Start: start, Duration: time.Since(start), Err: err})
+	}
+	return ret, err
+}
+
+// update 返回写入后的值与是否写入
+func (m *XStorage) update(key string, fn UpdateFunc) (*ValueUnit, bool, error) {
+	if !m.initTag.IsInitialized() {
+		return nil, false, ErrMgrNotInit
+	}
+	if key == "" {
+		return nil, false, ErrKeyIsEmpty
+	}
+	if fn == nil {
+		return nil, false, ErrParamIsNil
+	}
+	m.rwLock.Lock()
+	defer m.rwLock.Unlock()
+
+	var old, newValue *ValueUnit
+	t := m.setting.SaveType
+	if misc.HasProperty(m.setting.Property, UseDisk) && t.isDB() {
+		// 以数据库中的值为准，写回模式下需要先落盘
+		err := m.flushDirty(key)
+		if err != nil {
+			return nil, false, errors.Join(ErrUpdateValue, err)
+		}
+		ret, err := m.dbCore.Update(key, func(dbOld *ValueUnit) (*ValueUnit, error) {
+			old = dbOld
+			v, err := fn(dbOld)
+			newValue = v
+			return v, err
+		})
+		if err != nil {
+			return nil, false, errors.Join(ErrUpdateValue, err)
+		}
+		if newValue == nil {
+			return ret, false, nil
+		}
+		if misc.HasProperty(m.setting.Property, UseCache) {
+			err = m.recordToMap(key, newValue)
+			if err != nil {
+				return nil, false, errors.Join(ErrRecordToMap, err)
+			}
+		}
+	} else {
+		old = m.loadOldValue(key)
+		v, err := fn(old)
+		if err != nil {
+			return nil, false, errors.Join(ErrUpdateValue, err)
+		}
+		if v == nil {
+			return old, false, nil
+		}
+		newValue = v
+		err = m.recordToMap(key, newValue)
+		if err != nil {
+			return nil, false, errors.Join(ErrRecordToMap, err)
+		}
+		if misc.HasProperty(m.setting.Property, UseDisk) {
+			err = m.saveFile()
+			if err != nil {
+				// 回滚缓存
+				if old == nil {
+					_ = m.removeFromMap(key)
+				} else {
+					_ = m.recordToMap(key, old)
+				}
+				return nil, false, errors.Join(ErrUpdateValue, err)
+			}
+		}
+	}
+	if m.watchHub.has(key) {
+		m.watchHub.publish(newWatchEvent(key, old, newValue))
+	}
+	ret := &ValueUnit{}
+	Copy(newValue, ret)
+	return ret, true, nil
+}
+
+// CompareAndSwap 当key的当前值与old相同时写入newValue，old为nil代表期望key不存在。返回是否写入
+func (m *XStorage) CompareAndSwap(key string, old *ValueUnit, newValue *ValueUnit) (bool, error) {
+	if newValue == nil {
+		return false, ErrValueIsNil
+	}
+	swapped := false
+	_, err := m.Update(key, func(cur *ValueUnit) (*ValueUnit, error) {
+		if cur == nil || old == nil {
+			if cur != old {
+				return nil, nil
+			}
+		} else if !Compare(cur, old) {
+			return nil, nil
+		}
+		swapped = true
+		return newValue, nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return swapped, nil
+}
+
+// Incr 将数值类型的值加上delta，key不存在时视为0，返回相加后的值。过期时间保持不变
+func (m *XStorage) Incr(key string, delta *ValueUnit) (*ValueUnit, error) {
+	if delta == nil {
+		return nil, ErrValueIsNil
+	}
+	switch delta.Type {
+	case ValueTypeInt, ValueTypeFloat, ValueTypeInt64, ValueTypeFloat64:
+	default:
+		return nil, ErrIncrType
+	}
+	return m.Update(key, func(cur *ValueUnit) (*ValueUnit, error) {
+		newValue := &ValueUnit{}
+		if cur == nil {
+			Copy(delta, newValue)
+			newValue.ExpireAt = 0
+			return newValue, nil
+		}
+		if cur.Type != delta.Type {
+			return nil, ErrValueTypeNotMatch
+		}
+		Copy(cur, newValue)
+		switch delta.Type {
+		case ValueTypeInt:
+			newValue.Data = ToBase[int](cur) + ToBase[int](delta)
+		case ValueTypeFloat:
+			newValue.Data = ToBase[float32](cur) + ToBase[float32](delta)
+		case ValueTypeInt64:
+			newValue.Data = ToBase[int64](cur) + ToBase[int64](delta)
+		case ValueTypeFloat64:
+			newValue.Data = ToBase[float64](cur) + ToBase[float64](delta)
+		}
+		return newValue, nil
+	})
+}
+
+// Append 在slice类型的值后追加values中的元素，key不存在时直接写入values，返回追加后的值。过期时间保持不变
+func (m *XStorage) Append(key string, values *ValueUnit) (*ValueUnit, error) {
+	if values == nil {
+		return nil, ErrValueIsNil
+	}
+	if values.Type <= ValueTypeSliceBegin {
+		return nil, ErrAppendType
+	}
+	return m.Update(key, func(cur *ValueUnit) (*ValueUnit, error) {
+		newValue := &ValueUnit{}
+		if cur == nil {
+			Copy(values, newValue)
+			newValue.ExpireAt = 0
+			return newValue, nil
+		}
+		if cur.Type != values.Type {
+			return nil, ErrValueTypeNotMatch
+		}
+		Copy(cur, newValue)
+		switch values.Type {
+		case ValueTypeSliceInt:
+			newValue.Data = append(ToBase[[]int](newValue), ToBase[[]int](values)...)
+		case ValueTypeSliceString:
+			newValue.Data = append(ToBase[[]string](newValue), ToBase[[]string](values)...)
+		case ValueTypeSliceFloat:
+			newValue.Data = append(ToBase[[]float32](newValue), ToBase[[]float32](values)...)
+		case ValueTypeSliceBool:
+			newValue.Data = append(ToBase[[]bool](newValue), ToBase[[]bool](values)...)
+		default:
+			return nil, ErrAppendType
+		}
+		return newValue, nil
+	})
+}
@@ -0,0 +1,228 @@
+package xstorage
+
+import (
+	"errors"
+	"github.com/intmian/mian_go_lib/tool/misc"
+	"time"
+)
+
+// Batch 暂存跨key的写入与删除，Commit时原子的提交到缓存与磁盘，磁盘失败时缓存也会回滚。
+// 同一个key的多次操作按加入顺序生效
+type Batch struct {
+	storage *XStorage
+	ops     []BatchOp
+	prefix  string // 命名空间的前缀
+}
+
+func (m *XStorage) NewBatch() *Batch {
+	return &Batch{storage: m}
+}
+
+// Set 暂存一次写入，value会被复制，之后对value的修改不会影响提交的内容
+func (b *Batch) Set(key string, value *ValueUnit) *Batch {
+	var newValue *ValueUnit
+	if value != nil {
+		newValue = &ValueUnit{}
+		Copy(value, newValue)
+	}
+	b.ops = append(b.ops, BatchOp{Type: BatchOpSet, Key: b.key(key), Value: newValue})
+	return b
+}
+
+// SetWithTTL 暂存一次带过期时间的写入，ttl<=0时永不过期
+func (b *Batch) SetWithTTL(key string, value *ValueUnit, ttl time.Duration) *Batch {
+	if value == nil {
+		return b.Set(key, nil)
+	}
+	return b.Set(key, value.WithTTL(ttl))
+}
+
+func (b *Batch) Delete(key string) *Batch {
+	b.ops = append(b.ops, BatchOp{Type: BatchOpDelete, Key: b.key(key)})
+	return b
+}
+
+func (b *Batch) key(key string) string {
+	if key == "" {
+		return ""
+	}
+	return b.prefix + key
+}
+
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Commit 提交所有暂存的操作，提交后清空
+func (b *Batch) Commit() error {
+	err := b.storage.commitBatch(b.ops)
+	if err != nil {
+		return err
+	}
+	b.ops = nil
+	return nil
+}
+
+// Txn 在fn中暂存操作，fn返回nil时一次性提交，否则全部放弃
+func (m *XStorage) Txn(fn func(b *Batch) error) error {
+	b := m.NewBatch()
+	err := fn(b)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// SetBatch 原子的写入多个key
+func (m *XStorage) SetBatch(kv map[string]*ValueUnit) error {
+	b := m.NewBatch()
+	for k, v := range kv {
+		b.Set(k, v)
+	}
+	return b.Commit()
+}
+
+// DeleteBatch 原子的删除多个key
+func (m *XStorage) DeleteBatch(keys ...string) error {
+	b := m.NewBatch()
+	for _, k := range keys {
+		b.Delete(k)
+	}
+	return b.Commit()
+}
+
+func (m *XStorage) commitBatch(ops []BatchOp) error {
+	if !m.observers.has() {
+		return m.commit(ops)
+	}
+	start := time.Now()
+	err := m.commit(ops)
+	m.publishOps(ops, m.directSource(), start, err)
+	return err
+}
+
+func (m *XStorage) commit(ops []BatchOp) error {
+	if !m.initTag.IsInitialized() {
+		return ErrMgrNotInit
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	for _, op := range ops {
+		if op.Key == "" {
+			return ErrKeyIsEmpty
+		}
+		switch op.Type {
+		case BatchOpSet:
+			if op.Value == nil {
+				return ErrValueIsNil
+			}
+		case BatchOpDelete:
+		default:
+			return ErrBatchOpType
+		}
+	}
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.Lock()
+		defer m.rwLock.Unlock()
+	}
+	// 写回模式下先将涉及的key落盘，之后整个批次直接写入数据库
+	keys := make([]string, 0, len(ops))
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+	err := m.flushDirty(keys...)
+	if err != nil {
+		return errors.Join(ErrBatchWrite, err)
+	}
+
+	// 按顺序推演每个操作前的值，用于生成事件
+	var events []WatchEvent
+	staged := make(map[string]*ValueUnit)
+	for _, op := range ops {
+		if !m.watchHub.has(op.Key) {
+			continue
+		}
+		old, ok := staged[op.Key]
+		if !ok {
+			old = m.loadOldValue(op.Key)
+		}
+		e := newWatchEvent(op.Key, old, op.Value)
+		staged[op.Key] = e.NewValue
+		events = append(events, e)
+	}
+
+	// 记录缓存中的原值，用于落盘失败时回滚
+	var backup map[string]*ValueUnit
+	if misc.HasProperty(m.setting.Property, UseCache) {
+		backup = make(map[string]*ValueUnit)
+		for _, op := range ops {
+			if _, ok := backup[op.Key]; ok {
+				continue
+			}
+			var old *ValueUnit
+			if p, ok := m.kvMap[op.Key]; ok {
+				old = &ValueUnit{}
+				Copy(p, old)
+			}
+			backup[op.Key] = old
+		}
+		err := m.applyBatchToMap(ops)
+		if err != nil {
+			m.rollbackMap(backup)
+			return errors.Join(ErrBatchWrite, err)
+		}
+	}
+	if misc.HasProperty(m.setting.Property, UseDisk) {
+		err := m.onBatch2Disk(ops)
+		if err != nil {
+			if backup != nil {
+				m.rollbackMap(backup)
+			}
+			return errors.Join(ErrBatchWrite, err)
+		}
+	}
+	m.watchHub.publish(events...)
+	return nil
+}
+
+func (m *XStorage) applyBatchToMap(ops []BatchOp) error {
+	for _, op := range ops {
+		switch op.Type {
+		case BatchOpSet:
+			err := m.recordToMap(op.Key, op.Value)
+			if err != nil {
+				return errors.Join(ErrRecordToMap, err)
+			}
+		case BatchOpDelete:
+			err := m.removeFromMap(op.Key)
+			if err != nil && !errors.Is(err, ErrKeyNotExist) {
+				return errors.Join(ErrRemoveFromMap, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rollbackMap 将缓存恢复为backup中记录的值，nil代表原本不存在
+func (m *XStorage) rollbackMap(backup map[string]*ValueUnit) {
+	for key, old := range backup {
+		if old == nil {
+			_ = m.removeFromMap(key)
+		} else {
+			_ = m.recordToMap(key, old)
+		}
+	}
+}
+
+func (m *XStorage) onBatch2Disk(ops []BatchOp) error {
+	t := m.setting.SaveType
+	var err error
+	switch {
+	case t.isDB():
+		err = m.dbCore.BatchWrite(ops)
+	case t.isFile():
+		err = m.saveFile()
+	}
+	return err
+}
@@ -0,0 +1,850 @@
+package xstorage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/intmian/mian_go_lib/tool/misc"
+)
+
+/*
+BTreeCore 单文件的追加写B+树
+文件头部有两个meta槽，轮流写入，记录根节点位置、有效的文件长度与key的数量，并带有校验。
+节点一旦写入就不再修改，每次提交只把修改路径上新生成的节点追加到文件末尾，刷盘后再写入新的meta，
+所以进程崩溃时最多丢失最后一次提交，并且不会出现写了一半的提交。加载时会截断掉meta记录的长度之后的内容。
+删除时不做节点合并，只移除空节点，文件中失效的节点会在文件增长到一定程度后通过压缩重建。
+*/
+
+const (
+	btreeMagic          = "XSBTREE1"
+	btreeMetaSize       = 64
+	btreeHeaderSize     = btreeMetaSize * 2
+	btreeMaxKeys        = 64
+	btreeMaxCacheNode   = 4096
+	btreeCompactMinSize = 1 << 20
+)
+
+type btreeMeta struct {
+	txID  uint64
+	root  int64 // 根节点的位置，0代表空树
+	size  int64 // 有效的文件长度
+	count int64 // key的数量
+}
+
+func (m btreeMeta) encode() []byte {
+	b := make([]byte, btreeMetaSize)
+	copy(b, btreeMagic)
+	binary.LittleEndian.PutUint64(b[8:], m.txID)
+	binary.LittleEndian.PutUint64(b[16:], uint64(m.root))
+	binary.LittleEndian.PutUint64(b[24:], uint64(m.size))
+	binary.LittleEndian.PutUint64(b[32:], uint64(m.count))
+	binary.LittleEndian.PutUint32(b[40:], crc32.ChecksumIEEE(b[:40]))
+	return b
+}
+
+func decodeBTreeMeta(b []byte) (btreeMeta, bool) {
+	if len(b) < btreeMetaSize || string(b[:8]) != btreeMagic {
+		return btreeMeta{}, false
+	}
+	if binary.LittleEndian.Uint32(b[40:]) != crc32.ChecksumIEEE(b[:40]) {
+		return btreeMeta{}, false
+	}
+	return btreeMeta{
+		txID:  binary.LittleEndian.Uint64(b[8:]),
+		root:  int64(binary.LittleEndian.Uint64(b[16:])),
+		size:  int64(binary.LittleEndian.Uint64(b[24:])),
+		count: int64(binary.LittleEndian.Uint64(b[32:])),
+	}, true
+}
+
+// btreeNode 叶子节点存放key与编码后的值，中间节点的keys[i]为children[i]中最小的key
+type btreeNode struct {
+	leaf     bool
+	keys     []string
+	values   [][]byte
+	children []btreeRef
+}
+
+// btreeRef 指向一个节点，node不为nil时代表是尚未落盘的新节点
+type btreeRef struct {
+	offset int64
+	node   *btreeNode
+}
+
+func (r btreeRef) isEmpty() bool {
+	return r.offset == 0 && r.node == nil
+}
+
+func (n *btreeNode) clone() *btreeNode {
+	nn := &btreeNode{leaf: n.leaf}
+	nn.keys = append([]string(nil), n.keys...)
+	if n.leaf {
+		nn.values = append([][]byte(nil), n.values...)
+	} else {
+		nn.children = append([]btreeRef(nil), n.children...)
+	}
+	return nn
+}
+
+// childIndex 返回key所在的子节点
+func (n *btreeNode) childIndex(key string) int {
+	i := sort.Search(len(n.keys), func(i int) bool {
+		return n.keys[i] > key
+	}) - 1
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
+// encodeBTreeNode 长度(4) + 内容 + crc32(4)
+func encodeBTreeNode(n *btreeNode) []byte {
+	var body bytes.Buffer
+	if n.leaf {
+		body.WriteByte(0)
+	} else {
+		body.WriteByte(1)
+	}
+	tmp := make([]byte, binary.MaxVarintLen64)
+	writeUvarint := func(v uint64) {
+		l := binary.PutUvarint(tmp, v)
+		body.Write(tmp[:l])
+	}
+	writeUvarint(uint64(len(n.keys)))
+	for i, k := range n.keys {
+		writeUvarint(uint64(len(k)))
+		body.WriteString(k)
+		if n.leaf {
+			writeUvarint(uint64(len(n.values[i])))
+			body.Write(n.values[i])
+		} else {
+			writeUvarint(uint64(n.children[i].offset))
+		}
+	}
+	b := make([]byte, 4, 8+body.Len())
+	binary.LittleEndian.PutUint32(b, uint32(body.Len()))
+	b = append(b, body.Bytes()...)
+	b = binary.LittleEndian.AppendUint32(b, crc32.ChecksumIEEE(body.Bytes()))
+	return b
+}
+
+func decodeBTreeNode(body []byte) (*btreeNode, error) {
+	r := bytes.NewReader(body)
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n := &btreeNode{leaf: kind == 0}
+	num, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	readBytes := func() ([]byte, error) {
+		l, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, err
+		}
+		if l > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, l)
+		_, err = io.ReadFull(r, b)
+		return b, err
+	}
+	for i := uint64(0); i < num; i++ {
+		k, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		n.keys = append(n.keys, string(k))
+		if n.leaf {
+			v, err := readBytes()
+			if err != nil {
+				return nil, err
+			}
+			n.values = append(n.values, v)
+		} else {
+			offset, err := binary.ReadUvarint(r)
+			if err != nil {
+				return nil, err
+			}
+			n.children = append(n.children, btreeRef{offset: int64(offset)})
+		}
+	}
+	return n, nil
+}
+
+type BTreeCore struct {
+	addr            string
+	file            *os.File
+	meta            btreeMeta
+	cache           map[int64]*btreeNode
+	lastCompactSize int64
+	// compactErr 最近一次自动压缩的错误，数据已经提交，所以不影响提交的结果，下次提交时会重试
+	compactErr error
+	misc.InitTag
+	rwLock sync.RWMutex
+}
+
+func NewBTreeCore(addr string) (*BTreeCore, error) {
+	c := &BTreeCore{
+		addr: addr,
+	}
+	err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	c.SetInitialized()
+	return c, nil
+}
+
+// open 打开文件，选出有效且最新的meta，并截断其后未完成的提交
+func (c *BTreeCore) open() error {
+	file, err := os.OpenFile(c.addr, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return errors.Join(ErrOpenBTree, err)
+	}
+	c.file = file
+	c.cache = make(map[int64]*btreeNode)
+	header := make([]byte, btreeHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return errors.Join(ErrOpenBTree, err)
+	}
+	if n == 0 {
+		// 新文件
+		c.meta = btreeMeta{size: btreeHeaderSize}
+		b := append(c.meta.encode(), c.meta.encode()...)
+		_, err = file.WriteAt(b, 0)
+		if err == nil {
+			err = file.Sync()
+		}
+		if err != nil {
+			return errors.Join(ErrOpenBTree, err)
+		}
+		c.lastCompactSize = c.meta.size
+		return nil
+	}
+	meta1, ok1 := decodeBTreeMeta(header[:btreeMetaSize])
+	meta2, ok2 := decodeBTreeMeta(header[btreeMetaSize:])
+	switch {
+	case ok1 && ok2:
+		c.meta = meta1
+		if meta2.txID > meta1.txID {
+			c.meta = meta2
+		}
+	case ok1:
+		c.meta = meta1
+	case ok2:
+		c.meta = meta2
+	default:
+		return ErrBTreeFileBroken
+	}
+	err = file.Truncate(c.meta.size)
+	if err != nil {
+		return errors.Join(ErrOpenBTree, err)
+	}
+	c.lastCompactSize = c.meta.size
+	return nil
+}
+
+func (c *BTreeCore) root() btreeRef {
+	return btreeRef{offset: c.meta.root}
+}
+
+func (c *BTreeCore) load(ref btreeRef) (*btreeNode, error) {
+	if ref.node != nil {
+		return ref.node, nil
+	}
+	if n, ok := c.cache[ref.offset]; ok {
+		return n, nil
+	}
+	lenBuf := make([]byte, 4)
+	_, err := c.file.ReadAt(lenBuf, ref.offset)
+	if err != nil {
+		return nil, errors.Join(ErrReadBTree, err)
+	}
+	l := int64(binary.LittleEndian.Uint32(lenBuf))
+	if ref.offset+8+l > c.meta.size {
+		return nil, ErrBTreeFileBroken
+	}
+	b := make([]byte, l+4)
+	_, err = c.file.ReadAt(b, ref.offset+4)
+	if err != nil {
+		return nil, errors.Join(ErrReadBTree, err)
+	}
+	body := b[:l]
+	if binary.LittleEndian.Uint32(b[l:]) != crc32.ChecksumIEEE(body) {
+		return nil, ErrBTreeFileBroken
+	}
+	n, err := decodeBTreeNode(body)
+	if err != nil {
+		return nil, errors.Join(ErrBTreeFileBroken, err)
+	}
+	if len(c.cache) >= btreeMaxCacheNode {
+		c.cache = make(map[int64]*btreeNode)
+	}
+	c.cache[ref.offset] = n
+	return n, nil
+}
+
+func (c *BTreeCore) firstKey(ref btreeRef) (string, error) {
+	n, err := c.load(ref)
+	if err != nil {
+		return "", err
+	}
+	return n.keys[0], nil
+}
+
+func (c *BTreeCore) get(root btreeRef, key string) ([]byte, bool, error) {
+	if root.isEmpty() {
+		return nil, false, nil
+	}
+	n, err := c.load(root)
+	if err != nil {
+		return nil, false, err
+	}
+	for !n.leaf {
+		n, err = c.load(n.children[n.childIndex(key)])
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	i := sort.SearchStrings(n.keys, key)
+	if i < len(n.keys) && n.keys[i] == key {
+		return n.values[i], true, nil
+	}
+	return nil, false, nil
+}
+
+// split 节点过大时对半拆分，返回右半部分
+func splitBTreeNode(n *btreeNode) *btreeNode {
+	if len(n.keys) <= btreeMaxKeys {
+		return nil
+	}
+	mid := len(n.keys) / 2
+	right := &btreeNode{leaf: n.leaf}
+	right.keys = append([]string(nil), n.keys[mid:]...)
+	n.keys = n.keys[:mid:mid]
+	if n.leaf {
+		right.values = append([][]byte(nil), n.values[mid:]...)
+		n.values = n.values[:mid:mid]
+	} else {
+		right.children = append([]btreeRef(nil), n.children[mid:]...)
+		n.children = n.children[:mid:mid]
+	}
+	return right
+}
+
+// insert 写时复制的插入，返回替换ref的新节点，以及分裂出的右侧节点
+func (c *BTreeCore) insert(ref btreeRef, key string, value []byte) (btreeRef, *btreeRef, bool, error) {
+	n, err := c.load(ref)
+	if err != nil {
+		return btreeRef{}, nil, false, err
+	}
+	nn := n.clone()
+	isNew := false
+	if nn.leaf {
+		i := sort.SearchStrings(nn.keys, key)
+		if i < len(nn.keys) && nn.keys[i] == key {
+			nn.values[i] = value
+		} else {
+			isNew = true
+			nn.keys = append(nn.keys, "")
+			copy(nn.keys[i+1:], nn.keys[i:])
+			nn.keys[i] = key
+			nn.values = append(nn.values, nil)
+			copy(nn.values[i+1:], nn.values[i:])
+			nn.values[i] = value
+		}
+	} else {
+		i := nn.childIndex(key)
+		left, right, childNew, err := c.insert(nn.children[i], key, value)
+		if err != nil {
+			return btreeRef{}, nil, false, err
+		}
+		isNew = childNew
+		nn.children[i] = left
+		nn.keys[i] = left.node.keys[0]
+		if right != nil {
+			nn.keys = append(nn.keys, "")
+			copy(nn.keys[i+2:], nn.keys[i+1:])
+			nn.keys[i+1] = right.node.keys[0]
+			nn.children = append(nn.children, btreeRef{})
+			copy(nn.children[i+2:], nn.children[i+1:])
+			nn.children[i+1] = *right
+		}
+	}
+	var rightRef *btreeRef
+	if right := splitBTreeNode(nn); right != nil {
+		rightRef = &btreeRef{node: right}
+	}
+	return btreeRef{node: nn}, rightRef, isNew, nil
+}
+
+// remove 写时复制的删除，返回替换ref的新节点，节点被删空时返回空的ref
+func (c *BTreeCore) remove(ref btreeRef, key string) (btreeRef, bool, error) {
+	n, err := c.load(ref)
+	if err != nil {
+		return btreeRef{}, false, err
+	}
+	if n.leaf {
+		i := sort.SearchStrings(n.keys, key)
+		if i >= len(n.keys) || n.keys[i] != key {
+			return ref, false, nil
+		}
+		if len(n.keys) == 1 {
+			return btreeRef{}, true, nil
+		}
+		nn := n.clone()
+		nn.keys = append(nn.keys[:i], nn.keys[i+1:]...)
+		nn.values = append(nn.values[:i], nn.values[i+1:]...)
+		return btreeRef{node: nn}, true, nil
+	}
+	i := n.childIndex(key)
+	child, found, err := c.remove(n.children[i], key)
+	if err != nil || !found {
+		return ref, found, err
+	}
+	nn := n.clone()
+	if child.isEmpty() {
+		if len(nn.keys) == 1 {
+			return btreeRef{}, true, nil
+		}
+		nn.keys = append(nn.keys[:i], nn.keys[i+1:]...)
+		nn.children = append(nn.children[:i], nn.children[i+1:]...)
+	} else {
+		nn.children[i] = child
+		nn.keys[i] = child.node.keys[0]
+	}
+	return btreeRef{node: nn}, true, nil
+}
+
+// walk 按key升序遍历[lower, upper)范围内的数据，fn返回false时停止
+func (c *BTreeCore) walk(ref btreeRef, lower string, upper string, fn func(key string, value []byte) bool) (bool, error) {
+	if ref.isEmpty() {
+		return true, nil
+	}
+	n, err := c.load(ref)
+	if err != nil {
+		return false, err
+	}
+	if n.leaf {
+		for i := sort.SearchStrings(n.keys, lower); i < len(n.keys); i++ {
+			if upper != "" && n.keys[i] >= upper {
+				return false, nil
+			}
+			if !fn(n.keys[i], n.values[i]) {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	for i := n.childIndex(lower); i < len(n.children); i++ {
+		if upper != "" && n.keys[i] >= upper {
+			return false, nil
+		}
+		goOn, err := c.walk(n.children[i], lower, upper, fn)
+		if err != nil || !goOn {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// writeNodes 后序遍历，将所有未落盘的节点编码到buf中，并把ref改为指向落盘后的位置
+func (c *BTreeCore) writeNodes(ref *btreeRef, buf *bytes.Buffer, base int64, cache map[int64]*btreeNode) {
+	if ref.node == nil {
+		return
+	}
+	n := ref.node
+	if !n.leaf {
+		for i := range n.children {
+			c.writeNodes(&n.children[i], buf, base, cache)
+		}
+	}
+	ref.offset = base + int64(buf.Len())
+	buf.Write(encodeBTreeNode(n))
+	if cache != nil {
+		cache[ref.offset] = n
+	}
+	ref.node = nil
+}
+
+// commit 追加新节点并刷盘，再写入新的meta。失败时保持原来的状态
+func (c *BTreeCore) commit(root btreeRef, count int64) error {
+	var buf bytes.Buffer
+	newNodes := make(map[int64]*btreeNode)
+	c.writeNodes(&root, &buf, c.meta.size, newNodes)
+	meta := btreeMeta{
+		txID:  c.meta.txID + 1,
+		root:  root.offset,
+		size:  c.meta.size + int64(buf.Len()),
+		count: count,
+	}
+	_, err := c.file.WriteAt(buf.Bytes(), c.meta.size)
+	if err == nil {
+		err = c.file.Sync()
+	}
+	if err == nil {
+		_, err = c.file.WriteAt(meta.encode(), int64(meta.txID%2)*btreeMetaSize)
+	}
+	if err == nil {
+		err = c.file.Sync()
+	}
+	if err != nil {
+		_ = c.file.Truncate(c.meta.size)
+		return errors.Join(ErrWriteBTree, err)
+	}
+	c.meta = meta
+	if len(c.cache)+len(newNodes) >= btreeMaxCacheNode {
+		c.cache = make(map[int64]*btreeNode)
+	}
+	for offset, n := range newNodes {
+		c.cache[offset] = n
+	}
+	if c.meta.size > btreeCompactMinSize && c.meta.size > c.lastCompactSize*4 {
+		c.compactErr = c.compact()
+	}
+	return nil
+}
+
+// CompactErr 返回最近一次自动压缩的错误，压缩成功后为nil
+func (c *BTreeCore) CompactErr() error {
+	c.rwLock.RLock()
+	defer c.rwLock.RUnlock()
+	return c.compactErr
+}
+
+// apply 在root上执行一批操作，返回新的根节点与key的数量，不落盘
+func (c *BTreeCore) apply(root btreeRef, count int64, ops []BatchOp) (btreeRef, int64, error) {
+	for _, op := range ops {
+		if op.Key == "" {
+			return root, count, ErrKeyIsEmpty
+		}
+		switch op.Type {
+		case BatchOpSet:
+			value, err := encodeUnit(op.Value)
+			if err != nil {
+				return root, count, err
+			}
+			if root.isEmpty() {
+				root = btreeRef{node: &btreeNode{leaf: true, keys: []string{op.Key}, values: [][]byte{value}}}
+				count++
+				continue
+			}
+			left, right, isNew, err := c.insert(root, op.Key, value)
+			if err != nil {
+				return root, count, err
+			}
+			if isNew {
+				count++
+			}
+			root = left
+			if right != nil {
+				root = btreeRef{node: &btreeNode{
+					keys:     []string{left.node.keys[0], right.node.keys[0]},
+					children: []btreeRef{left, *right},
+				}}
+			}
+		case BatchOpDelete:
+			if root.isEmpty() {
+				continue
+			}
+			newRoot, found, err := c.remove(root, op.Key)
+			if err != nil {
+				return root, count, err
+			}
+			if !found {
+				continue
+			}
+			count--
+			root = newRoot
+			// 根节点只剩一个子节点时降低树高
+			for !root.isEmpty() {
+				n, err := c.load(root)
+				if err != nil {
+					return root, count, err
+				}
+				if n.leaf || len(n.children) > 1 {
+					break
+				}
+				root = n.children[0]
+			}
+		default:
+			return root, count, ErrBatchOpType
+		}
+	}
+	return root, count, nil
+}
+
+func (c *BTreeCore) Get(key string, rec *ValueUnit) (bool, error) {
+	if !c.IsInitialized() {
+		return false, ErrBTreeCoreNotInit
+	}
+	if rec == nil {
+		return false, ErrRecIsNil
+	}
+	// 读取时会填充节点缓存，所以这里也需要写锁
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	value, ok, err := c.get(c.root(), key)
+	if err != nil || !ok {
+		return false, err
+	}
+	err = decodeUnit(value, rec)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *BTreeCore) Set(key string, value *ValueUnit) error {
+	return c.BatchWrite([]BatchOp{{Type: BatchOpSet, Key: key, Value: value}})
+}
+
+func (c *BTreeCore) Delete(key string) error {
+	return c.BatchWrite([]BatchOp{{Type: BatchOpDelete, Key: key}})
+}
+
+// BatchWrite 所有操作在内存中完成后一次性追加落盘
+func (c *BTreeCore) BatchWrite(ops []BatchOp) error {
+	if !c.IsInitialized() {
+		return ErrBTreeCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	root, count, err := c.apply(c.root(), c.meta.count, ops)
+	if err != nil {
+		return errors.Join(ErrBatchWrite, err)
+	}
+	if root.node == nil && root.offset == c.meta.root {
+		return nil
+	}
+	return c.commit(root, count)
+}
+
+func (c *BTreeCore) GetAll() (map[string]*ValueUnit, error) {
+	if !c.IsInitialized() {
+		return nil, ErrBTreeCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	ret := make(map[string]*ValueUnit, c.meta.count)
+	var decodeErr error
+	_, err := c.walk(c.root(), "", "", func(key string, value []byte) bool {
+		unit := &ValueUnit{}
+		decodeErr = decodeUnit(value, unit)
+		ret[key] = unit
+		return decodeErr == nil
+	})
+	err = errors.Join(err, decodeErr)
+	if err != nil {
+		return nil, errors.Join(ErrGetAllValue, err)
+	}
+	return ret, nil
+}
+
+func (c *BTreeCore) Scan(option ScanOption) (*ScanResult, error) {
+	if !c.IsInitialized() {
+		return nil, ErrBTreeCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	lower, upper := scanRange(option)
+	now := time.Now()
+	ret := &ScanResult{}
+	var decodeErr error
+	_, err := c.walk(c.root(), lower, upper, func(key string, value []byte) bool {
+		unit := &ValueUnit{}
+		decodeErr = decodeUnit(value, unit)
+		if decodeErr != nil {
+			return false
+		}
+		if unit.IsExpired(now) {
+			return true
+		}
+		if option.Limit > 0 && len(ret.Pairs) >= option.Limit {
+			ret.Next = key
+			return false
+		}
+		ret.Pairs = append(ret.Pairs, KVPair{Key: key, Value: unit})
+		return true
+	})
+	err = errors.Join(err, decodeErr)
+	if err != nil {
+		return nil, errors.Join(ErrScanValue, err)
+	}
+	return ret, nil
+}
+
+func (c *BTreeCore) DeleteExpired(now int64) ([]string, error) {
+	if !c.IsInitialized() {
+		return nil, ErrBTreeCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	var keys []string
+	var ops []BatchOp
+	var decodeErr error
+	_, err := c.walk(c.root(), "", "", func(key string, value []byte) bool {
+		var r unitRecord
+		decodeErr = json.Unmarshal(value, &r)
+		if decodeErr != nil {
+			return false
+		}
+		if r.ExpireAt != 0 && r.ExpireAt <= now {
+			keys = append(keys, key)
+			ops = append(ops, BatchOp{Type: BatchOpDelete, Key: key})
+		}
+		return true
+	})
+	err = errors.Join(err, decodeErr)
+	if err != nil {
+		return nil, errors.Join(ErrDeleteExpired, err)
+	}
+	if len(ops) == 0 {
+		return nil, nil
+	}
+	root, count, err := c.apply(c.root(), c.meta.count, ops)
+	if err == nil {
+		err = c.commit(root, count)
+	}
+	if err != nil {
+		return nil, errors.Join(ErrDeleteExpired, err)
+	}
+	return keys, nil
+}
+
+func (c *BTreeCore) Update(key string, fn UpdateFunc) (*ValueUnit, error) {
+	if !c.IsInitialized() {
+		return nil, ErrBTreeCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	var old *ValueUnit
+	value, ok, err := c.get(c.root(), key)
+	if err != nil {
+		return nil, errors.Join(ErrUpdateValue, err)
+	}
+	if ok {
+		old = &ValueUnit{}
+		err = decodeUnit(value, old)
+		if err != nil {
+			return nil, errors.Join(ErrUpdateValue, err)
+		}
+		if old.IsExpired(time.Now()) {
+			old = nil
+		}
+	}
+	newValue, err := fn(old)
+	if err != nil {
+		return nil, errors.Join(ErrUpdateValue, err)
+	}
+	if newValue == nil {
+		return old, nil
+	}
+	root, count, err := c.apply(c.root(), c.meta.count, []BatchOp{{Type: BatchOpSet, Key: key, Value: newValue}})
+	if err == nil {
+		err = c.commit(root, count)
+	}
+	if err != nil {
+		return nil, errors.Join(ErrUpdateValue, err)
+	}
+	return newValue, nil
+}
+
+// Compact 立即重建文件，去掉所有失效的节点
+func (c *BTreeCore) Compact() error {
+	if !c.IsInitialized() {
+		return ErrBTreeCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	c.compactErr = c.compact()
+	return c.compactErr
+}
+
+// compact 将所有数据按顺序装填为一棵新树写入临时文件，再通过rename替换
+func (c *BTreeCore) compact() error {
+	var level []btreeRef
+	leaf := &btreeNode{leaf: true}
+	_, err := c.walk(c.root(), "", "", func(key string, value []byte) bool {
+		leaf.keys = append(leaf.keys, key)
+		leaf.values = append(leaf.values, value)
+		if len(leaf.keys) == btreeMaxKeys {
+			level = append(level, btreeRef{node: leaf})
+			leaf = &btreeNode{leaf: true}
+		}
+		return true
+	})
+	if err != nil {
+		return errors.Join(ErrCompact, err)
+	}
+	if len(leaf.keys) > 0 {
+		level = append(level, btreeRef{node: leaf})
+	}
+	for len(level) > 1 {
+		var next []btreeRef
+		branch := &btreeNode{}
+		for _, ref := range level {
+			branch.keys = append(branch.keys, ref.node.keys[0])
+			branch.children = append(branch.children, ref)
+			if len(branch.keys) == btreeMaxKeys {
+				next = append(next, btreeRef{node: branch})
+				branch = &btreeNode{}
+			}
+		}
+		if len(branch.keys) > 0 {
+			next = append(next, btreeRef{node: branch})
+		}
+		level = next
+	}
+	root := btreeRef{}
+	if len(level) == 1 {
+		root = level[0]
+	}
+	var buf bytes.Buffer
+	c.writeNodes(&root, &buf, btreeHeaderSize, nil)
+	meta := btreeMeta{
+		txID:  c.meta.txID + 1,
+		root:  root.offset,
+		size:  btreeHeaderSize + int64(buf.Len()),
+		count: c.meta.count,
+	}
+	data := append(meta.encode(), meta.encode()...)
+	data = append(data, buf.Bytes()...)
+	tmpAddr := c.addr + ".compact"
+	err = writeFileSync(tmpAddr, data)
+	if err != nil {
+		return errors.Join(ErrCompact, err)
+	}
+	_ = c.file.Close()
+	err = os.Rename(tmpAddr, c.addr)
+	if err != nil {
+		_ = os.Remove(tmpAddr)
+	}
+	// 无论rename是否成功都需要重新打开文件
+	openErr := c.open()
+	if err != nil || openErr != nil {
+		return errors.Join(ErrCompact, err, openErr)
+	}
+	return nil
+}
+
+func (c *BTreeCore) Close() error {
+	if !c.IsInitialized() {
+		return ErrBTreeCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	return c.file.Close()
+}
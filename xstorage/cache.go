@@ -0,0 +1,396 @@
+package xstorage
+
+import (
+	"container/heap"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/intmian/mian_go_lib/tool/misc"
+)
+
+type CacheEvictType int
+
+const (
+	CacheEvictLRU CacheEvictType = iota // 淘汰最久未访问的key
+	CacheEvictLFU                       // 淘汰访问次数最少的key，次数相同时淘汰最久未访问的
+)
+
+const defaultCacheFlushInterval = time.Second
+
+// CachePolicy 缓存的容量与写回策略，零值代表不限制容量并且写穿。
+// 只能用于同时开启UseCache、UseDisk并且没有FullInitLoad的数据库存储，此时缓存中只是部分数据，可以安全的淘汰
+type CachePolicy struct {
+	MaxEntries int            // 最多缓存的key数量，<=0时不限制
+	MaxBytes   int64          // 缓存的估算大小上限，<=0时不限制
+	Evict      CacheEvictType // 淘汰策略
+	// WriteBack 写回模式，Set与Delete只修改缓存并记为脏数据，由后台每隔FlushInterval批量落盘，
+	// 脏数据被淘汰前、Close时以及需要直接访问数据库的操作（Scan、Batch、Update等）之前也会落盘
+	WriteBack     bool
+	FlushInterval time.Duration // 写回间隔，<=0时为1秒
+}
+
+func (p CachePolicy) isBounded() bool {
+	return p.MaxEntries > 0 || p.MaxBytes > 0
+}
+
+func (p CachePolicy) isSet() bool {
+	return p.isBounded() || p.WriteBack
+}
+
+// CacheStats 缓存的统计数据
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Entries   int   // 缓存中的key数量
+	Bytes     int64 // 缓存的估算大小，仅在限制了容量时统计
+	Dirty     int   // 尚未落盘的修改数量
+}
+
+type cacheEntry struct {
+	key   string
+	size  int64
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+// cacheHeap 堆顶为下一个被淘汰的key
+type cacheHeap struct {
+	entries []*cacheEntry
+	lfu     bool
+}
+
+func (h *cacheHeap) Len() int {
+	return len(h.entries)
+}
+
+func (h *cacheHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if h.lfu && a.freq != b.freq {
+		return a.freq < b.freq
+	}
+	return a.tick < b.tick
+}
+
+func (h *cacheHeap) Swap(i, j int) {
+	h.entries[i], h.entries[j] = h.entries[j], h.entries[i]
+	h.entries[i].index = i
+	h.entries[j].index = j
+}
+
+func (h *cacheHeap) Push(x any) {
+	e := x.(*cacheEntry)
+	e.index = len(h.entries)
+	h.entries = append(h.entries, e)
+}
+
+func (h *cacheHeap) Pop() any {
+	old := h.entries
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	h.entries = old[:len(old)-1]
+	e.index = -1
+	return e
+}
+
+// cacheTracker 记录缓存的访问情况、脏数据与统计。
+// 读取时也需要更新访问记录，而读取只持有XStorage的读锁，所以单独加锁
+type cacheTracker struct {
+	policy  CachePolicy
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	heap    cacheHeap
+	tick    uint64
+	bytes   int64
+	// 尚未落盘的key，true为写入，false为删除
+	dirty     map[string]bool
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	evictions atomic.Uint64
+}
+
+func newCacheTracker(policy CachePolicy) *cacheTracker {
+	return &cacheTracker{
+		policy:  policy,
+		entries: make(map[string]*cacheEntry),
+		heap:    cacheHeap{lfu: policy.Evict == CacheEvictLFU},
+		dirty:   make(map[string]bool),
+	}
+}
+
+// add 记录写入缓存的key，返回超出容量后需要淘汰的key，不会包含key本身
+func (c *cacheTracker) add(key string, value *ValueUnit) []string {
+	if !c.policy.isBounded() {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tick++
+	size := estimateSize(key, value)
+	if e, ok := c.entries[key]; ok {
+		c.bytes += size - e.size
+		e.size = size
+		e.freq++
+		e.tick = c.tick
+		heap.Fix(&c.heap, e.index)
+	} else {
+		e = &cacheEntry{key: key, size: size, freq: 1, tick: c.tick}
+		c.entries[key] = e
+		heap.Push(&c.heap, e)
+		c.bytes += size
+	}
+	var victims []string
+	count := len(c.entries)
+	bytes := c.bytes
+	// 只挑选出需要淘汰的key，真正移除由removeFromMap调用remove完成
+	var skipped []*cacheEntry
+	for c.heap.Len() > 0 && ((c.policy.MaxEntries > 0 && count > c.policy.MaxEntries) || (c.policy.MaxBytes > 0 && bytes > c.policy.MaxBytes)) {
+		e := heap.Pop(&c.heap).(*cacheEntry)
+		skipped = append(skipped, e)
+		if e.key == key {
+			continue
+		}
+		victims = append(victims, e.key)
+		count--
+		bytes -= e.size
+	}
+	for _, e := range skipped {
+		heap.Push(&c.heap, e)
+	}
+	return victims
+}
+
+func (c *cacheTracker) touch(key string) {
+	c.hits.Add(1)
+	if !c.policy.isBounded() {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.tick++
+	e.freq++
+	e.tick = c.tick
+	heap.Fix(&c.heap, e.index)
+}
+
+func (c *cacheTracker) remove(key string) {
+	if !c.policy.isBounded() {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&c.heap, e.index)
+	delete(c.entries, key)
+	c.bytes -= e.size
+}
+
+func (c *cacheTracker) markDirty(key string, set bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dirty[key] = set
+}
+
+// isDeleted key是否已经被删除但是尚未落盘
+func (c *cacheTracker) isDeleted(key string) bool {
+	if !c.policy.WriteBack {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	set, ok := c.dirty[key]
+	return ok && !set
+}
+
+func (c *cacheTracker) isDirty(key string) bool {
+	if !c.policy.WriteBack {
+		return false
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.dirty[key]
+	return ok
+}
+
+// takeDirty 取出keys中的脏数据，keys为空时取出全部
+func (c *cacheTracker) takeDirty(keys ...string) map[string]bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(keys) == 0 {
+		dirty := c.dirty
+		c.dirty = make(map[string]bool)
+		return dirty
+	}
+	dirty := make(map[string]bool)
+	for _, k := range keys {
+		if set, ok := c.dirty[k]; ok {
+			dirty[k] = set
+			delete(c.dirty, k)
+		}
+	}
+	return dirty
+}
+
+// restoreDirty 落盘失败时放回脏数据，期间被重新修改过的key以新的为准
+func (c *cacheTracker) restoreDirty(dirty map[string]bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, set := range dirty {
+		if _, ok := c.dirty[k]; !ok {
+			c.dirty[k] = set
+		}
+	}
+}
+
+// estimateSize 估算缓存一个key所占用的内存
+func estimateSize(key string, value *ValueUnit) int64 {
+	const overhead = 64
+	size := int64(len(key) + overhead)
+	switch data := value.Data.(type) {
+	case string:
+		size += int64(len(data))
+	case []string:
+		for _, s := range data {
+			size += int64(len(s)) + 16
+		}
+	case []int:
+		size += int64(len(data)) * 8
+	case []float32:
+		size += int64(len(data)) * 4
+	case []bool:
+		size += int64(len(data))
+	case map[string]string:
+		for k, v := range data {
+			size += int64(len(k)+len(v)) + 32
+		}
+	case map[string]int:
+		for k := range data {
+			size += int64(len(k)) + 24
+		}
+	}
+	return size
+}
+
+func (m *XStorage) writeBack() bool {
+	return m.cache != nil && m.cache.policy.WriteBack
+}
+
+// flushDirty 将脏数据落盘，keys为空时落盘全部。调用者需要持有锁，读锁即可
+func (m *XStorage) flushDirty(keys ...string) error {
+	if !m.writeBack() {
+		return nil
+	}
+	dirty := m.cache.takeDirty(keys...)
+	if len(dirty) == 0 {
+		return nil
+	}
+	ops := make([]BatchOp, 0, len(dirty))
+	for k, set := range dirty {
+		if !set {
+			ops = append(ops, BatchOp{Type: BatchOpDelete, Key: k})
+			continue
+		}
+		v, ok := m.kvMap[k]
+		if !ok {
+			// 已经被批量操作直接写入了数据库
+			continue
+		}
+		ops = append(ops, BatchOp{Type: BatchOpSet, Key: k, Value: v})
+	}
+	err := m.dbCore.BatchWrite(ops)
+	if err != nil {
+		m.cache.restoreDirty(dirty)
+		return errors.Join(ErrFlushCache, err)
+	}
+	return nil
+}
+
+// Flush 立即将写回模式下的脏数据落盘
+func (m *XStorage) Flush() error {
+	if !m.initTag.IsInitialized() {
+		return ErrMgrNotInit
+	}
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.RLock()
+		defer m.rwLock.RUnlock()
+	}
+	return m.flushDirty()
+}
+
+func (m *XStorage) flushLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			_ = m.Flush()
+		}
+	}
+}
+
+// evict 淘汰缓存中的key，其中的脏数据会先落盘，落盘失败时不淘汰
+func (m *XStorage) evict(victims []string) error {
+	if len(victims) == 0 {
+		return nil
+	}
+	err := m.flushDirty(victims...)
+	if err != nil {
+		return err
+	}
+	for _, k := range victims {
+		if _, ok := m.kvMap[k]; !ok {
+			continue
+		}
+		_ = m.removeFromMap(k)
+		m.cache.evictions.Add(1)
+	}
+	return nil
+}
+
+// recordLoaded 将从磁盘读取到的值写入缓存。读取期间缓存发生过修改时放弃写入，避免缓存旧值
+func (m *XStorage) recordLoaded(key string, value *ValueUnit, gen uint64) error {
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.Lock()
+		defer m.rwLock.Unlock()
+	}
+	if m.cacheGen != gen {
+		return nil
+	}
+	if _, ok := m.kvMap[key]; ok {
+		return nil
+	}
+	return m.recordToMap(key, value)
+}
+
+// CacheStats 返回缓存的命中统计，没有开启缓存时返回零值
+func (m *XStorage) CacheStats() CacheStats {
+	if m.cache == nil {
+		return CacheStats{}
+	}
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.RLock()
+		defer m.rwLock.RUnlock()
+	}
+	m.cache.lock.Lock()
+	defer m.cache.lock.Unlock()
+	return CacheStats{
+		Hits:      m.cache.hits.Load(),
+		Misses:    m.cache.misses.Load(),
+		Evictions: m.cache.evictions.Load(),
+		Entries:   len(m.kvMap),
+		Bytes:     m.cache.bytes,
+		Dirty:     len(m.cache.dirty),
+	}
+}
@@ -0,0 +1,344 @@
+package xstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 配置的修改历史存储在同一个存储中，key为 __cfghis.<存储中的key>.<20位纳秒时间戳>
+const cfgHistoryPrefix = "__cfghis"
+
+// CfgChange 一次配置修改
+type CfgChange struct {
+	Key      string     // 参数的Key
+	User     string     // SetUser的用户，全局配置为空
+	Operator string     // 修改者
+	Time     time.Time  // 修改时间
+	Old      *ValueUnit // 修改前存储中的值，没有时为nil
+	New      *ValueUnit // 修改后的值，删除时为nil
+	Comment  string
+}
+
+// cfgChangeRecord CfgChange落盘时的格式
+type cfgChangeRecord struct {
+	Key      string      `json:"key"`
+	User     string      `json:"user,omitempty"`
+	RealKey  string      `json:"realKey"`
+	Operator string      `json:"operator,omitempty"`
+	Time     time.Time   `json:"time"`
+	Old      *unitRecord `json:"old,omitempty"`
+	New      *unitRecord `json:"new,omitempty"`
+	Comment  string      `json:"comment,omitempty"`
+}
+
+// CfgDiff 一个配置在两个时间点的值，没有值时为nil
+type CfgDiff struct {
+	Key  string
+	User string
+	From *ValueUnit
+	To   *ValueUnit
+}
+
+// cfgHistoryDefaultLimit 每个配置默认保留的历史数量
+const cfgHistoryDefaultLimit = 100
+
+// cfgHistory 保证读取旧值、写入新值与写入历史之间不会被其他配置修改打断
+type cfgHistory struct {
+	lock  sync.Mutex
+	last  int64 // 上一条历史的纳秒时间戳，保证key不重复并且有序
+	limit int   // 每个配置保留的历史数量，0时为cfgHistoryDefaultLimit，<0时不限制
+}
+
+// SetHistoryLimit 设置每个配置（全局配置与每个用户的配置分别计算）保留的历史数量，写入新的历史时删除最旧的。
+// 默认为100，<0时不限制
+func (c *CfgExt) SetHistoryLimit(limit int) {
+	c.his.lock.Lock()
+	defer c.his.lock.Unlock()
+	if limit == 0 {
+		limit = cfgHistoryDefaultLimit
+	}
+	c.his.limit = limit
+}
+
+// stagePrune 在b中暂存删除realKey超出数量的旧历史，adding为本次新增的数量，需要持有c.his.lock
+func (c *CfgExt) stagePrune(b *Batch, realKey string, adding int) error {
+	limit := c.his.limit
+	if limit == 0 {
+		limit = cfgHistoryDefaultLimit
+	}
+	if limit < 0 {
+		return nil
+	}
+	prefix := Join(cfgHistoryPrefix, realKey, "")
+	pairs, err := c.core.GetByPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	// 前缀也会匹配到用户的配置的历史，只保留realKey自己的，GetByPrefix已经按时间排序
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		if !strings.Contains(strings.TrimPrefix(pair.Key, prefix), ".") {
+			keys = append(keys, pair.Key)
+		}
+	}
+	for i := 0; i < len(keys)+adding-limit && i < len(keys); i++ {
+		b.Delete(keys[i])
+	}
+	return nil
+}
+
+func cfgHistoryKey(realKey string, nano int64) string {
+	return Join(cfgHistoryPrefix, realKey, fmt.Sprintf("%020d", nano))
+}
+
+func (r *cfgChangeRecord) toChange() (CfgChange, error) {
+	change := CfgChange{
+		Key:      r.Key,
+		User:     r.User,
+		Operator: r.Operator,
+		Time:     r.Time,
+		Comment:  r.Comment,
+	}
+	if r.Old != nil {
+		change.Old = &ValueUnit{}
+		err := r.Old.toUnit(change.Old)
+		if err != nil {
+			return change, err
+		}
+	}
+	if r.New != nil {
+		change.New = &ValueUnit{}
+		err := r.New.toUnit(change.New)
+		if err != nil {
+			return change, err
+		}
+	}
+	return change, nil
+}
+
+// stageChange 在b中暂存一次修改及其历史，需要持有c.his.lock
+func (c *CfgExt) stageChange(b *Batch, change CfgChange, realKey string) error {
+	old, err := c.core.Get(realKey)
+	if err != nil {
+		return err
+	}
+	change.Old = old
+	now := time.Now()
+	nano := now.UnixNano()
+	if nano <= c.his.last {
+		nano = c.his.last + 1
+	}
+	c.his.last = nano
+	rec := cfgChangeRecord{
+		Key:      change.Key,
+		User:     change.User,
+		RealKey:  realKey,
+		Operator: change.Operator,
+		Time:     now,
+		Comment:  change.Comment,
+	}
+	if change.Old != nil {
+		rec.Old, err = newUnitRecord(change.Old)
+		if err != nil {
+			return err
+		}
+	}
+	if change.New != nil {
+		rec.New, err = newUnitRecord(change.New)
+		if err != nil {
+			return err
+		}
+		b.Set(realKey, change.New)
+	} else {
+		b.Delete(realKey)
+	}
+	s, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Join(ErrJsonMarshalErr, err)
+	}
+	b.Set(cfgHistoryKey(realKey, nano), ToUnit(string(s), ValueTypeString))
+	return c.stagePrune(b, realKey, 1)
+}
+
+// setWithHistory 原子的写入配置与修改历史
+func (c *CfgExt) setWithHistory(change CfgChange, realKey string) error {
+	c.his.lock.Lock()
+	defer c.his.lock.Unlock()
+	b := c.core.NewBatch()
+	err := c.stageChange(b, change, realKey)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// loadHistory 读取存储中的key以prefix开头的修改历史，按存储中的key分组，每组按时间排序
+func (c *CfgExt) loadHistory(prefix string) (map[string][]CfgChange, error) {
+	pairs, err := c.core.GetByPrefix(Join(cfgHistoryPrefix, prefix))
+	if err != nil {
+		return nil, errors.Join(ErrCfgHistory, err)
+	}
+	ret := make(map[string][]CfgChange)
+	for _, pair := range pairs {
+		var rec cfgChangeRecord
+		err := json.Unmarshal([]byte(ToBase[string](pair.Value)), &rec)
+		if err != nil {
+			return nil, errors.Join(ErrCfgHistory, ErrJsonUnmarshalErr, err)
+		}
+		change, err := rec.toChange()
+		if err != nil {
+			return nil, errors.Join(ErrCfgHistory, err)
+		}
+		ret[rec.RealKey] = append(ret[rec.RealKey], change)
+	}
+	for _, changes := range ret {
+		sort.SliceStable(changes, func(i, j int) bool {
+			return changes[i].Time.Before(changes[j].Time)
+		})
+	}
+	return ret, nil
+}
+
+func (c *CfgExt) realKey(key string, user string) (string, error) {
+	param := c.paramMap.GetParam(key)
+	if param == nil {
+		return "", ErrKeyNotFound
+	}
+	if user == "" {
+		return param.RealKey, nil
+	}
+	return Join(param.RealKey, user), nil
+}
+
+// History 返回参数的修改历史，user为空时为全局配置，按时间从旧到新排序
+func (c *CfgExt) History(key string, user string) ([]CfgChange, error) {
+	if !c.initTag.IsInitialized() {
+		return nil, ErrNotInitialized
+	}
+	realKey, err := c.realKey(key, user)
+	if err != nil {
+		return nil, err
+	}
+	// 前缀也会匹配到以realKey.开头的其他key，例如用户的配置，所以按realKey取出
+	all, err := c.loadHistory(Join(realKey, ""))
+	if err != nil {
+		return nil, err
+	}
+	return all[realKey], nil
+}
+
+// valueAt changes在t时的值，t早于第一次修改时为第一次修改前的值
+func valueAt(changes []CfgChange, t time.Time) *ValueUnit {
+	if len(changes) == 0 {
+		return nil
+	}
+	i := sort.Search(len(changes), func(i int) bool {
+		return changes[i].Time.After(t)
+	})
+	if i == 0 {
+		return changes[0].Old
+	}
+	return changes[i-1].New
+}
+
+// Diff 返回在from与to两个时间点值不同的配置，只包含有修改历史的配置
+func (c *CfgExt) Diff(from time.Time, to time.Time) ([]CfgDiff, error) {
+	if !c.initTag.IsInitialized() {
+		return nil, ErrNotInitialized
+	}
+	all, err := c.loadHistory("")
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]CfgDiff, 0)
+	for _, changes := range all {
+		a, b := valueAt(changes, from), valueAt(changes, to)
+		if a == nil && b == nil {
+			continue
+		}
+		if a != nil && b != nil && Compare(a, b) {
+			continue
+		}
+		ret = append(ret, CfgDiff{
+			Key:  changes[0].Key,
+			User: changes[0].User,
+			From: a,
+			To:   b,
+		})
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Key != ret[j].Key {
+			return ret[i].Key < ret[j].Key
+		}
+		return ret[i].User < ret[j].User
+	})
+	return ret, nil
+}
+
+// Rollback 将参数回滚到t时的值，t时还没有设置过时会删除存储中的值。回滚本身也会记录在历史中
+func (c *CfgExt) Rollback(operator string, key string, user string, t time.Time) error {
+	if !c.initTag.IsInitialized() {
+		return ErrNotInitialized
+	}
+	realKey, err := c.realKey(key, user)
+	if err != nil {
+		return err
+	}
+	return c.rollback(operator, Join(realKey, ""), t, func(k string) bool {
+		return k == realKey
+	})
+}
+
+// RollbackAll 将所有有修改历史的配置回滚到t时的值，所有修改原子的提交
+func (c *CfgExt) RollbackAll(operator string, t time.Time) error {
+	if !c.initTag.IsInitialized() {
+		return ErrNotInitialized
+	}
+	return c.rollback(operator, "", t, func(string) bool {
+		return true
+	})
+}
+
+func (c *CfgExt) rollback(operator string, prefix string, t time.Time, filter func(realKey string) bool) error {
+	c.his.lock.Lock()
+	defer c.his.lock.Unlock()
+	all, err := c.loadHistory(prefix)
+	if err != nil {
+		return err
+	}
+	comment := "rollback to " + t.Format(time.RFC3339Nano)
+	b := c.core.NewBatch()
+	for realKey, changes := range all {
+		if !filter(realKey) {
+			continue
+		}
+		target := valueAt(changes, t)
+		current, err := c.core.Get(realKey)
+		if err != nil {
+			return errors.Join(ErrCfgHistory, err)
+		}
+		if current == nil && target == nil || current != nil && target != nil && Compare(current, target) {
+			continue
+		}
+		last := changes[len(changes)-1]
+		err = c.stageChange(b, CfgChange{
+			Key:      last.Key,
+			User:     last.User,
+			Operator: operator,
+			Comment:  comment,
+			New:      target,
+		}, realKey)
+		if err != nil {
+			return errors.Join(ErrCfgHistory, err)
+		}
+	}
+	if b.Len() == 0 {
+		return nil
+	}
+	return b.Commit()
+}
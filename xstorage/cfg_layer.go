@@ -0,0 +1,340 @@
+package xstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+)
+
+// CfgSource 配置值的来源，优先级见cfgSourceOrder，与值的大小无关
+type CfgSource int
+
+/*
+配置按以下顺序逐层覆盖，读取时使用优先级最高的一层
+
+	默认值 CfgParam.Default
+	文件   LoadFile
+	存储   Set，运行时的修改，例如通过管理页面
+	环境变量 LoadEnv
+	命令行 BindFlags
+	用户   SetUser，只对CanUser的参数、指定了用户的读取生效
+
+部署时的环境变量与命令行可以覆盖存储中保存的值，方便临时调整
+*/
+const (
+	CfgSourceNull CfgSource = iota // 没有值
+	CfgSourceDefault
+	CfgSourceFile
+	CfgSourceEnv
+	CfgSourceFlag
+	CfgSourceStore
+	CfgSourceUser
+)
+
+func (s CfgSource) String() string {
+	switch s {
+	case CfgSourceDefault:
+		return "default"
+	case CfgSourceFile:
+		return "file"
+	case CfgSourceEnv:
+		return "env"
+	case CfgSourceFlag:
+		return "flag"
+	case CfgSourceStore:
+		return "store"
+	case CfgSourceUser:
+		return "user"
+	default:
+		return "null"
+	}
+}
+
+// CfgValue 解析后的配置值与其来源
+type CfgValue struct {
+	Value  ValueUnit
+	Source CfgSource
+}
+
+// cfgLayers 文件、环境变量、命令行三层的值，key为参数的Key
+type cfgLayers struct {
+	lock   sync.RWMutex
+	layers map[CfgSource]map[string]ValueUnit
+}
+
+func (l *cfgLayers) get(source CfgSource, key string) (ValueUnit, bool) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	v, ok := l.layers[source][key]
+	return v, ok
+}
+
+// replace 替换一整层，用于重新加载
+func (l *cfgLayers) replace(source CfgSource, values map[string]ValueUnit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.layers == nil {
+		l.layers = make(map[CfgSource]map[string]ValueUnit)
+	}
+	l.layers[source] = values
+}
+
+func (l *cfgLayers) set(source CfgSource, key string, value ValueUnit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.layers == nil {
+		l.layers = make(map[CfgSource]map[string]ValueUnit)
+	}
+	if l.layers[source] == nil {
+		l.layers[source] = make(map[string]ValueUnit)
+	}
+	l.layers[source][key] = value
+}
+
+// parseLoose 解析文件、环境变量与命令行中的值。
+// 先按StringToUnit的json格式解析，失败时字符串与时间可以不带引号，[]string可以用逗号分隔
+func parseLoose(param *CfgParam, s string) *ValueUnit {
+	v := StringToUnit(s, param.ValueType)
+	if v != nil {
+		return v
+	}
+	switch param.ValueType {
+	case ValueTypeString, ValueTypeTime:
+		return StringToUnit(strconv.Quote(s), param.ValueType)
+	case ValueTypeSliceString:
+		b, _ := json.Marshal(strings.Split(s, ","))
+		return StringToUnit(string(b), param.ValueType)
+	}
+	return nil
+}
+
+// cfgSourceOrder 用户层与默认值之间的各层，优先级从高到低
+var cfgSourceOrder = []CfgSource{CfgSourceFlag, CfgSourceEnv, CfgSourceStore, CfgSourceFile}
+
+// resolve 按优先级读取参数的值，user为空或参数不是CanUser时跳过用户层
+func (c *CfgExt) resolve(param *CfgParam, user string) (*ValueUnit, CfgSource, error) {
+	if user != "" && param.CanUser {
+		v, err := c.core.Get(Join(param.RealKey, user))
+		if err != nil {
+			return nil, CfgSourceNull, err
+		}
+		if v != nil {
+			return v, CfgSourceUser, nil
+		}
+	}
+	for _, source := range cfgSourceOrder {
+		if source == CfgSourceStore {
+			v, err := c.core.Get(param.RealKey)
+			if err != nil {
+				return nil, CfgSourceNull, err
+			}
+			if v != nil {
+				return v, CfgSourceStore, nil
+			}
+			continue
+		}
+		if v, ok := c.layers.get(source, param.Key); ok {
+			return &v, source, nil
+		}
+	}
+	if param.Default.Type != 0 {
+		def := param.Default
+		return &def, CfgSourceDefault, nil
+	}
+	return nil, CfgSourceNull, nil
+}
+
+// GetWithSource 读取参数的值及其来源，user不为空时优先使用用户的配置。没有值时返回nil与CfgSourceNull
+func (c *CfgExt) GetWithSource(user string, keys ...string) (*ValueUnit, CfgSource, error) {
+	if !c.initTag.IsInitialized() {
+		return nil, CfgSourceNull, ErrNotInitialized
+	}
+	if len(keys) == 0 {
+		return nil, CfgSourceNull, ErrParamIsEmpty
+	}
+	param := c.paramMap.GetParam(Join(keys...))
+	if param == nil {
+		return nil, CfgSourceNull, ErrParamIsInvalid
+	}
+	return c.resolve(param, user)
+}
+
+// GetAllWithSource 返回所有有值的参数及其来源，user不为空时优先使用用户的配置
+func (c *CfgExt) GetAllWithSource(user string) (map[string]CfgValue, error) {
+	if !c.initTag.IsInitialized() {
+		return nil, ErrNotInitialized
+	}
+	ret := make(map[string]CfgValue)
+	for _, param := range c.Params() {
+		v, source, err := c.resolve(&param, user)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+		ret[param.Key] = CfgValue{Value: *v, Source: source}
+	}
+	return ret, nil
+}
+
+// loadValue 将文件、环境变量与命令行中的值转换为参数的类型并校验
+func loadValue(param *CfgParam, s string) (ValueUnit, error) {
+	v := parseLoose(param, s)
+	if v == nil {
+		return ValueUnit{}, errors.Join(ErrCfgLoad, ErrValueTypeNotMatch, errors.New(param.Key))
+	}
+	err := param.Validate(v)
+	if err != nil {
+		return ValueUnit{}, errors.Join(ErrCfgLoad, err)
+	}
+	return *v, nil
+}
+
+/*
+LoadFile 加载toml或json配置文件，按扩展名区分，重复调用时替换上一次加载的值。
+嵌套的表会用Join拼接为参数的Key，不是参数的key会被忽略，例如
+
+	[news]
+	limit = 10
+	keywords = ["a", "b"]
+*/
+func (c *CfgExt) LoadFile(path string) error {
+	if !c.initTag.IsInitialized() {
+		return ErrNotInitialized
+	}
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		_, err := toml.DecodeFile(path, &raw)
+		if err != nil {
+			return errors.Join(ErrCfgLoad, err)
+		}
+	case ".json":
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return errors.Join(ErrCfgLoad, err)
+		}
+		err = json.Unmarshal(b, &raw)
+		if err != nil {
+			return errors.Join(ErrCfgLoad, ErrJsonUnmarshalErr, err)
+		}
+	default:
+		return errors.Join(ErrCfgLoad, ErrParamIsInvalid)
+	}
+	values := make(map[string]ValueUnit)
+	err := c.flatten("", raw, values)
+	if err != nil {
+		return err
+	}
+	c.layers.replace(CfgSourceFile, values)
+	return nil
+}
+
+func (c *CfgExt) flatten(prefix string, raw map[string]interface{}, values map[string]ValueUnit) error {
+	for k, v := range raw {
+		key := k
+		if prefix != "" {
+			key = Join(prefix, k)
+		}
+		// map类型的参数本身也是表，所以先判断是否为参数
+		if param := c.paramMap.GetParam(key); param != nil {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return errors.Join(ErrCfgLoad, ErrJsonMarshalErr, err)
+			}
+			value, err := loadValue(param, string(b))
+			if err != nil {
+				return err
+			}
+			values[key] = value
+			continue
+		}
+		if sub, ok := v.(map[string]interface{}); ok {
+			err := c.flatten(key, sub, values)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// EnvName 参数对应的环境变量名，为prefix加上大写的Key，其中的.与-替换为_，例如 news.limit -> APP_NEWS_LIMIT
+func EnvName(prefix string, key string) string {
+	return prefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// LoadEnv 从环境变量加载配置，files为可选的.env文件，进程的环境变量优先于.env文件。重复调用时替换上一次加载的值
+func (c *CfgExt) LoadEnv(prefix string, files ...string) error {
+	if !c.initTag.IsInitialized() {
+		return ErrNotInitialized
+	}
+	dotenv := make(map[string]string)
+	if len(files) > 0 {
+		var err error
+		dotenv, err = godotenv.Read(files...)
+		if err != nil {
+			return errors.Join(ErrCfgLoad, err)
+		}
+	}
+	values := make(map[string]ValueUnit)
+	for _, param := range c.Params() {
+		name := EnvName(prefix, param.Key)
+		s, ok := os.LookupEnv(name)
+		if !ok {
+			s, ok = dotenv[name]
+		}
+		if !ok {
+			continue
+		}
+		value, err := loadValue(&param, s)
+		if err != nil {
+			return err
+		}
+		values[param.Key] = value
+	}
+	c.layers.replace(CfgSourceEnv, values)
+	return nil
+}
+
+// BindFlags 为每个参数在fs上注册一个与Key同名的命令行参数，fs.Parse时写入命令行层。需要在AddParam之后调用
+func (c *CfgExt) BindFlags(fs *flag.FlagSet) {
+	for _, param := range c.Params() {
+		param := param
+		usage := param.Desc
+		if usage == "" {
+			usage = valueTypeName(param.ValueType)
+		}
+		fs.Func(param.Key, usage, func(s string) error {
+			value, err := loadValue(&param, s)
+			if err != nil {
+				return err
+			}
+			c.layers.set(CfgSourceFlag, param.Key, value)
+			return nil
+		})
+	}
+}
+
+// ParseFlags 使用args解析命令行参数，args一般为os.Args[1:]
+func (c *CfgExt) ParseFlags(args []string) error {
+	if !c.initTag.IsInitialized() {
+		return ErrNotInitialized
+	}
+	fs := flag.NewFlagSet("cfg", flag.ContinueOnError)
+	c.BindFlags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return errors.Join(ErrCfgLoad, err)
+	}
+	return nil
+}
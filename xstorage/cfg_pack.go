@@ -3,6 +3,8 @@ package xstorage
 import (
 	"errors"
 	"github.com/intmian/mian_go_lib/tool/misc"
+	"regexp"
+	"sort"
 	"strings"
 	"sync"
 )
@@ -13,6 +15,17 @@ type CfgParam struct {
 	CanUser   bool      // 是否可以用户配置
 	RealKey   string    // storage里面的key
 	Default   ValueUnit // 如果storage里面没有这个值，就会使用这个值。
+	Desc      string    // 描述，导出schema时使用
+
+	// 以下为约束，零值代表不检查，Set与SetUser时会校验，具体见Validate
+	Required bool          // 不能为空值，并且CheckRequired时必须有值或默认值
+	Min      *float64      // 数值的最小值
+	Max      *float64      // 数值的最大值
+	Pattern  string        // 字符串需要匹配的正则
+	Enum     []interface{} // 允许的值，按json比较，例如 []interface{}{"a", "b"}
+	MinLen   int           // 字符串的最小长度（字符数），slice、map的最少元素数
+	MaxLen   int           // 字符串的最大长度（字符数），slice、map的最多元素数，<=0时不限制
+	pattern  *regexp.Regexp
 }
 
 type ParamMap struct {
@@ -32,6 +45,10 @@ func (p *ParamMap) AddParam(param *CfgParam) error {
 	if param.RealKey == "" {
 		param.RealKey = param.Key
 	}
+	err := param.compile()
+	if err != nil {
+		return errors.Join(ErrParamIsInvalid, err)
+	}
 	_, ok := p.paramMap[param.Key]
 	if ok {
 		return ErrKeyAlreadyExist
@@ -50,6 +67,8 @@ func (p *ParamMap) GetParam(key string) *CfgParam {
 type CfgExt struct {
 	core     *XStorage
 	paramMap ParamMap
+	layers   cfgLayers
+	his      cfgHistory
 	initTag  misc.InitTag
 }
 
@@ -84,6 +103,11 @@ func (c *CfgExt) AddParam(param *CfgParam) error {
 }
 
 func (c *CfgExt) Set(key string, value string) error {
+	return c.SetBy("", "", key, value)
+}
+
+// SetBy 与Set相同，operator与comment会记录在修改历史中
+func (c *CfgExt) SetBy(operator, comment, key string, value string) error {
 	if !c.initTag.IsInitialized() {
 		return ErrNotInitialized
 	}
@@ -99,11 +123,20 @@ func (c *CfgExt) Set(key string, value string) error {
 	if v == nil {
 		return ErrParamIsInvalid
 	}
+	err := param.Validate(v)
+	if err != nil {
+		return err
+	}
 
-	return c.core.Set(param.RealKey, v)
+	return c.setWithHistory(CfgChange{Key: key, Operator: operator, Comment: comment, New: v}, param.RealKey)
 }
 
 func (c *CfgExt) SetUser(user, key string, value string) error {
+	return c.SetUserBy("", "", user, key, value)
+}
+
+// SetUserBy 与SetUser相同，operator与comment会记录在修改历史中
+func (c *CfgExt) SetUserBy(operator, comment, user, key string, value string) error {
 	if !c.initTag.IsInitialized() {
 		return ErrNotInitialized
 	}
@@ -120,61 +153,51 @@ func (c *CfgExt) SetUser(user, key string, value string) error {
 	if v == nil {
 		return ErrParamIsInvalid
 	}
+	err := param.Validate(v)
+	if err != nil {
+		return err
+	}
 
-	return c.core.Set(Join(param.RealKey, user), v)
+	return c.setWithHistory(CfgChange{Key: key, User: user, Operator: operator, Comment: comment, New: v}, Join(param.RealKey, user))
 }
 
+// GetAll 返回所有有值的参数，来源见GetAllWithSource
 func (c *CfgExt) GetAll() (map[string]ValueUnit, error) {
-	if !c.initTag.IsInitialized() {
-		return nil, ErrNotInitialized
+	all, err := c.GetAllWithSource("")
+	if err != nil {
+		return nil, err
 	}
-	ret := make(map[string]ValueUnit)
-	for k, v := range c.paramMap.paramMap {
-		value, err := c.core.Get(v.RealKey)
-		if err != nil {
-			return nil, err
-		}
-		if value == nil {
-			continue
-		}
-		ret[k] = *value
+	ret := make(map[string]ValueUnit, len(all))
+	for k, v := range all {
+		ret[k] = v.Value
 	}
 	return ret, nil
 }
 
+// GetWithFilter 返回Key以prefix.开头的参数，user不为空时优先使用用户的配置，有参数没有值时返回ErrKeyNotFound
 func (c *CfgExt) GetWithFilter(prefix, user string) (map[string]ValueUnit, error) {
 	if !c.initTag.IsInitialized() {
 		return nil, ErrNotInitialized
 	}
 	ret := make(map[string]ValueUnit)
 	realPrefix := prefix + "."
-	for logicKey, params := range c.paramMap.paramMap {
-		if prefix != "" && !strings.HasPrefix(logicKey, realPrefix) {
+	for _, param := range c.Params() {
+		if prefix != "" && !strings.HasPrefix(param.Key, realPrefix) {
 			continue
 		}
-		if user == "" {
-			value, err := c.core.Get(params.RealKey)
-			if err != nil {
-				return nil, err
-			}
-			if value == nil {
-				return nil, ErrKeyNotFound
-			}
-			ret[logicKey] = *value
-		} else {
-			value, err := c.core.Get(Join(params.RealKey, user))
-			if err != nil {
-				return nil, err
-			}
-			if value == nil {
-				return nil, ErrKeyNotFound
-			}
-			ret[logicKey] = *value
+		value, _, err := c.resolve(&param, user)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			return nil, ErrKeyNotFound
 		}
+		ret[param.Key] = *value
 	}
 	return ret, nil
 }
 
+// GetUser 读取用户的配置，用户没有配置时逐层回退到全局配置与默认值
 func (c *CfgExt) GetUser(user string, keys ...string) (*ValueUnit, error) {
 	if !c.initTag.IsInitialized() {
 		return nil, ErrNotInitialized
@@ -190,37 +213,61 @@ func (c *CfgExt) GetUser(user string, keys ...string) (*ValueUnit, error) {
 	if !param.CanUser {
 		return nil, ErrParamIsInvalid
 	}
-	v, err := c.core.Get(Join(param.RealKey, user))
-	if err != nil {
-		if errors.Is(err, ErrKeyNotFound) {
-			return &param.Default, nil
-		} else {
-			return nil, err
-		}
-	}
+	v, _, err := c.resolve(param, user)
 	return v, err
 }
 
+// Get 读取全局配置，按命令行、环境变量、存储、文件、默认值的顺序取第一个有值的层，都没有时返回nil
 func (c *CfgExt) Get(keys ...string) (*ValueUnit, error) {
+	v, _, err := c.GetWithSource("", keys...)
+	return v, err
+}
+
+// Params 返回所有参数的副本，按Key排序
+func (c *CfgExt) Params() []CfgParam {
+	c.paramMap.paramMapLock.RLock()
+	defer c.paramMap.paramMapLock.RUnlock()
+	ret := make([]CfgParam, 0, len(c.paramMap.paramMap))
+	for _, p := range c.paramMap.paramMap {
+		ret = append(ret, *p)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Key < ret[j].Key
+	})
+	return ret
+}
+
+// UserValues 返回参数key所有用户的配置，key为用户名
+func (c *CfgExt) UserValues(key string) (map[string]ValueUnit, error) {
 	if !c.initTag.IsInitialized() {
 		return nil, ErrNotInitialized
 	}
-	if len(keys) == 0 {
-		return nil, ErrParamIsEmpty
-	}
-	realLogicKey := Join(keys...)
-	param := c.paramMap.GetParam(realLogicKey)
+	param := c.paramMap.GetParam(key)
 	if param == nil {
-		return nil, ErrParamIsInvalid
+		return nil, ErrKeyNotFound
 	}
-
-	v, err := c.core.Get(param.RealKey)
+	ret := make(map[string]ValueUnit)
+	if !param.CanUser {
+		return ret, nil
+	}
+	// 其他参数的RealKey可能以本参数的RealKey为前缀，需要跳过
+	realKeys := make(map[string]bool)
+	c.paramMap.paramMapLock.RLock()
+	for _, p := range c.paramMap.paramMap {
+		realKeys[p.RealKey] = true
+	}
+	c.paramMap.paramMapLock.RUnlock()
+	prefix := Join(param.RealKey, "")
+	pairs, err := c.core.GetByPrefix(prefix)
 	if err != nil {
-		if errors.Is(err, ErrKeyNotFound) {
-			return &param.Default, nil
-		} else {
-			return nil, err
+		return nil, err
+	}
+	for _, pair := range pairs {
+		user := strings.TrimPrefix(pair.Key, prefix)
+		if user == "" || strings.Contains(user, ".") || realKeys[pair.Key] {
+			continue
 		}
+		ret[user] = *pair.Value
 	}
-	return v, err
+	return ret, nil
 }
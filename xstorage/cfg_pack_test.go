@@ -1,9 +1,15 @@
 package xstorage
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"github.com/intmian/mian_go_lib/tool/misc"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestCfg(t *testing.T) {
@@ -33,14 +39,14 @@ func TestCfg(t *testing.T) {
 		Key:       "test3",
 		ValueType: ValueTypeInt,
 		CanUser:   true,
-		Default:   ToUnit(123, ValueTypeInt),
+		Default:   *ToUnit(123, ValueTypeInt),
 		RealKey:   "test3real",
 	})
 	err4 := cfg.AddParam(&CfgParam{
 		Key:       "test4",
 		ValueType: ValueTypeInt,
 		CanUser:   false,
-		Default:   ToUnit(123, ValueTypeInt),
+		Default:   *ToUnit(123, ValueTypeInt),
 		RealKey:   "test4real",
 	})
 	err = misc.JoinErr(err1, err2, err3, err4)
@@ -56,8 +62,8 @@ func TestCfg(t *testing.T) {
 
 	// 测试默认
 	v, _ = cfg.Get("test3")
-	if v != nil {
-		t.Fatal("test3 should be nil")
+	if v == nil || ToBase[int](v) != 123 {
+		t.Fatal("test3 should be default")
 	}
 	v, _ = cfg.Get("test4")
 	if v == nil {
@@ -99,3 +105,352 @@ func TestCfg(t *testing.T) {
 		}
 	}
 }
+
+func TestCfgConstraint(t *testing.T) {
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := NewCfgExt(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	min, max := 1.0, 10.0
+	err = misc.JoinErr(
+		cfg.AddParam(&CfgParam{Key: "limit", ValueType: ValueTypeInt, Min: &min, Max: &max, Default: *ToUnit(5, ValueTypeInt)}),
+		cfg.AddParam(&CfgParam{Key: "name", ValueType: ValueTypeString, Pattern: "^[a-z]+$", MaxLen: 5, Required: true}),
+		cfg.AddParam(&CfgParam{Key: "mode", ValueType: ValueTypeString, Enum: []interface{}{"fast", "slow"}}),
+		cfg.AddParam(&CfgParam{Key: "ports", ValueType: ValueTypeSliceInt, CanUser: true, MinLen: 1, MaxLen: 2, Min: &min}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.AddParam(&CfgParam{Key: "bad", ValueType: ValueTypeInt, Max: &min, Default: *ToUnit(5, ValueTypeInt)})
+	if !errors.Is(err, ErrParamIsInvalid) {
+		t.Fatal("default out of range should be invalid")
+	}
+	if !errors.Is(cfg.CheckRequired(), ErrCfgRequired) {
+		t.Fatal("name is required")
+	}
+
+	cases := []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{"limit", "11", ErrCfgOutOfRange},
+		{"limit", "0", ErrCfgOutOfRange},
+		{"limit", "10", nil},
+		{"name", `"abc1"`, ErrCfgPattern},
+		{"name", `"abcdef"`, ErrCfgLength},
+		{"name", `""`, ErrCfgRequired},
+		{"name", `"abc"`, nil},
+		{"mode", `"normal"`, ErrCfgEnum},
+		{"mode", `"slow"`, nil},
+		{"ports", `[]`, ErrCfgLength},
+		{"ports", `[1,2,3]`, ErrCfgLength},
+		{"ports", `[0]`, ErrCfgOutOfRange},
+		{"ports", `[80,443]`, nil},
+	}
+	for _, c := range cases {
+		err := cfg.Set(c.key, c.value)
+		if c.err == nil && err != nil || c.err != nil && !errors.Is(err, c.err) {
+			t.Fatalf("set %s %s: want %v got %v", c.key, c.value, c.err, err)
+		}
+	}
+	if !errors.Is(cfg.SetUser("u1", "ports", `[0]`), ErrCfgOutOfRange) {
+		t.Fatal("SetUser should be validated")
+	}
+	if cfg.CheckRequired() != nil {
+		t.Fatal("name has been set")
+	}
+
+	b, err := cfg.JSONSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties map[string]map[string]interface{} `json:"properties"`
+		Required   []string                          `json:"required"`
+	}
+	err = json.Unmarshal(b, &schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schema.Required) != 1 || schema.Required[0] != "name" {
+		t.Fatal("schema required error")
+	}
+	ports := schema.Properties["ports"]
+	if ports["type"] != "array" || ports["maxItems"] != 2.0 || ports["items"].(map[string]interface{})["minimum"] != 1.0 {
+		t.Fatalf("schema ports error %v", ports)
+	}
+	if schema.Properties["limit"]["default"] != 5.0 || schema.Properties["name"]["pattern"] != "^[a-z]+$" {
+		t.Fatalf("schema error %s", b)
+	}
+}
+
+func TestCfgLayer(t *testing.T) {
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := NewCfgExt(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	max := 100.0
+	err = misc.JoinErr(
+		cfg.AddParam(&CfgParam{Key: "news.limit", ValueType: ValueTypeInt, CanUser: true, Max: &max, Default: *ToUnit(1, ValueTypeInt)}),
+		cfg.AddParam(&CfgParam{Key: "news.keywords", ValueType: ValueTypeSliceString}),
+		cfg.AddParam(&CfgParam{Key: "news.tags", ValueType: ValueTypeMapString}),
+		cfg.AddParam(&CfgParam{Key: "name", ValueType: ValueTypeString}),
+		cfg.AddParam(&CfgParam{Key: "none", ValueType: ValueTypeString}),
+		cfg.AddParam(&CfgParam{Key: "token", ValueType: ValueTypeString, Required: true}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(user string, key string, want interface{}, source CfgSource) {
+		t.Helper()
+		v, s, err := cfg.GetWithSource(user, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s != source {
+			t.Fatalf("%s source want %s got %s", key, source, s)
+		}
+		b1, _ := json.Marshal(want)
+		b2, _ := json.Marshal(v.Data)
+		if string(b1) != string(b2) {
+			t.Fatalf("%s want %s got %s", key, b1, b2)
+		}
+	}
+	check("", "news.limit", 1, CfgSourceDefault)
+
+	dir := t.TempDir()
+	file := filepath.Join(dir, "cfg.toml")
+	err = os.WriteFile(file, []byte("name = \"file\"\nother = 1\n[news]\nlimit = 2\nkeywords = [\"a\", \"b\"]\n[news.tags]\nx = \"y\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.LoadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("", "news.limit", 2, CfgSourceFile)
+	check("", "news.keywords", []string{"a", "b"}, CfgSourceFile)
+	check("", "news.tags", map[string]string{"x": "y"}, CfgSourceFile)
+	check("", "name", "file", CfgSourceFile)
+
+	envFile := filepath.Join(dir, ".env")
+	err = os.WriteFile(envFile, []byte("APP_NEWS_LIMIT=3\nAPP_NAME=dotenv\nAPP_TOKEN=secret\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("APP_NAME", "env")
+	t.Setenv("APP_NEWS_KEYWORDS", "c,d")
+	if !errors.Is(cfg.CheckRequired(), ErrCfgRequired) {
+		t.Fatal("token is required")
+	}
+	err = cfg.LoadEnv("APP_", envFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 只在环境变量中的值同样满足Required
+	if cfg.CheckRequired() != nil {
+		t.Fatal("token is set by env")
+	}
+	check("", "news.limit", 3, CfgSourceEnv)
+	check("", "news.keywords", []string{"c", "d"}, CfgSourceEnv)
+	check("", "name", "env", CfgSourceEnv)
+
+	err = cfg.ParseFlags([]string{"-news.limit=4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("", "news.limit", 4, CfgSourceFlag)
+	if cfg.ParseFlags([]string{"-news.limit=101"}) == nil {
+		t.Fatal("flag should be validated")
+	}
+
+	// 存储中的值覆盖文件，但是不能覆盖环境变量与命令行
+	err = misc.JoinErr(
+		cfg.Set("news.limit", "5"),
+		cfg.Set("name", `"store"`),
+		cfg.Set("news.tags", `{"x":"z"}`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("", "news.limit", 4, CfgSourceFlag)
+	check("", "name", "env", CfgSourceEnv)
+	check("", "news.tags", map[string]string{"x": "z"}, CfgSourceStore)
+	err = cfg.SetUser("u1", "news.limit", "6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("u1", "news.limit", 6, CfgSourceUser)
+	check("u2", "news.limit", 4, CfgSourceFlag)
+	check("u1", "name", "env", CfgSourceEnv)
+
+	all, err := cfg.GetAllWithSource("u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 5 || all["news.limit"].Source != CfgSourceUser || all["news.tags"].Source != CfgSourceStore {
+		t.Fatalf("get all error %v", all)
+	}
+	if _, ok := all["none"]; ok {
+		t.Fatal("none should not have value")
+	}
+}
+
+func TestCfgHistory(t *testing.T) {
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := NewCfgExt(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = misc.JoinErr(
+		cfg.AddParam(&CfgParam{Key: "limit", ValueType: ValueTypeInt, CanUser: true}),
+		cfg.AddParam(&CfgParam{Key: "keywords", ValueType: ValueTypeSliceString}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Now()
+	err = misc.JoinErr(
+		cfg.SetBy("alice", "init", "limit", "1"),
+		cfg.Set("keywords", `["a"]`),
+		cfg.SetUserBy("bob", "", "u1", "limit", "10"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t1 := time.Now()
+	err = misc.JoinErr(
+		cfg.SetBy("bob", "bigger", "limit", "2"),
+		cfg.Set("keywords", `["a","b"]`),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t2 := time.Now()
+
+	his, err := cfg.History("limit", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(his) != 2 || his[0].Operator != "alice" || his[0].Comment != "init" || his[0].Old != nil ||
+		ToBase[int](his[1].Old) != 1 || ToBase[int](his[1].New) != 2 || his[1].Operator != "bob" {
+		t.Fatalf("history error %+v", his)
+	}
+	his, err = cfg.History("limit", "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(his) != 1 || his[0].User != "u1" || ToBase[int](his[0].New) != 10 {
+		t.Fatalf("user history error %+v", his)
+	}
+
+	diff, err := cfg.Diff(t1, t2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 2 || diff[0].Key != "keywords" || len(ToBase[[]string](diff[0].To)) != 2 || diff[1].Key != "limit" || ToBase[int](diff[1].From) != 1 {
+		t.Fatalf("diff error %+v", diff)
+	}
+	diff, err = cfg.Diff(t0, t2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 3 || diff[0].From != nil || diff[2].User != "u1" {
+		t.Fatalf("diff error %+v", diff)
+	}
+
+	err = cfg.Rollback("carol", "limit", "", t1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ := cfg.Get("limit")
+	if ToBase[int](v) != 1 {
+		t.Fatal("rollback error")
+	}
+	v, _ = cfg.Get("keywords")
+	if len(ToBase[[]string](v)) != 2 {
+		t.Fatal("rollback should only change limit")
+	}
+	his, _ = cfg.History("limit", "")
+	if len(his) != 3 || his[2].Operator != "carol" || ToBase[int](his[2].New) != 1 {
+		t.Fatalf("rollback should be recorded %+v", his)
+	}
+
+	err = cfg.RollbackAll("carol", t0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"limit", "keywords"} {
+		v, _ = cfg.Get(key)
+		if v != nil {
+			t.Fatalf("%s should be deleted", key)
+		}
+	}
+	v, _ = m.Get("limit.u1")
+	if v != nil {
+		t.Fatal("user value should be deleted")
+	}
+	err = cfg.RollbackAll("carol", t2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, _ = cfg.GetUser("u1", "limit")
+	if ToBase[int](v) != 10 {
+		t.Fatal("rollback all error")
+	}
+
+	// 历史不会出现在列表与导出中
+	all, err := m.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k := range all {
+		if internalPrefixOf(k) != "" {
+			t.Fatalf("history should be hidden %s", k)
+		}
+	}
+	ret, err := m.Scan(ScanOption{Limit: 1})
+	if err != nil || len(ret.Pairs) != 1 || internalPrefixOf(ret.Pairs[0].Key) != "" {
+		t.Fatalf("scan should skip history %+v %v", ret, err)
+	}
+	var buf bytes.Buffer
+	err = m.Export(&buf)
+	if err != nil || bytes.Contains(buf.Bytes(), []byte(cfgHistoryPrefix)) {
+		t.Fatalf("export should not contain history %v", err)
+	}
+
+	// 超出数量的旧历史在写入时删除，用户的历史单独计算
+	cfg.SetHistoryLimit(2)
+	for i := 0; i < 3; i++ {
+		err = cfg.Set("limit", strconv.Itoa(100+i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	his, _ = cfg.History("limit", "")
+	if len(his) != 2 || ToBase[int](his[0].New) != 101 || ToBase[int](his[1].New) != 102 {
+		t.Fatalf("history limit error %+v", his)
+	}
+	his, _ = cfg.History("limit", "u1")
+	if len(his) != 3 {
+		t.Fatalf("user history should not be pruned %+v", his)
+	}
+}
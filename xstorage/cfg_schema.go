@@ -0,0 +1,280 @@
+package xstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"unicode/utf8"
+)
+
+// compile 检查约束本身是否合法，并编译正则。默认值不满足约束时也视为不合法
+func (p *CfgParam) compile() error {
+	if p.Pattern != "" {
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return err
+		}
+		p.pattern = re
+	}
+	if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+		return ErrCfgOutOfRange
+	}
+	if p.MaxLen > 0 && p.MinLen > p.MaxLen {
+		return ErrCfgLength
+	}
+	if p.Default.Type != 0 {
+		return p.Validate(&p.Default)
+	}
+	return nil
+}
+
+/*
+Validate 检查value是否满足param的约束。
+slice类型的MinLen、MaxLen限制元素数量，Min、Max、Pattern、Enum作用于每个元素。
+Required时value不能为nil、空字符串、空slice或空map。
+*/
+func (p *CfgParam) Validate(value *ValueUnit) error {
+	if value == nil {
+		if p.Required {
+			return errors.Join(ErrCfgRequired, fmt.Errorf("%s is empty", p.Key))
+		}
+		return nil
+	}
+	if value.Type != p.ValueType {
+		return ErrValueTypeNotMatch
+	}
+	if p.pattern == nil && p.Pattern != "" {
+		// 没有通过AddParam添加的参数
+		re, err := regexp.Compile(p.Pattern)
+		if err != nil {
+			return errors.Join(ErrParamIsInvalid, err)
+		}
+		compiled := *p
+		compiled.pattern = re
+		p = &compiled
+	}
+	switch data := value.Data.(type) {
+	case string:
+		err := p.checkLen(utf8.RuneCountInString(data))
+		if err != nil {
+			return err
+		}
+		return p.checkElem(data)
+	case map[string]string:
+		return p.checkLen(len(data))
+	case map[string]int:
+		return p.checkLen(len(data))
+	case []string:
+		return checkSlice(p, data)
+	case []int:
+		return checkSlice(p, data)
+	case []float32:
+		return checkSlice(p, data)
+	case []bool:
+		return checkSlice(p, data)
+	default:
+		return p.checkElem(data)
+	}
+}
+
+func checkSlice[T any](p *CfgParam, data []T) error {
+	err := p.checkLen(len(data))
+	if err != nil {
+		return err
+	}
+	for _, v := range data {
+		err = p.checkElem(v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkLen 检查字符串长度或元素数量
+func (p *CfgParam) checkLen(n int) error {
+	if p.Required && n == 0 {
+		return errors.Join(ErrCfgRequired, fmt.Errorf("%s is empty", p.Key))
+	}
+	if n < p.MinLen || (p.MaxLen > 0 && n > p.MaxLen) {
+		return errors.Join(ErrCfgLength, fmt.Errorf("%s length %d not in [%d, %d]", p.Key, n, p.MinLen, p.MaxLen))
+	}
+	return nil
+}
+
+// checkElem 检查单个值的范围、正则与枚举
+func (p *CfgParam) checkElem(v interface{}) error {
+	if f, ok := toFloat(v); ok {
+		if p.Min != nil && f < *p.Min {
+			return errors.Join(ErrCfgOutOfRange, fmt.Errorf("%s value %v < min %v", p.Key, v, *p.Min))
+		}
+		if p.Max != nil && f > *p.Max {
+			return errors.Join(ErrCfgOutOfRange, fmt.Errorf("%s value %v > max %v", p.Key, v, *p.Max))
+		}
+	}
+	if s, ok := v.(string); ok && p.pattern != nil && !p.pattern.MatchString(s) {
+		return errors.Join(ErrCfgPattern, fmt.Errorf("%s value %q not match %s", p.Key, s, p.Pattern))
+	}
+	if len(p.Enum) > 0 {
+		b, err := json.Marshal(v)
+		if err != nil {
+			return errors.Join(ErrJsonMarshalErr, err)
+		}
+		for _, e := range p.Enum {
+			eb, err := json.Marshal(e)
+			if err == nil && string(eb) == string(b) {
+				return nil
+			}
+		}
+		return errors.Join(ErrCfgEnum, fmt.Errorf("%s value %s not in enum", p.Key, b))
+	}
+	return nil
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	default:
+		return 0, false
+	}
+}
+
+// CheckRequired 检查所有Required的参数在存储、命令行、环境变量、文件与默认值中是否有值，返回所有缺少的参数的错误
+func (c *CfgExt) CheckRequired() error {
+	if !c.initTag.IsInitialized() {
+		return ErrNotInitialized
+	}
+	var errs []error
+	for _, p := range c.Params() {
+		if !p.Required {
+			continue
+		}
+		v, _, err := c.resolve(&p, "")
+		if err != nil {
+			return err
+		}
+		if v == nil {
+			errs = append(errs, fmt.Errorf("%s is not set", p.Key))
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errors.Join(append([]error{ErrCfgRequired}, errs...)...)
+}
+
+// jsonSchemaType 返回ValueType对应的json schema，不含约束
+func jsonSchemaType(t ValueType) map[string]interface{} {
+	switch t {
+	case ValueTypeString:
+		return map[string]interface{}{"type": "string"}
+	case ValueTypeInt, ValueTypeInt64:
+		return map[string]interface{}{"type": "integer"}
+	case ValueTypeFloat, ValueTypeFloat64:
+		return map[string]interface{}{"type": "number"}
+	case ValueTypeBool:
+		return map[string]interface{}{"type": "boolean"}
+	case ValueTypeTime:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case ValueTypeMapString:
+		return map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "string"}}
+	case ValueTypeMapInt:
+		return map[string]interface{}{"type": "object", "additionalProperties": map[string]interface{}{"type": "integer"}}
+	}
+	if t > ValueTypeSliceBegin {
+		return map[string]interface{}{"type": "array", "items": jsonSchemaType(t - ValueTypeSliceString + ValueTypeString)}
+	}
+	return map[string]interface{}{}
+}
+
+// Schema 返回参数的json schema，约束会写入对应的关键字，ValueType与CanUser写入x-valueType与x-canUser
+func (p *CfgParam) Schema() map[string]interface{} {
+	schema := jsonSchemaType(p.ValueType)
+	elem := schema
+	if items, ok := schema["items"].(map[string]interface{}); ok {
+		elem = items
+		if p.MinLen > 0 {
+			schema["minItems"] = p.MinLen
+		}
+		if p.MaxLen > 0 {
+			schema["maxItems"] = p.MaxLen
+		}
+	} else if schema["type"] == "object" {
+		if p.MinLen > 0 {
+			schema["minProperties"] = p.MinLen
+		}
+		if p.MaxLen > 0 {
+			schema["maxProperties"] = p.MaxLen
+		}
+	} else if p.ValueType == ValueTypeString {
+		if p.MinLen > 0 {
+			schema["minLength"] = p.MinLen
+		}
+		if p.MaxLen > 0 {
+			schema["maxLength"] = p.MaxLen
+		}
+	}
+	if p.Required && schema["type"] == "string" && p.MinLen == 0 {
+		schema["minLength"] = 1
+	}
+	if p.Required && schema["type"] == "array" && p.MinLen == 0 {
+		schema["minItems"] = 1
+	}
+	if p.Min != nil {
+		elem["minimum"] = *p.Min
+	}
+	if p.Max != nil {
+		elem["maximum"] = *p.Max
+	}
+	if p.Pattern != "" {
+		elem["pattern"] = p.Pattern
+	}
+	if len(p.Enum) > 0 {
+		elem["enum"] = p.Enum
+	}
+	if p.Desc != "" {
+		schema["description"] = p.Desc
+	}
+	if p.Default.Type != 0 {
+		schema["default"] = p.Default.Data
+	}
+	schema["x-valueType"] = p.ValueType
+	schema["x-canUser"] = p.CanUser
+	return schema
+}
+
+// JSONSchema 导出所有参数的json schema（draft 2020-12），属性名为参数的Key，供前端生成表单
+func (c *CfgExt) JSONSchema() ([]byte, error) {
+	if !c.initTag.IsInitialized() {
+		return nil, ErrNotInitialized
+	}
+	properties := make(map[string]interface{})
+	required := make([]string, 0)
+	for _, p := range c.Params() {
+		properties[p.Key] = p.Schema()
+		if p.Required {
+			required = append(required, p.Key)
+		}
+	}
+	sort.Strings(required)
+	schema := map[string]interface{}{
+		"$schema":    "https://json-schema.org/draft/2020-12/schema",
+		"type":       "object",
+		"properties": properties,
+		"required":   required,
+	}
+	b, err := json.Marshal(schema)
+	if err != nil {
+		return nil, errors.Join(ErrJsonMarshalErr, err)
+	}
+	return b, nil
+}
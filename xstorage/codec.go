@@ -0,0 +1,55 @@
+package xstorage
+
+import (
+	"encoding/json"
+	"errors"
+)
+
+// unitRecord ValueUnit落盘时的格式，Data按Type还原为具体类型，避免slice被解析为[]interface{}
+type unitRecord struct {
+	Type     ValueType       `json:"t"`
+	Data     json.RawMessage `json:"d"`
+	ExpireAt int64           `json:"e,omitempty"`
+}
+
+func newUnitRecord(unit *ValueUnit) (*unitRecord, error) {
+	if unit == nil {
+		return nil, ErrValueUnitIsNil
+	}
+	data, err := json.Marshal(unit.Data)
+	if err != nil {
+		return nil, errors.Join(ErrJsonMarshalErr, err)
+	}
+	return &unitRecord{
+		Type:     unit.Type,
+		Data:     data,
+		ExpireAt: unit.ExpireAt,
+	}, nil
+}
+
+func (r *unitRecord) toUnit(rec *ValueUnit) error {
+	unit := StringToUnit(string(r.Data), r.Type)
+	if unit == nil {
+		return ErrJsonUnmarshalErr
+	}
+	unit.ExpireAt = r.ExpireAt
+	*rec = *unit
+	return nil
+}
+
+func encodeUnit(unit *ValueUnit) ([]byte, error) {
+	r, err := newUnitRecord(unit)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(r)
+}
+
+func decodeUnit(b []byte, rec *ValueUnit) error {
+	var r unitRecord
+	err := json.Unmarshal(b, &r)
+	if err != nil {
+		return errors.Join(ErrJsonUnmarshalErr, err)
+	}
+	return r.toUnit(rec)
+}
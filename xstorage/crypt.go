@@ -0,0 +1,705 @@
+package xstorage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/intmian/mian_go_lib/tool/cipher"
+	"github.com/intmian/mian_go_lib/tool/misc"
+)
+
+/*
+加密只作用于落盘的数据，缓存中依然是明文。加密后的值以字符串的形式落盘
+
+	xenc1:<密钥id>:<原类型>:<base64(密文+hmac)>
+
+明文为codec中的unitRecord，前面加上一个随机的块，所以相同的值每次加密的结果都不同。
+hmac同时覆盖了key，密文不能被挪到其他key下使用。明文的字符串值不能以xenc1:开头。
+*/
+const cryptPrefix = "xenc1:"
+
+// SetEncrypted标记的key保存在同一个存储中，key为 __cryptmark.<存储中的key>，Init时读取
+const cryptMarkPrefix = "__cryptmark"
+
+// IKeyProvider 提供加密用的密钥，密钥长度需要为16、24或32字节，id中不能包含:
+type IKeyProvider interface {
+	// CurrentKey 返回当前用于加密的密钥及其id，id会记录在密文中
+	CurrentKey() (id string, key []byte, err error)
+	// Key 返回id对应的密钥，用于解密旧的值
+	Key(id string) ([]byte, error)
+}
+
+// KeyRing 内存中的IKeyProvider，可以保存多个密钥用于轮换
+type KeyRing struct {
+	lock    sync.RWMutex
+	keys    map[string][]byte
+	current string
+}
+
+// NewKeyRing 创建一个以id、key为当前密钥的KeyRing
+func NewKeyRing(id string, key []byte) (*KeyRing, error) {
+	r := &KeyRing{keys: make(map[string][]byte)}
+	err := r.AddKey(id, key)
+	if err != nil {
+		return nil, err
+	}
+	r.current = id
+	return r, nil
+}
+
+// AddKey 加入一个密钥，不会改变当前密钥
+func (r *KeyRing) AddKey(id string, key []byte) error {
+	if id == "" || strings.Contains(id, ":") {
+		return ErrCryptKeyIdInvalid
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return ErrCryptKeyInvalid
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.keys[id] = append([]byte(nil), key...)
+	return nil
+}
+
+// SetCurrent 切换当前密钥，之后写入的值会使用新的密钥，已有的值需要调用XStorage.RotateKey重新加密
+func (r *KeyRing) SetCurrent(id string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, ok := r.keys[id]; !ok {
+		return ErrCryptKeyNotFound
+	}
+	r.current = id
+	return nil
+}
+
+// RemoveKey 删除一个不再使用的密钥，不能删除当前密钥
+func (r *KeyRing) RemoveKey(id string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if id == r.current {
+		return ErrCryptKeyInUse
+	}
+	delete(r.keys, id)
+	return nil
+}
+
+func (r *KeyRing) CurrentKey() (string, []byte, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	key, ok := r.keys[r.current]
+	if !ok {
+		return "", nil, ErrCryptKeyNotFound
+	}
+	return r.current, key, nil
+}
+
+func (r *KeyRing) Key(id string) ([]byte, error) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	key, ok := r.keys[id]
+	if !ok {
+		return nil, ErrCryptKeyNotFound
+	}
+	return key, nil
+}
+
+// EncryptSetting 落盘加密的设置
+type EncryptSetting struct {
+	Provider IKeyProvider
+	// Prefixes 以这些前缀开头的key会被加密，使用命名空间时需要包含命名空间的前缀。其他key可以使用SetEncrypted单独加密
+	Prefixes []string
+}
+
+// cryptLayer 判断哪些key需要加密，并完成加解密
+type cryptLayer struct {
+	setting EncryptSetting
+	// SetEncrypted写入的key与读取时发现是密文的key
+	marked sync.Map
+	// 已经保存了标记的key，SetEncrypted只在第一次时写入标记
+	saved sync.Map
+}
+
+func newCryptLayer(setting EncryptSetting) (*cryptLayer, error) {
+	if setting.Provider == nil {
+		return nil, ErrKeyProviderIsNil
+	}
+	_, _, err := setting.Provider.CurrentKey()
+	if err != nil {
+		return nil, errors.Join(ErrEncrypt, err)
+	}
+	return &cryptLayer{setting: setting}, nil
+}
+
+func (c *cryptLayer) mark(key string) {
+	c.marked.Store(key, true)
+}
+
+// need key是否需要加密，加密的配置的修改历史中有旧值与新值，所以也需要加密
+func (c *cryptLayer) need(key string) bool {
+	if _, ok := c.marked.Load(key); ok {
+		return true
+	}
+	for _, prefix := range c.setting.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	if rest := strings.TrimPrefix(key, Join(cfgHistoryPrefix, "")); rest != key {
+		if i := strings.LastIndex(rest, "."); i > 0 {
+			return c.need(rest[:i])
+		}
+	}
+	return false
+}
+
+func macKey(key []byte) string {
+	return string(cipher.Sha2562Bytes(append([]byte("xstorage mac "), key...)))
+}
+
+func (c *cryptLayer) encrypt(key string, unit *ValueUnit) (*ValueUnit, error) {
+	id, secret, err := c.setting.Provider.CurrentKey()
+	if err != nil {
+		return nil, errors.Join(ErrEncrypt, err)
+	}
+	if id == "" || strings.Contains(id, ":") {
+		return nil, errors.Join(ErrEncrypt, ErrCryptKeyIdInvalid)
+	}
+	plain, err := encodeUnit(unit)
+	if err != nil {
+		return nil, errors.Join(ErrEncrypt, err)
+	}
+	// CBC的iv是固定的，用一个随机的块代替iv
+	nonce := make([]byte, aes.BlockSize, aes.BlockSize+len(plain))
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, errors.Join(ErrEncrypt, err)
+	}
+	sealed, err := cipher.AesEncrypt(append(nonce, plain...), secret)
+	if err != nil {
+		return nil, errors.Join(ErrEncrypt, err)
+	}
+	header := fmt.Sprintf("%s%s:%d:", cryptPrefix, id, unit.Type)
+	mac := cipher.HmacSha256Sign(macKey(secret), key+"\x00"+header+string(sealed))
+	return &ValueUnit{
+		Type:     ValueTypeString,
+		Data:     header + base64.StdEncoding.EncodeToString(append(sealed, mac...)),
+		ExpireAt: unit.ExpireAt,
+	}, nil
+}
+
+// envelope 解析密文的头部，不是密文时返回false
+func envelope(unit *ValueUnit) (id string, valueType ValueType, body string, ok bool) {
+	if unit == nil || unit.Type != ValueTypeString {
+		return "", 0, "", false
+	}
+	s, _ := unit.Data.(string)
+	if !strings.HasPrefix(s, cryptPrefix) {
+		return "", 0, "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(s, cryptPrefix), ":", 3)
+	if len(parts) != 3 {
+		return "", 0, "", false
+	}
+	t, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return "", 0, "", false
+	}
+	return parts[0], ValueType(t), parts[2], true
+}
+
+func (c *cryptLayer) decrypt(key string, unit *ValueUnit) (*ValueUnit, error) {
+	id, valueType, body, ok := envelope(unit)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	secret, err := c.setting.Provider.Key(id)
+	if err != nil {
+		return nil, errors.Join(ErrDecrypt, err)
+	}
+	raw, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, errors.Join(ErrDecrypt, err)
+	}
+	const macLen = 32
+	if len(raw) < 2*aes.BlockSize+macLen || (len(raw)-macLen)%aes.BlockSize != 0 {
+		return nil, ErrDecrypt
+	}
+	sealed, mac := raw[:len(raw)-macLen], raw[len(raw)-macLen:]
+	header := fmt.Sprintf("%s%s:%d:", cryptPrefix, id, valueType)
+	if !hmac.Equal(mac, cipher.HmacSha256Sign(macKey(secret), key+"\x00"+header+string(sealed))) {
+		return nil, errors.Join(ErrDecrypt, ErrCryptMacNotMatch)
+	}
+	plain, err := cipher.AesDecrypt(sealed, secret)
+	if err != nil {
+		return nil, errors.Join(ErrDecrypt, err)
+	}
+	if len(plain) < aes.BlockSize {
+		return nil, ErrDecrypt
+	}
+	ret := &ValueUnit{}
+	err = decodeUnit(plain[aes.BlockSize:], ret)
+	if err != nil {
+		return nil, errors.Join(ErrDecrypt, err)
+	}
+	if ret.Type != valueType {
+		return nil, errors.Join(ErrDecrypt, ErrValueTypeNotMatch)
+	}
+	return ret, nil
+}
+
+// seal 需要加密时返回密文，否则原样返回
+func (c *cryptLayer) seal(key string, unit *ValueUnit) (*ValueUnit, error) {
+	if unit == nil || !c.need(key) {
+		return unit, nil
+	}
+	return c.encrypt(key, unit)
+}
+
+// open 是密文时返回明文并标记key，否则原样返回
+func (c *cryptLayer) open(key string, unit *ValueUnit) (*ValueUnit, error) {
+	if _, _, _, ok := envelope(unit); !ok {
+		return unit, nil
+	}
+	c.mark(key)
+	return c.decrypt(key, unit)
+}
+
+// openAll 返回解密后的副本，不修改all
+func (c *cryptLayer) openAll(all map[string]*ValueUnit) (map[string]*ValueUnit, error) {
+	ret := make(map[string]*ValueUnit, len(all))
+	for key, value := range all {
+		plain, err := c.open(key, value)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("key %s", key), err)
+		}
+		ret[key] = plain
+	}
+	return ret, nil
+}
+
+// logicalType 落盘的值解密后的类型
+func logicalType(unit *ValueUnit) ValueType {
+	if _, t, _, ok := envelope(unit); ok {
+		return t
+	}
+	return unit.Type
+}
+
+// cryptDBCore 在IDBCore外加上加解密
+type cryptDBCore struct {
+	core IDBCore
+	c    *cryptLayer
+}
+
+func (d *cryptDBCore) Get(key string, rec *ValueUnit) (bool, error) {
+	if rec == nil {
+		return false, ErrRecIsNil
+	}
+	ok, err := d.core.Get(key, rec)
+	if err != nil || !ok {
+		return ok, err
+	}
+	plain, err := d.c.open(key, rec)
+	if err != nil {
+		return false, err
+	}
+	*rec = *plain
+	return true, nil
+}
+
+func (d *cryptDBCore) Set(key string, value *ValueUnit) error {
+	return d.BatchWrite([]BatchOp{{Type: BatchOpSet, Key: key, Value: value}})
+}
+
+func (d *cryptDBCore) GetAll() (map[string]*ValueUnit, error) {
+	all, err := d.core.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return d.c.openAll(all)
+}
+
+func (d *cryptDBCore) Delete(key string) error {
+	return d.core.Delete(key)
+}
+
+func (d *cryptDBCore) Scan(option ScanOption) (*ScanResult, error) {
+	ret, err := d.core.Scan(option)
+	if err != nil {
+		return nil, err
+	}
+	pairs := make([]KVPair, len(ret.Pairs))
+	for i, pair := range ret.Pairs {
+		value, err := d.c.open(pair.Key, pair.Value)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("key %s", pair.Key), err)
+		}
+		pairs[i] = KVPair{Key: pair.Key, Value: value}
+	}
+	return &ScanResult{Pairs: pairs, Next: ret.Next}, nil
+}
+
+func (d *cryptDBCore) BatchWrite(ops []BatchOp) error {
+	sealed := make([]BatchOp, len(ops))
+	hasSealed := false
+	for i, op := range ops {
+		sealed[i] = op
+		if op.Type != BatchOpSet {
+			continue
+		}
+		var err error
+		sealed[i].Value, err = d.c.seal(op.Key, op.Value)
+		if err != nil {
+			return err
+		}
+		hasSealed = hasSealed || sealed[i].Value != op.Value
+	}
+	// 密文落盘时都是字符串，数据库无法检查类型，需要先读取
+	if hasSealed {
+		return d.replace(sealed)
+	}
+	var err error
+	if len(sealed) == 1 && sealed[0].Type == BatchOpSet {
+		err = d.core.Set(sealed[0].Key, sealed[0].Value)
+	} else {
+		err = d.core.BatchWrite(sealed)
+	}
+	if !errors.Is(err, ErrValueTypeNotMatch) {
+		return err
+	}
+	return d.replace(sealed)
+}
+
+/*
+replace 检查解密后的类型后提交。明文与密文之间转换时落盘的类型会改变，
+部分数据库不允许修改已有key的类型，所以在落盘类型改变的写入前加上删除
+*/
+func (d *cryptDBCore) replace(ops []BatchOp) error {
+	ret := make([]BatchOp, 0, len(ops))
+	for _, op := range ops {
+		if op.Type == BatchOpSet && op.Value != nil {
+			old := &ValueUnit{}
+			ok, err := d.core.Get(op.Key, old)
+			if err != nil {
+				return err
+			}
+			if ok && logicalType(old) != logicalType(op.Value) {
+				return ErrValueTypeNotMatch
+			}
+			if ok && old.Type != op.Value.Type {
+				ret = append(ret, BatchOp{Type: BatchOpDelete, Key: op.Key})
+			}
+		}
+		ret = append(ret, op)
+	}
+	if len(ret) == 1 && ret[0].Type == BatchOpSet {
+		return d.core.Set(ret[0].Key, ret[0].Value)
+	}
+	return d.core.BatchWrite(ret)
+}
+
+func (d *cryptDBCore) DeleteExpired(now int64) ([]string, error) {
+	return d.core.DeleteExpired(now)
+}
+
+func (d *cryptDBCore) Update(key string, fn UpdateFunc) (*ValueUnit, error) {
+	ret, err := d.core.Update(key, func(old *ValueUnit) (*ValueUnit, error) {
+		plain, err := d.c.open(key, old)
+		if err != nil {
+			return nil, err
+		}
+		newValue, err := fn(plain)
+		if err != nil || newValue == nil {
+			return nil, err
+		}
+		return d.c.seal(key, newValue)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return d.c.open(key, ret)
+}
+
+func (d *cryptDBCore) Close() error {
+	if closer, ok := d.core.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// rotate 用当前密钥重新加密旧密钥加密的值与需要加密的明文，返回重新加密的数量
+func (d *cryptDBCore) rotate() (int, error) {
+	id, _, err := d.c.setting.Provider.CurrentKey()
+	if err != nil {
+		return 0, errors.Join(ErrEncrypt, err)
+	}
+	all, err := d.core.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	ops := make([]BatchOp, 0)
+	n := 0
+	for key, raw := range all {
+		plain := raw
+		if oldID, _, _, ok := envelope(raw); ok {
+			if oldID == id {
+				continue
+			}
+			plain, err = d.c.open(key, raw)
+			if err != nil {
+				return 0, errors.Join(fmt.Errorf("key %s", key), err)
+			}
+		} else if !d.c.need(key) {
+			continue
+		}
+		sealed, err := d.c.encrypt(key, plain)
+		if err != nil {
+			return 0, err
+		}
+		if raw.Type != sealed.Type {
+			ops = append(ops, BatchOp{Type: BatchOpDelete, Key: key})
+		}
+		ops = append(ops, BatchOp{Type: BatchOpSet, Key: key, Value: sealed})
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	err = d.core.BatchWrite(ops)
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// cryptFileCore 在IFileCore外加上加解密。文件每次全量写入，明文与当前密钥都没有变化的key复用上次的密文，
+// 否则文件内容每次都会变化，TomlCore无法分辨外部的修改
+type cryptFileCore struct {
+	core   IFileCore
+	c      *cryptLayer
+	lock   sync.Mutex
+	sealed map[string]sealedUnit
+}
+
+type sealedUnit struct {
+	plain []byte
+	id    string
+	value *ValueUnit
+}
+
+func (f *cryptFileCore) GetAll() (map[string]*ValueUnit, error) {
+	all, err := f.core.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.sealed = make(map[string]sealedUnit)
+	ret := make(map[string]*ValueUnit, len(all))
+	for key, value := range all {
+		plain, err := f.open(key, value)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("key %s", key), err)
+		}
+		ret[key] = plain
+	}
+	return ret, nil
+}
+
+func (f *cryptFileCore) SaveAll(data map[string]*ValueUnit) error {
+	_, err := f.save(data)
+	return err
+}
+
+// save 返回加密的数量
+func (f *cryptFileCore) save(data map[string]*ValueUnit) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.sealed == nil {
+		f.sealed = make(map[string]sealedUnit)
+	}
+	id, _, err := f.c.setting.Provider.CurrentKey()
+	if err != nil {
+		return 0, errors.Join(ErrEncrypt, err)
+	}
+	sealed := make(map[string]*ValueUnit, len(data))
+	n := 0
+	for key, value := range data {
+		if value == nil || !f.c.need(key) {
+			delete(f.sealed, key)
+			sealed[key] = value
+			continue
+		}
+		plain, err := encodeUnit(value)
+		if err != nil {
+			return 0, errors.Join(ErrEncrypt, err)
+		}
+		last, ok := f.sealed[key]
+		if !ok || last.id != id || !bytes.Equal(last.plain, plain) {
+			v, err := f.c.encrypt(key, value)
+			if err != nil {
+				return 0, err
+			}
+			last = sealedUnit{plain: plain, id: id, value: v}
+			f.sealed[key] = last
+		}
+		sealed[key] = last.value
+		n++
+	}
+	return n, f.core.SaveAll(sealed)
+}
+
+func (f *cryptFileCore) Reload() (bool, error) {
+	core, ok := f.core.(IWatchableFileCore)
+	if !ok {
+		return false, nil
+	}
+	return core.Reload()
+}
+
+// TakeExternal 返回解密后的修改与冲突，无法解密的key会被跳过并返回错误
+func (f *cryptFileCore) TakeExternal() (map[string]*ValueUnit, []FileConflict, error) {
+	core, ok := f.core.(IWatchableFileCore)
+	if !ok {
+		return nil, nil, nil
+	}
+	external, conflicts, err := core.TakeExternal()
+	if err != nil {
+		return nil, nil, err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var errs []error
+	ret := make(map[string]*ValueUnit, len(external))
+	for key, value := range external {
+		plain, err := f.open(key, value)
+		if err != nil {
+			errs = append(errs, errors.Join(fmt.Errorf("key %s", key), err))
+			continue
+		}
+		ret[key] = plain
+	}
+	for i := range conflicts {
+		c := &conflicts[i]
+		local, err := f.c.open(c.Key, c.Local)
+		if err != nil {
+			errs = append(errs, errors.Join(fmt.Errorf("key %s", c.Key), err))
+		}
+		external, err := f.c.open(c.Key, c.External)
+		if err != nil {
+			errs = append(errs, errors.Join(fmt.Errorf("key %s", c.Key), err))
+		}
+		c.Local, c.External = local, external
+	}
+	return ret, conflicts, errors.Join(errs...)
+}
+
+// open 解密并记录密文，之后明文没有变化时复用，调用时需要持有锁
+func (f *cryptFileCore) open(key string, value *ValueUnit) (*ValueUnit, error) {
+	plain, err := f.c.open(key, value)
+	if err != nil {
+		return nil, err
+	}
+	if plain == value {
+		delete(f.sealed, key)
+		return plain, nil
+	}
+	id, _, _, _ := envelope(value)
+	b, err := encodeUnit(plain)
+	if err == nil {
+		f.sealed[key] = sealedUnit{plain: b, id: id, value: value}
+	}
+	return plain, nil
+}
+
+// SetEncrypted 与Set相同，但是无论key是否匹配EncryptSetting.Prefixes都会加密落盘，之后这个key的Set也会加密。
+// 标记保存在存储中，重启后依然有效
+func (m *XStorage) SetEncrypted(key string, value *ValueUnit) error {
+	if !m.initTag.IsInitialized() {
+		return ErrMgrNotInit
+	}
+	if m.crypt == nil {
+		return ErrEncryptNotEnabled
+	}
+	if key == "" {
+		return ErrKeyIsEmpty
+	}
+	if _, ok := m.crypt.saved.Load(key); ok {
+		return m.Set(key, value)
+	}
+	// 标记与值一起提交，重启后依然会加密
+	m.crypt.mark(key)
+	err := m.NewBatch().Set(Join(cryptMarkPrefix, key), ToUnit(true, ValueTypeBool)).Set(key, value).Commit()
+	if err != nil {
+		return err
+	}
+	m.crypt.saved.Store(key, true)
+	return nil
+}
+
+// loadCryptMarks 读取SetEncrypted保存的标记
+func (m *XStorage) loadCryptMarks() error {
+	prefix := Join(cryptMarkPrefix, "")
+	pairs, err := m.GetByPrefix(prefix)
+	if err != nil {
+		return err
+	}
+	for _, pair := range pairs {
+		key := strings.TrimPrefix(pair.Key, prefix)
+		m.crypt.mark(key)
+		m.crypt.saved.Store(key, true)
+	}
+	return nil
+}
+
+/*
+RotateKey 使用当前密钥重新加密所有落盘的值，返回重新加密的数量。
+轮换的流程为：向IKeyProvider加入新密钥并设为当前密钥，调用RotateKey，之后旧密钥就可以删除了。
+匹配EncryptSetting.Prefixes的明文也会在这时被加密。
+*/
+func (m *XStorage) RotateKey() (int, error) {
+	if !m.initTag.IsInitialized() {
+		return 0, ErrMgrNotInit
+	}
+	if m.crypt == nil {
+		return 0, ErrEncryptNotEnabled
+	}
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.Lock()
+		defer m.rwLock.Unlock()
+	}
+	err := m.flushDirty()
+	if err != nil {
+		return 0, errors.Join(ErrRotateKey, err)
+	}
+	var n int
+	switch core := m.dbCore.(type) {
+	case *cryptDBCore:
+		n, err = core.rotate()
+	default:
+		// 只使用缓存时没有落盘的数据需要加密
+		fileCore, ok := m.fileCore.(*cryptFileCore)
+		if !ok {
+			return 0, ErrEncryptNotEnabled
+		}
+		n, err = fileCore.save(m.kvMap)
+		if err == nil {
+			_ = m.applyExternal()
+		}
+	}
+	if err != nil {
+		return 0, errors.Join(ErrRotateKey, err)
+	}
+	return n, nil
+}
@@ -1,5 +1,11 @@
 package xstorage
 
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
 type KeyValueProperty uint32
 
 const (
@@ -17,29 +23,67 @@ const (
 
 type keyValueSaveType uint32
 
+// 可能以数字的形式保存在配置中，新的方式只能加在最后，不能改变已有的值
 const (
 	DBBegin keyValueSaveType = iota
 	SqlLiteDB
 	FileBegin
-	Toml // 为保证效率，必须开启UseCache、FullInitLoad
+	Toml       // 为保证效率，必须开启UseCache、FullInitLoad
+	JsonLineDB // 追加写的json lines日志文件，定期压缩，不依赖cgo
+	BTreeDB    // 单文件的追加写B+树，写入时只追加修改路径上的节点，定期压缩，不依赖cgo
+	GormDB     // 任意gorm支持的数据库，使用Dialector，或者使用Driver与DBAddr（DSN），见GormCore
 )
 
+// isDB 是否使用IDBCore存储
+func (t keyValueSaveType) isDB() bool {
+	switch t {
+	case SqlLiteDB, JsonLineDB, BTreeDB, GormDB:
+		return true
+	}
+	return false
+}
+
+// isFile 是否使用IFileCore存储
+func (t keyValueSaveType) isFile() bool {
+	return t == Toml
+}
+
 type XStorageSetting struct {
 	Property KeyValueProperty
 	SaveType keyValueSaveType
 	DBAddr   string
 	FileAddr string
+	// Dialector SaveType为GormDB时使用的数据库，不为空时忽略Driver与DBAddr
+	Dialector gorm.Dialector
+	// Driver SaveType为GormDB时DBAddr对应的驱动名，见RegisterGormDriver，为空时根据DBAddr的scheme判断
+	Driver string
+	// ExpireSweepInterval 后台清理过期key的间隔，<=0时不启动后台清理，过期的key只会在读取时被过滤，可以手动调用PurgeExpired清理
+	ExpireSweepInterval time.Duration
+	// Cache 缓存的容量与写回策略，零值为不限制容量的写穿缓存
+	Cache CachePolicy
+	// Encrypt 落盘加密，为nil时不加密，见crypt.go
+	Encrypt *EncryptSetting
+	// FileWatchInterval 检查文件是否被其他进程或手动修改的间隔，<=0时只在写入时合并外部修改，可以手动调用ReloadFile。需要开启MultiSafe
+	FileWatchInterval time.Duration
+	// OnFileConflict 写入时发现同一个key在外部也被修改为不同的值，文件中保留本进程的值。在新的goroutine中调用
+	OnFileConflict func(conflicts []FileConflict)
 }
 
 type ValueType int
 
 // 可能会被外部调用，所以复杂命名
+// 新的基础类型需要加在ValueTypeNormalEnd之前，slice类型的值会自动保持不变，已经落盘的数据依然可以读取
 const (
 	ValueTypeNormalBegin ValueType = iota
 	ValueTypeString
 	ValueTypeInt
 	ValueTypeFloat
 	ValueTypeBool
+	ValueTypeInt64
+	ValueTypeFloat64
+	ValueTypeTime      // time.Time
+	ValueTypeMapString // map[string]string
+	ValueTypeMapInt    // map[string]int
 	ValueTypeNormalEnd
 	ValueTypeSliceBegin  = 100
 	ValueTypeSliceString = iota + ValueTypeSliceBegin - ValueTypeNormalEnd - 1
@@ -49,5 +93,40 @@ const (
 )
 
 type IValueType interface {
-	int | string | float32 | bool | []int | []string | []float32 | []bool
+	int | string | float32 | bool | int64 | float64 | time.Time | map[string]string | map[string]int | []int | []string | []float32 | []bool
+}
+
+// ScanOption 范围查询的条件，所有条件取交集，结果按key升序排列
+type ScanOption struct {
+	Prefix string // 只返回以Prefix开头的key，为空时不限制
+	Start  string // 起始key（包含），为空时从头开始，翻页时填入上一页的ScanResult.Next
+	End    string // 结束key（不包含），为空时直到末尾
+	Limit  int    // 单页最大数量，<=0时不限制
+}
+
+type KVPair struct {
+	Key   string
+	Value *ValueUnit
+}
+
+type ScanResult struct {
+	Pairs []KVPair
+	Next  string // 下一页的起始key，为空代表没有更多数据
+}
+
+type BatchOpType int
+
+const (
+	BatchOpNull BatchOpType = iota
+	BatchOpSet
+	BatchOpDelete
+)
+
+type BatchOp struct {
+	Type  BatchOpType
+	Key   string
+	Value *ValueUnit // 仅BatchOpSet时有效
 }
+
+// UpdateFunc 根据当前值计算新值，用于原子的读改写。old为nil代表不存在，返回nil代表不做修改
+type UpdateFunc func(old *ValueUnit) (*ValueUnit, error)
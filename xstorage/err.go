@@ -38,4 +38,59 @@ const (
 	ErrGetSliceValue                           = misc.ErrStr("get slice value error")
 	ErrsqliteModel2Data                        = misc.ErrStr("sqliteModel2Data error")
 	ErrGet                                     = misc.ErrStr("get error")
+	ErrScanValue                               = misc.ErrStr("scan value error")
+	ErrBatchOpType                             = misc.ErrStr("batch op type error")
+	ErrBatchWrite                              = misc.ErrStr("batch write error")
+	ErrDeleteExpired                           = misc.ErrStr("delete expired error")
+	ErrUpdateValue                             = misc.ErrStr("update value error")
+	ErrIncrType                                = misc.ErrStr("incr only support number")
+	ErrAppendType                              = misc.ErrStr("append only support slice")
+	ErrOpenJsonLine                            = misc.ErrStr("open json line file error")
+	ErrWriteJsonLine                           = misc.ErrStr("write json line file error")
+	ErrReadJsonLine                            = misc.ErrStr("read json line file error")
+	ErrJsonLineCoreNotInit                     = misc.ErrStr("json line core not init")
+	ErrJsonLineFileBroken                      = misc.ErrStr("json line file broken")
+	ErrJsonLineCoreBroken                      = misc.ErrStr("json line core broken, create it again")
+	ErrOpenBTree                               = misc.ErrStr("open btree file error")
+	ErrWriteBTree                              = misc.ErrStr("write btree file error")
+	ErrReadBTree                               = misc.ErrStr("read btree file error")
+	ErrBTreeFileBroken                         = misc.ErrStr("btree file broken")
+	ErrBTreeCoreNotInit                        = misc.ErrStr("btree core not init")
+	ErrNewDBCore                               = misc.ErrStr("new db core error")
+	ErrCompact                                 = misc.ErrStr("compact error")
+	ErrExport                                  = misc.ErrStr("export error")
+	ErrImport                                  = misc.ErrStr("import error")
+	ErrSnapshotFormat                          = misc.ErrStr("snapshot format error")
+	ErrSnapshotVersion                         = misc.ErrStr("snapshot version not support")
+	ErrMigrate                                 = misc.ErrStr("migrate error")
+	ErrMigrateVerify                           = misc.ErrStr("migrate verify error")
+	ErrCachePolicy                             = misc.ErrStr("cache policy only support lazy load db with cache")
+	ErrFlushCache                              = misc.ErrStr("flush cache error")
+	ErrCfgRequired                             = misc.ErrStr("cfg param is required")
+	ErrCfgOutOfRange                           = misc.ErrStr("cfg value out of range")
+	ErrCfgPattern                              = misc.ErrStr("cfg value not match pattern")
+	ErrCfgEnum                                 = misc.ErrStr("cfg value not in enum")
+	ErrCfgLength                               = misc.ErrStr("cfg value length out of range")
+	ErrCfgLoad                                 = misc.ErrStr("load cfg error")
+	ErrCfgHistory                              = misc.ErrStr("cfg history error")
+	ErrMigrateSqliteV1                         = misc.ErrStr("migrate sqlite v1 table error")
+	ErrGormCoreNotInit                         = misc.ErrStr("gorm core not init")
+	ErrOpenGorm                                = misc.ErrStr("open gorm db error")
+	ErrGormDriverNotFound                      = misc.ErrStr("gorm driver not found")
+	ErrGormDialectorIsNil                      = misc.ErrStr("gorm dialector is nil")
+	ErrNewGormCore                             = misc.ErrStr("new gorm core error")
+	ErrEncrypt                                 = misc.ErrStr("encrypt error")
+	ErrDecrypt                                 = misc.ErrStr("decrypt error")
+	ErrEncryptNotEnabled                       = misc.ErrStr("encrypt not enabled")
+	ErrKeyProviderIsNil                        = misc.ErrStr("key provider is nil")
+	ErrCryptKeyInvalid                         = misc.ErrStr("crypt key length must be 16, 24 or 32")
+	ErrCryptKeyIdInvalid                       = misc.ErrStr("crypt key id is empty or contains :")
+	ErrCryptKeyNotFound                        = misc.ErrStr("crypt key not found")
+	ErrCryptKeyInUse                           = misc.ErrStr("crypt key is in use")
+	ErrCryptMacNotMatch                        = misc.ErrStr("crypt mac not match")
+	ErrRotateKey                               = misc.ErrStr("rotate key error")
+	ErrReloadFile                              = misc.ErrStr("reload file error")
+	ErrFileWatchNeedMultiSafe                  = misc.ErrStr("file watch need MultiSafe")
+	ErrLogIsNil                                = misc.ErrStr("log is nil")
+	ErrBindLogLevel                            = misc.ErrStr("bind log level error")
 )
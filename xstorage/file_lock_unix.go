@@ -0,0 +1,23 @@
+//go:build !windows
+
+package xstorage
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockFile 对整个文件加排他的建议锁，阻塞直到获得锁
+func lockFile(f *os.File) error {
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
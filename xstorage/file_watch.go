@@ -0,0 +1,96 @@
+package xstorage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/intmian/mian_go_lib/tool/misc"
+)
+
+// saveFile 全量写入文件，并将写入时合并进来的外部修改应用到缓存，调用时需要持有锁
+func (m *XStorage) saveFile() error {
+	err := m.fileCore.SaveAll(m.kvMap)
+	if err != nil {
+		return err
+	}
+	// 文件已经写入成功，外部修改中无法解密的key保持缓存不变，不影响本次写入
+	_ = m.applyExternal()
+	return nil
+}
+
+// ReloadFile 文件被其他进程或手动修改时重新读取并更新缓存，修改的key会通知监听者。
+// FileWatchInterval>0时会在后台定期调用
+func (m *XStorage) ReloadFile() error {
+	if !m.initTag.IsInitialized() {
+		return ErrMgrNotInit
+	}
+	core, ok := m.fileCore.(IWatchableFileCore)
+	if !ok {
+		return nil
+	}
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.Lock()
+		defer m.rwLock.Unlock()
+	}
+	_, err := core.Reload()
+	if err != nil {
+		return errors.Join(ErrReloadFile, err)
+	}
+	err = m.applyExternal()
+	if err != nil {
+		return errors.Join(ErrReloadFile, err)
+	}
+	return nil
+}
+
+// applyExternal 取出文件的外部修改应用到缓存，并将冲突交给OnFileConflict，调用时需要持有锁
+func (m *XStorage) applyExternal() error {
+	core, ok := m.fileCore.(IWatchableFileCore)
+	if !ok {
+		return nil
+	}
+	external, conflicts, err := core.TakeExternal()
+	now := time.Now()
+	for key, value := range external {
+		if value != nil && value.IsExpired(now) {
+			value = nil
+		}
+		needEvent := m.watchHub.has(key)
+		var old *ValueUnit
+		if needEvent {
+			old = m.loadOldValue(key)
+		}
+		if value == nil {
+			if _, ok := m.kvMap[key]; !ok {
+				continue
+			}
+			_ = m.removeFromMap(key)
+		} else {
+			e := m.recordToMap(key, value)
+			if e != nil {
+				err = errors.Join(err, e)
+				continue
+			}
+		}
+		if needEvent {
+			m.watchHub.publish(newWatchEvent(key, old, value))
+		}
+	}
+	if len(conflicts) > 0 && m.setting.OnFileConflict != nil {
+		go m.setting.OnFileConflict(conflicts)
+	}
+	return err
+}
+
+func (m *XStorage) watchFile(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			_ = m.ReloadFile()
+		}
+	}
+}
@@ -0,0 +1,489 @@
+package xstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intmian/mian_go_lib/fork/d1_gorm_adapter/gormd1"
+	"github.com/intmian/mian_go_lib/tool/misc"
+	_ "github.com/mattn/go-sqlite3"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/gorm/logger"
+)
+
+/*
+GormCore 通过gorm.Dialector支持任意gorm支持的数据库，例如sqlite、cloudflare d1、postgres、mysql
+数据存放在key_value_v2表中，一个key一行
+列Key用来存储键
+列ValueInt64用来存储int、int64、bool
+列ValueFloat64用来存储float、float64
+列ValueString用来存储字符串，time、map以json的形式存放
+列ValueBytes用来存储slice，以json的形式存放，可以为空slice
+旧版本的表结构会在NewGormCore时自动迁移，见sqlite_migrate.go
+d1的事务是空实现，所以在d1上BatchWrite与Update不是原子的
+*/
+
+type GormCore struct {
+	db *gorm.DB
+	misc.InitTag
+	rwLock sync.RWMutex
+}
+
+type EmptyLogger struct {
+}
+
+func (e EmptyLogger) LogMode(level logger.LogLevel) logger.Interface {
+	return e
+}
+
+func (e EmptyLogger) Info(ctx context.Context, s string, i ...interface{}) {}
+
+func (e EmptyLogger) Warn(ctx context.Context, s string, i ...interface{}) {}
+
+func (e EmptyLogger) Error(ctx context.Context, s string, i ...interface{}) {}
+
+func (e EmptyLogger) Trace(ctx context.Context, begin time.Time, fc func() (sql string, rowsAffected int64), err error) {
+}
+
+// GormOpener 根据DSN创建gorm.Dialector，例如sqlite.Open、gormd1.Open、postgres.Open、mysql.Open
+type GormOpener func(dsn string) gorm.Dialector
+
+var (
+	gormDriversLock sync.RWMutex
+	gormDrivers     = map[string]GormOpener{
+		"sqlite": sqlite.Open,
+		"d1":     gormd1.Open,
+	}
+)
+
+// RegisterGormDriver 注册一个驱动，之后可以在XStorageSetting.Driver中使用。内置sqlite与d1，
+// 其他数据库为了不引入额外的依赖需要使用者注册，例如 RegisterGormDriver("postgres", postgres.Open)
+func RegisterGormDriver(name string, opener GormOpener) {
+	gormDriversLock.Lock()
+	defer gormDriversLock.Unlock()
+	gormDrivers[name] = opener
+}
+
+// OpenGormDialector 使用注册的驱动打开dsn，driver为空时使用dsn的scheme，例如 d1://...，没有scheme时为sqlite
+func OpenGormDialector(driver string, dsn string) (gorm.Dialector, error) {
+	if driver == "" {
+		driver = "sqlite"
+		if i := strings.Index(dsn, "://"); i > 0 {
+			driver = dsn[:i]
+		}
+	}
+	gormDriversLock.RLock()
+	opener, ok := gormDrivers[driver]
+	gormDriversLock.RUnlock()
+	if !ok {
+		return nil, errors.Join(ErrGormDriverNotFound, errors.New(driver))
+	}
+	return opener(dsn), nil
+}
+
+func NewGormCore(dialector gorm.Dialector) (*GormCore, error) {
+	if dialector == nil {
+		return nil, ErrGormDialectorIsNil
+	}
+	// 依靠外层进行日志交互，为了避免本地打印日志过多，这里不使用日志库
+	db, err := gorm.Open(dialector, &gorm.Config{
+		Logger: EmptyLogger{},
+	})
+	if err != nil {
+		return nil, errors.Join(ErrOpenGorm, err)
+	}
+	err = db.AutoMigrate(&KeyValueModelV2{})
+	if err != nil {
+		return nil, errors.Join(ErrAutoMigrate, err)
+	}
+	err = migrateSqliteV1(db)
+	if err != nil {
+		return nil, errors.Join(ErrMigrateSqliteV1, err)
+	}
+	gormCore := &GormCore{
+		db: db,
+	}
+	gormCore.SetInitialized()
+	return gormCore, nil
+}
+
+// Close 关闭数据库连接
+func (m *GormCore) Close() error {
+	if !m.IsInitialized() {
+		return ErrGormCoreNotInit
+	}
+	sqlDB, err := m.db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.Close()
+}
+
+// key在mysql中是保留字，所以不能直接写在sql中，需要由gorm加上引号
+var keyColumn = clause.Column{Name: "key"}
+
+func (m *GormCore) Get(key string, rec *ValueUnit) (bool, error) {
+	if rec == nil {
+		return false, ErrRecIsNil
+	}
+	return m.getInner(m.db, key, rec, true)
+}
+
+func (m *GormCore) getInner(db *gorm.DB, key string, rec *ValueUnit, needLock bool) (exist bool, retErr error) {
+	if !m.IsInitialized() {
+		return false, ErrGormCoreNotInit
+	}
+	if needLock {
+		m.rwLock.RLock()
+		defer m.rwLock.RUnlock()
+	}
+
+	var keyValueModel KeyValueModelV2
+	result := db.Where(clause.Eq{Column: keyColumn, Value: key}).Limit(1).Find(&keyValueModel)
+	if result.Error != nil {
+		return false, errors.Join(ErrGet, result.Error)
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	err := gormModel2Data(keyValueModel, rec)
+	if err != nil {
+		return false, errors.Join(ErrsqliteModel2Data, err)
+	}
+	return true, nil
+}
+
+// gormModel2Data 将从数据库取出来的model转化为ValueUnit
+func gormModel2Data(keyValueModel KeyValueModelV2, rec *ValueUnit) error {
+	valueType := ValueType(keyValueModel.ValueType)
+	// 判断合法性
+	switch valueType {
+	case ValueTypeInt, ValueTypeBool, ValueTypeInt64:
+		if keyValueModel.ValueInt64 == nil {
+			return ErrValueIsNil
+		}
+	case ValueTypeFloat, ValueTypeFloat64:
+		if keyValueModel.ValueFloat64 == nil {
+			return ErrValueIsNil
+		}
+	case ValueTypeString, ValueTypeTime, ValueTypeMapString, ValueTypeMapInt:
+		if keyValueModel.ValueString == nil {
+			return ErrValueIsNil
+		}
+	case ValueTypeSliceInt, ValueTypeSliceString, ValueTypeSliceFloat, ValueTypeSliceBool:
+		if keyValueModel.ValueBytes == nil {
+			return ErrValueIsNil
+		}
+	default:
+		return ErrValueType
+	}
+
+	// 读取值
+	value := &ValueUnit{Type: valueType}
+	switch valueType {
+	case ValueTypeInt:
+		value.Data = int(*keyValueModel.ValueInt64)
+	case ValueTypeBool:
+		value.Data = *keyValueModel.ValueInt64 != 0
+	case ValueTypeInt64:
+		value.Data = *keyValueModel.ValueInt64
+	case ValueTypeFloat:
+		value.Data = float32(*keyValueModel.ValueFloat64)
+	case ValueTypeFloat64:
+		value.Data = *keyValueModel.ValueFloat64
+	case ValueTypeString:
+		value.Data = *keyValueModel.ValueString
+	case ValueTypeTime, ValueTypeMapString, ValueTypeMapInt:
+		value = StringToUnit(*keyValueModel.ValueString, valueType)
+	default:
+		value = StringToUnit(string(keyValueModel.ValueBytes), valueType)
+	}
+	if value == nil {
+		return ErrJsonUnmarshalErr
+	}
+	value.ExpireAt = keyValueModel.ExpireAt
+	*rec = *value
+	return nil
+}
+
+// gormData2Model 将数据转换为model
+func gormData2Model(key string, value *ValueUnit) (*KeyValueModelV2, error) {
+	keyValueModel := &KeyValueModelV2{
+		Key:       key,
+		ValueType: int(value.Type),
+		ExpireAt:  value.ExpireAt,
+	}
+	switch value.Type {
+	case ValueTypeInt:
+		v := int64(ToBase[int](value))
+		keyValueModel.ValueInt64 = &v
+	case ValueTypeBool:
+		v := int64(0)
+		if ToBase[bool](value) {
+			v = 1
+		}
+		keyValueModel.ValueInt64 = &v
+	case ValueTypeInt64:
+		v := ToBase[int64](value)
+		keyValueModel.ValueInt64 = &v
+	case ValueTypeFloat:
+		v := float64(ToBase[float32](value))
+		keyValueModel.ValueFloat64 = &v
+	case ValueTypeFloat64:
+		v := ToBase[float64](value)
+		keyValueModel.ValueFloat64 = &v
+	case ValueTypeString:
+		v := ToBase[string](value)
+		keyValueModel.ValueString = &v
+	case ValueTypeTime, ValueTypeMapString, ValueTypeMapInt:
+		b, err := json.Marshal(value.Data)
+		if err != nil {
+			return nil, errors.Join(ErrJsonMarshalErr, err)
+		}
+		v := string(b)
+		keyValueModel.ValueString = &v
+	case ValueTypeSliceInt, ValueTypeSliceString, ValueTypeSliceFloat, ValueTypeSliceBool:
+		b, err := json.Marshal(value.Data)
+		if err != nil {
+			return nil, errors.Join(ErrJsonMarshalErr, err)
+		}
+		// nil的slice也存为空slice
+		if string(b) == "null" {
+			b = []byte("[]")
+		}
+		keyValueModel.ValueBytes = b
+	default:
+		return nil, ErrValueType
+	}
+	return keyValueModel, nil
+}
+
+func (m *GormCore) Set(key string, value *ValueUnit) error {
+	if !m.IsInitialized() {
+		return ErrGormCoreNotInit
+	}
+	m.rwLock.Lock()
+	defer m.rwLock.Unlock()
+	return m.setInner(m.db, key, value)
+}
+
+func (m *GormCore) setInner(db *gorm.DB, key string, value *ValueUnit) error {
+	if value == nil {
+		return ErrValueIsNil
+	}
+	keyValueModel, err := gormData2Model(key, value)
+	if err != nil {
+		return errors.Join(ErrSqliteData2Model, err)
+	}
+	// 已经存在的key不能修改类型
+	var types []int
+	result := db.Model(&KeyValueModelV2{}).Where(clause.Eq{Column: keyColumn, Value: key}).Limit(1).Pluck("value_type", &types)
+	if result.Error != nil {
+		return errors.Join(ErrGet, result.Error)
+	}
+	if len(types) > 0 && ValueType(types[0]) != value.Type {
+		return ErrValueTypeNotMatch
+	}
+	result = db.Clauses(clause.OnConflict{UpdateAll: true}).Create(keyValueModel)
+	if result.Error != nil {
+		return errors.Join(ErrSetValue, result.Error)
+	}
+	return nil
+}
+
+func (m *GormCore) Delete(key string) error {
+	if !m.IsInitialized() {
+		return ErrGormCoreNotInit
+	}
+	m.rwLock.Lock()
+	defer m.rwLock.Unlock()
+	return m.deleteInner(m.db, key)
+}
+
+func (m *GormCore) deleteInner(db *gorm.DB, key string) error {
+	result := db.Where(clause.Eq{Column: keyColumn, Value: key}).Delete(&KeyValueModelV2{})
+	return result.Error
+}
+
+// BatchWrite 在一个事务中执行所有操作，任意一个失败时整体回滚
+func (m *GormCore) BatchWrite(ops []BatchOp) error {
+	if !m.IsInitialized() {
+		return ErrGormCoreNotInit
+	}
+	m.rwLock.Lock()
+	defer m.rwLock.Unlock()
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		for _, op := range ops {
+			var err error
+			switch op.Type {
+			case BatchOpSet:
+				err = m.setInner(tx, op.Key, op.Value)
+			case BatchOpDelete:
+				err = m.deleteInner(tx, op.Key)
+			default:
+				err = ErrBatchOpType
+			}
+			if err != nil {
+				return errors.Join(fmt.Errorf("batch op %s failed", op.Key), err)
+			}
+		}
+		return nil
+	})
+}
+
+func (m *GormCore) Have(key string) (bool, error) {
+	if !m.IsInitialized() {
+		return false, ErrGormCoreNotInit
+	}
+	m.rwLock.RLock()
+	defer m.rwLock.RUnlock()
+	var count int64
+	result := m.db.Model(&KeyValueModelV2{}).Where(clause.Eq{Column: keyColumn, Value: key}).Count(&count)
+	if result.Error != nil {
+		return false, errors.Join(ErrGet, result.Error)
+	}
+	return count > 0, nil
+}
+
+func (m *GormCore) GetAll() (map[string]*ValueUnit, error) {
+	if !m.IsInitialized() {
+		return nil, ErrGormCoreNotInit
+	}
+	m.rwLock.RLock()
+	defer m.rwLock.RUnlock()
+	var keyValueModelList []KeyValueModelV2
+	result := m.db.Find(&keyValueModelList)
+	if result.Error != nil {
+		return nil, errors.Join(ErrGetAllValue, result.Error)
+	}
+	keyValueModelMap := make(map[string]*ValueUnit, len(keyValueModelList))
+	for _, keyValueModel := range keyValueModelList {
+		unit := &ValueUnit{}
+		err := gormModel2Data(keyValueModel, unit)
+		if err != nil {
+			return nil, errors.Join(ErrsqliteModel2Data, err)
+		}
+		keyValueModelMap[keyValueModel.Key] = unit
+	}
+	return keyValueModelMap, nil
+}
+
+// Scan 将前缀与范围查询转化为主键上的范围查询，由数据库完成排序与分页
+func (m *GormCore) Scan(option ScanOption) (*ScanResult, error) {
+	if !m.IsInitialized() {
+		return nil, ErrGormCoreNotInit
+	}
+	m.rwLock.RLock()
+	defer m.rwLock.RUnlock()
+	lower, upper := scanRange(option)
+	query := m.db.Where(clause.Gte{Column: keyColumn, Value: lower})
+	query = query.Where("expire_at = 0 OR expire_at > ?", time.Now().UnixMilli())
+	if upper != "" {
+		query = query.Where(clause.Lt{Column: keyColumn, Value: upper})
+	}
+	query = query.Order(clause.OrderByColumn{Column: keyColumn})
+	if option.Limit > 0 {
+		// 多取一个用于判断是否还有下一页
+		query = query.Limit(option.Limit + 1)
+	}
+	var keyValueModelList []KeyValueModelV2
+	result := query.Find(&keyValueModelList)
+	if result.Error != nil {
+		return nil, errors.Join(ErrScanValue, result.Error)
+	}
+	ret := &ScanResult{}
+	if option.Limit > 0 && len(keyValueModelList) > option.Limit {
+		ret.Next = keyValueModelList[option.Limit].Key
+		keyValueModelList = keyValueModelList[:option.Limit]
+	}
+	ret.Pairs = make([]KVPair, 0, len(keyValueModelList))
+	for _, keyValueModel := range keyValueModelList {
+		unit := &ValueUnit{}
+		err := gormModel2Data(keyValueModel, unit)
+		if err != nil {
+			return nil, errors.Join(ErrsqliteModel2Data, err)
+		}
+		ret.Pairs = append(ret.Pairs, KVPair{Key: keyValueModel.Key, Value: unit})
+	}
+	return ret, nil
+}
+
+// DeleteExpired 删除所有在now（毫秒时间戳）前过期的key，返回被删除的key
+func (m *GormCore) DeleteExpired(now int64) ([]string, error) {
+	if !m.IsInitialized() {
+		return nil, ErrGormCoreNotInit
+	}
+	m.rwLock.Lock()
+	defer m.rwLock.Unlock()
+	var keys []string
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&KeyValueModelV2{}).Where("expire_at > 0 AND expire_at <= ?", now).Pluck("key", &keys)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(keys) == 0 {
+			return nil
+		}
+		values := make([]interface{}, len(keys))
+		for i, key := range keys {
+			values[i] = key
+		}
+		return tx.Where(clause.IN{Column: keyColumn, Values: values}).Delete(&KeyValueModelV2{}).Error
+	})
+	if err != nil {
+		return nil, errors.Join(ErrDeleteExpired, err)
+	}
+	return keys, nil
+}
+
+// Update 在同一个事务中完成读取与写入，已过期的值视为不存在
+func (m *GormCore) Update(key string, fn UpdateFunc) (*ValueUnit, error) {
+	if !m.IsInitialized() {
+		return nil, ErrGormCoreNotInit
+	}
+	m.rwLock.Lock()
+	defer m.rwLock.Unlock()
+	var ret *ValueUnit
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		old := &ValueUnit{}
+		exist, err := m.getInner(tx, key, old, false)
+		if err != nil {
+			return err
+		}
+		if exist && old.IsExpired(time.Now()) {
+			err = m.deleteInner(tx, key)
+			if err != nil {
+				return err
+			}
+			exist = false
+		}
+		if !exist {
+			old = nil
+		}
+		newValue, err := fn(old)
+		if err != nil {
+			return err
+		}
+		if newValue == nil {
+			ret = old
+			return nil
+		}
+		err = m.setInner(tx, key, newValue)
+		if err != nil {
+			return err
+		}
+		ret = newValue
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Join(ErrUpdateValue, err)
+	}
+	return ret, nil
+}
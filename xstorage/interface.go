@@ -5,9 +5,27 @@ type IDBCore interface {
 	Set(key string, value *ValueUnit) error
 	GetAll() (map[string]*ValueUnit, error)
 	Delete(key string) error
+	// Scan 按key升序进行前缀、范围查询，需要由底层保证有序及分页，不应全量取出后再过滤
+	Scan(option ScanOption) (*ScanResult, error)
+	// BatchWrite 原子的执行一批操作，失败时需要保证没有任何操作生效
+	BatchWrite(ops []BatchOp) error
+	// DeleteExpired 删除所有在now（毫秒时间戳）前过期的key，返回被删除的key
+	DeleteExpired(now int64) ([]string, error)
+	// Update 在同一个事务中读取key并写入fn计算出的新值，返回写入后的值，没有修改时返回当前值
+	Update(key string, fn UpdateFunc) (*ValueUnit, error)
 }
 
+// IFileCore 文件存储每次都全量落盘，SaveAll本身即是一次原子提交，批量操作只需要在最后调用一次SaveAll
 type IFileCore interface {
 	GetAll() (map[string]*ValueUnit, error)
 	SaveAll(data map[string]*ValueUnit) error
 }
+
+// IWatchableFileCore 能够发现文件被其他进程或手动修改的IFileCore
+type IWatchableFileCore interface {
+	IFileCore
+	// Reload 文件被外部修改时重新读取，返回是否有key发生了变化
+	Reload() (bool, error)
+	// TakeExternal 取出并清空Reload与SaveAll发现的外部修改以及SaveAll合并时的冲突，修改中的nil代表key被删除
+	TakeExternal() (map[string]*ValueUnit, []FileConflict, error)
+}
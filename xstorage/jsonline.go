@@ -0,0 +1,484 @@
+package xstorage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/intmian/mian_go_lib/tool/misc"
+)
+
+/*
+JsonLineCore 追加写的日志文件存储
+每一行是一次原子提交，包含一个或多个操作，例如
+{"ops":[{"k":"a","v":{"t":2,"d":1}},{"k":"b","del":true}]}
+内存中只保留key到所在行的索引，值在读取时从文件中解析。
+进程崩溃时最后一行可能只写了一半，加载时会被截断丢弃，所以一次提交要么全部生效要么全部不生效。
+被覆盖或删除的记录超过一定数量并且多于有效记录时，会重写文件进行压缩。
+*/
+
+const (
+	jsonLineCompactMinGarbage = 1024
+)
+
+type jsonLineOp struct {
+	Key    string      `json:"k"`
+	Value  *unitRecord `json:"v,omitempty"`
+	Delete bool        `json:"del,omitempty"`
+}
+
+type jsonLineRecord struct {
+	Ops []jsonLineOp `json:"ops"`
+}
+
+type jsonLineIndex struct {
+	offset   int64
+	length   int64
+	expireAt int64
+}
+
+type JsonLineCore struct {
+	addr    string
+	file    *os.File
+	size    int64
+	index   map[string]jsonLineIndex
+	garbage int // 已经失效的记录数，用于判断是否需要压缩
+	// compactErr 最近一次自动压缩的错误，记录已经写入，所以不影响写入的结果，下次写入时会重试
+	compactErr error
+	// brokenErr 压缩后重新打开文件失败时的错误，此后的读写都返回这个错误，需要重新创建
+	brokenErr error
+	misc.InitTag
+	rwLock sync.RWMutex
+}
+
+func NewJsonLineCore(addr string) (*JsonLineCore, error) {
+	c := &JsonLineCore{
+		addr: addr,
+	}
+	err := c.load()
+	if err != nil {
+		return nil, err
+	}
+	c.SetInitialized()
+	return c, nil
+}
+
+// load 打开文件并重建索引，末尾没有换行的行是写了一半的提交，会被截断。
+// 其他无法解析的行说明文件损坏，返回错误而不是截断，避免丢失之后的记录
+func (c *JsonLineCore) load() error {
+	file, err := os.OpenFile(c.addr, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return errors.Join(ErrOpenJsonLine, err)
+	}
+	c.file = file
+	c.index = make(map[string]jsonLineIndex)
+	c.garbage = 0
+	reader := bufio.NewReader(file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			_ = file.Close()
+			return errors.Join(ErrOpenJsonLine, err)
+		}
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			break
+		}
+		var record jsonLineRecord
+		err = json.Unmarshal(line, &record)
+		if err == nil {
+			err = record.check()
+		}
+		if err != nil {
+			_ = file.Close()
+			return errors.Join(ErrOpenJsonLine, ErrJsonLineFileBroken, fmt.Errorf("line at offset %d", offset), err)
+		}
+		c.applyIndex(record, offset, int64(len(line)))
+		offset += int64(len(line))
+	}
+	c.size = offset
+	err = file.Truncate(offset)
+	if err != nil {
+		_ = file.Close()
+		return errors.Join(ErrOpenJsonLine, err)
+	}
+	return nil
+}
+
+// check 不是删除的操作需要有值
+func (r jsonLineRecord) check() error {
+	for _, op := range r.Ops {
+		if !op.Delete && op.Value == nil {
+			return fmt.Errorf("key %s has neither value nor delete", op.Key)
+		}
+	}
+	return nil
+}
+
+func (c *JsonLineCore) applyIndex(record jsonLineRecord, offset int64, length int64) {
+	for _, op := range record.Ops {
+		_, exist := c.index[op.Key]
+		if exist {
+			c.garbage++
+		}
+		if op.Delete {
+			if exist {
+				delete(c.index, op.Key)
+			}
+			// 删除记录本身也是无效记录
+			c.garbage++
+			continue
+		}
+		c.index[op.Key] = jsonLineIndex{
+			offset:   offset,
+			length:   length,
+			expireAt: op.Value.ExpireAt,
+		}
+	}
+}
+
+// appendRecord 将一次提交写入文件末尾并更新索引
+func (c *JsonLineCore) appendRecord(record jsonLineRecord) error {
+	if len(record.Ops) == 0 {
+		return nil
+	}
+	b, err := json.Marshal(record)
+	if err != nil {
+		return errors.Join(ErrJsonMarshalErr, err)
+	}
+	b = append(b, '\n')
+	_, err = c.file.WriteAt(b, c.size)
+	if err != nil {
+		// 写了一半的内容会在下次加载时被截断，这里也直接截断掉
+		_ = c.file.Truncate(c.size)
+		return errors.Join(ErrWriteJsonLine, err)
+	}
+	c.applyIndex(record, c.size, int64(len(b)))
+	c.size += int64(len(b))
+	if c.garbage > jsonLineCompactMinGarbage && c.garbage > len(c.index) {
+		c.compactErr = c.compact()
+	}
+	return nil
+}
+
+// CompactErr 返回最近一次自动压缩的错误，压缩成功后为nil
+func (c *JsonLineCore) CompactErr() error {
+	c.rwLock.RLock()
+	defer c.rwLock.RUnlock()
+	return c.compactErr
+}
+
+// readValue 读取索引指向的行，并取出其中key对应的值
+func (c *JsonLineCore) readValue(key string, idx jsonLineIndex, rec *ValueUnit) error {
+	b := make([]byte, idx.length)
+	_, err := c.file.ReadAt(b, idx.offset)
+	if err != nil {
+		return errors.Join(ErrReadJsonLine, err)
+	}
+	var record jsonLineRecord
+	err = json.Unmarshal(b, &record)
+	if err != nil {
+		return errors.Join(ErrReadJsonLine, err)
+	}
+	// 同一行中同一个key以最后一次为准
+	for i := len(record.Ops) - 1; i >= 0; i-- {
+		op := record.Ops[i]
+		if op.Key == key && !op.Delete {
+			return op.Value.toUnit(rec)
+		}
+	}
+	return ErrReadJsonLine
+}
+
+func (c *JsonLineCore) Get(key string, rec *ValueUnit) (bool, error) {
+	if !c.IsInitialized() {
+		return false, ErrJsonLineCoreNotInit
+	}
+	if rec == nil {
+		return false, ErrRecIsNil
+	}
+	c.rwLock.RLock()
+	defer c.rwLock.RUnlock()
+	if c.brokenErr != nil {
+		return false, c.brokenErr
+	}
+	idx, ok := c.index[key]
+	if !ok {
+		return false, nil
+	}
+	err := c.readValue(key, idx, rec)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *JsonLineCore) Set(key string, value *ValueUnit) error {
+	return c.BatchWrite([]BatchOp{{Type: BatchOpSet, Key: key, Value: value}})
+}
+
+func (c *JsonLineCore) Delete(key string) error {
+	return c.BatchWrite([]BatchOp{{Type: BatchOpDelete, Key: key}})
+}
+
+// BatchWrite 一批操作写在同一行中，保证原子性
+func (c *JsonLineCore) BatchWrite(ops []BatchOp) error {
+	if !c.IsInitialized() {
+		return ErrJsonLineCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	if c.brokenErr != nil {
+		return c.brokenErr
+	}
+	record, err := c.toRecord(ops)
+	if err != nil {
+		return err
+	}
+	return c.appendRecord(record)
+}
+
+func (c *JsonLineCore) toRecord(ops []BatchOp) (jsonLineRecord, error) {
+	record := jsonLineRecord{}
+	for _, op := range ops {
+		if op.Key == "" {
+			return record, ErrKeyIsEmpty
+		}
+		switch op.Type {
+		case BatchOpSet:
+			r, err := newUnitRecord(op.Value)
+			if err != nil {
+				return record, err
+			}
+			record.Ops = append(record.Ops, jsonLineOp{Key: op.Key, Value: r})
+		case BatchOpDelete:
+			// 不存在的key不需要记录删除
+			_, exist := c.index[op.Key]
+			staged := false
+			for _, o := range record.Ops {
+				if o.Key == op.Key {
+					staged = true
+				}
+			}
+			if exist || staged {
+				record.Ops = append(record.Ops, jsonLineOp{Key: op.Key, Delete: true})
+			}
+		default:
+			return record, ErrBatchOpType
+		}
+	}
+	return record, nil
+}
+
+func (c *JsonLineCore) GetAll() (map[string]*ValueUnit, error) {
+	if !c.IsInitialized() {
+		return nil, ErrJsonLineCoreNotInit
+	}
+	c.rwLock.RLock()
+	defer c.rwLock.RUnlock()
+	if c.brokenErr != nil {
+		return nil, c.brokenErr
+	}
+	ret := make(map[string]*ValueUnit, len(c.index))
+	for key, idx := range c.index {
+		unit := &ValueUnit{}
+		err := c.readValue(key, idx, unit)
+		if err != nil {
+			return nil, errors.Join(ErrGetAllValue, err)
+		}
+		ret[key] = unit
+	}
+	return ret, nil
+}
+
+// Scan 在索引上排序后分页，只读取当页的值
+func (c *JsonLineCore) Scan(option ScanOption) (*ScanResult, error) {
+	if !c.IsInitialized() {
+		return nil, ErrJsonLineCoreNotInit
+	}
+	c.rwLock.RLock()
+	defer c.rwLock.RUnlock()
+	if c.brokenErr != nil {
+		return nil, c.brokenErr
+	}
+	lower, upper := scanRange(option)
+	now := time.Now().UnixMilli()
+	var keys []string
+	for key, idx := range c.index {
+		if key < lower || (upper != "" && key >= upper) {
+			continue
+		}
+		if idx.expireAt != 0 && idx.expireAt <= now {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	ret := &ScanResult{}
+	if option.Limit > 0 && len(keys) > option.Limit {
+		ret.Next = keys[option.Limit]
+		keys = keys[:option.Limit]
+	}
+	ret.Pairs = make([]KVPair, 0, len(keys))
+	for _, key := range keys {
+		unit := &ValueUnit{}
+		err := c.readValue(key, c.index[key], unit)
+		if err != nil {
+			return nil, errors.Join(ErrScanValue, err)
+		}
+		ret.Pairs = append(ret.Pairs, KVPair{Key: key, Value: unit})
+	}
+	return ret, nil
+}
+
+func (c *JsonLineCore) DeleteExpired(now int64) ([]string, error) {
+	if !c.IsInitialized() {
+		return nil, ErrJsonLineCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	if c.brokenErr != nil {
+		return nil, c.brokenErr
+	}
+	var keys []string
+	record := jsonLineRecord{}
+	for key, idx := range c.index {
+		if idx.expireAt != 0 && idx.expireAt <= now {
+			keys = append(keys, key)
+			record.Ops = append(record.Ops, jsonLineOp{Key: key, Delete: true})
+		}
+	}
+	err := c.appendRecord(record)
+	if err != nil {
+		return nil, errors.Join(ErrDeleteExpired, err)
+	}
+	return keys, nil
+}
+
+func (c *JsonLineCore) Update(key string, fn UpdateFunc) (*ValueUnit, error) {
+	if !c.IsInitialized() {
+		return nil, ErrJsonLineCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	if c.brokenErr != nil {
+		return nil, c.brokenErr
+	}
+	var old *ValueUnit
+	if idx, ok := c.index[key]; ok && (idx.expireAt == 0 || idx.expireAt > time.Now().UnixMilli()) {
+		old = &ValueUnit{}
+		err := c.readValue(key, idx, old)
+		if err != nil {
+			return nil, errors.Join(ErrUpdateValue, err)
+		}
+	}
+	newValue, err := fn(old)
+	if err != nil {
+		return nil, errors.Join(ErrUpdateValue, err)
+	}
+	if newValue == nil {
+		return old, nil
+	}
+	record, err := c.toRecord([]BatchOp{{Type: BatchOpSet, Key: key, Value: newValue}})
+	if err != nil {
+		return nil, errors.Join(ErrUpdateValue, err)
+	}
+	err = c.appendRecord(record)
+	if err != nil {
+		return nil, errors.Join(ErrUpdateValue, err)
+	}
+	return newValue, nil
+}
+
+// Compact 立即重写文件，只保留有效的记录
+func (c *JsonLineCore) Compact() error {
+	if !c.IsInitialized() {
+		return ErrJsonLineCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	if c.brokenErr != nil {
+		return c.brokenErr
+	}
+	c.compactErr = c.compact()
+	return c.compactErr
+}
+
+// compact 先写入临时文件，再通过rename替换，任何一步失败原文件都不受影响
+func (c *JsonLineCore) compact() error {
+	keys := make([]string, 0, len(c.index))
+	for key := range c.index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	for _, key := range keys {
+		unit := &ValueUnit{}
+		err := c.readValue(key, c.index[key], unit)
+		if err != nil {
+			return errors.Join(ErrCompact, err)
+		}
+		r, err := newUnitRecord(unit)
+		if err != nil {
+			return errors.Join(ErrCompact, err)
+		}
+		b, err := json.Marshal(jsonLineRecord{Ops: []jsonLineOp{{Key: key, Value: r}}})
+		if err != nil {
+			return errors.Join(ErrCompact, err)
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	tmpAddr := c.addr + ".compact"
+	err := writeFileSync(tmpAddr, buf.Bytes())
+	if err != nil {
+		return errors.Join(ErrCompact, err)
+	}
+	_ = c.file.Close()
+	err = os.Rename(tmpAddr, c.addr)
+	if err != nil {
+		_ = os.Remove(tmpAddr)
+		err = errors.Join(ErrCompact, err)
+	}
+	// 无论rename是否成功都需要重新打开文件，打开失败时文件已经关闭，索引也不再可信，只能标记为不可用
+	loadErr := c.load()
+	if loadErr != nil {
+		c.brokenErr = errors.Join(ErrJsonLineCoreBroken, loadErr)
+		return errors.Join(err, c.brokenErr)
+	}
+	return err
+}
+
+func (c *JsonLineCore) Close() error {
+	if !c.IsInitialized() {
+		return ErrJsonLineCoreNotInit
+	}
+	c.rwLock.Lock()
+	defer c.rwLock.Unlock()
+	if c.brokenErr != nil {
+		// 文件已经关闭
+		return nil
+	}
+	err := c.file.Sync()
+	return errors.Join(err, c.file.Close())
+}
+
+// writeFileSync 写入文件并刷盘
+func writeFileSync(addr string, data []byte) error {
+	f, err := os.OpenFile(addr, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	return errors.Join(err, f.Close())
+}
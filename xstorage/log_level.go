@@ -0,0 +1,71 @@
+package xstorage
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/intmian/mian_go_lib/xlog"
+)
+
+// BindLogLevel 使用prefix.来源 的key设置log中各来源的级别上限，值为级别名的字符串，例如 log.level.NEWS = "DEBUG"。
+// 绑定时读取已有的key，之后的修改立即生效，删除key时恢复默认。CfgExt的参数同样可以使用，prefix为参数的key。
+// 放在xstorage中而不是xlog中，因为xstorage依赖xlog。返回的函数用于取消绑定
+func (m *XStorage) BindLogLevel(log *xlog.XLog, prefix string) (func(), error) {
+	if !m.initTag.IsInitialized() {
+		return nil, ErrMgrNotInit
+	}
+	if log == nil {
+		return nil, ErrLogIsNil
+	}
+	prefix = Join(prefix, "")
+	// 监听与读取可能同时应用同一个key，每次应用时在锁内重新读取当前的值，后应用的总是较新的值
+	var lock sync.Mutex
+	apply := func(key string) {
+		from := strings.TrimPrefix(key, prefix)
+		if from == "" || strings.Contains(from, ".") {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		value, err := m.Get(key)
+		if err != nil {
+			log.Warning("LOG", "read log level %s: %v", key, err)
+			return
+		}
+		if value == nil {
+			log.ResetLevel(from)
+			return
+		}
+		s, err := ToBaseE[string](value)
+		var level xlog.LogLevel
+		if err == nil {
+			level, err = xlog.ParseLevel(s)
+		}
+		if err != nil {
+			log.Warning("LOG", "invalid log level %s: %v", key, err)
+			return
+		}
+		log.SetLevel(from, level)
+	}
+	// 先监听再读取，避免遗漏读取期间的修改
+	cancel := m.WatchFunc(prefix, func(event WatchEvent) {
+		apply(event.Key)
+	})
+	option := ScanOption{Prefix: prefix}
+	for {
+		result, err := m.Scan(option)
+		if err != nil {
+			cancel()
+			return nil, errors.Join(ErrBindLogLevel, err)
+		}
+		for _, pair := range result.Pairs {
+			apply(pair.Key)
+		}
+		if result.Next == "" {
+			break
+		}
+		option.Start = result.Next
+	}
+	return cancel, nil
+}
@@ -1,10 +1,14 @@
 package xstorage
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/intmian/mian_go_lib/tool/misc"
+	"io"
+	"sort"
 	"sync"
+	"time"
 )
 
 type XStorage struct {
@@ -16,15 +20,32 @@ type XStorage struct {
 	//map尽量不要包非pool指针，不然可能在频繁调用的情况下出现大量的内存垃圾，影响内存，gc也无法快速回收，如果低峰期依然有访问可能会出现同访问量、数据量的情况下，每天内存占用越来越高，直到内存耗尽才频繁gc，性能会有问题，特别是在单机多进程的情况下。
 	kvMap map[string]*ValueUnit // 后面不放指针，避免影响gc，此为唯一数据，取出时取指针
 	pool  sync.Pool
+	// 缓存中key的有序索引，用于范围查询。只在key增删后的下一次查询时重建，避免每次查询都复制整个map
+	sortedKeys      []string
+	sortedKeysDirty bool
+	sortedKeysLock  sync.Mutex
+	// 用于停止后台任务
+	ctx    context.Context
+	cancel context.CancelFunc
+	// 修改的监听者
+	watchHub watchHub
+	// 缓存的淘汰、写回与统计
+	cache *cacheTracker
+	// 缓存每次修改时递增，用于判断从磁盘读取期间缓存是否被修改过
+	cacheGen uint64
+	// 落盘加密，没有开启时为nil
+	crypt *cryptLayer
+	// Get、Set、Delete的观察者
+	observers observerHub
 }
 
 func (m *XStorage) Init(setting XStorageSetting) error {
 	m.setting = setting
 	// 检查路径
-	if setting.SaveType > DBBegin && setting.SaveType < FileBegin && setting.DBAddr == "" {
+	if setting.SaveType.isDB() && setting.DBAddr == "" && !(setting.SaveType == GormDB && setting.Dialector != nil) {
 		return ErrSqliteDBFileAddrEmpty
 	}
-	if setting.SaveType > FileBegin && setting.FileAddr == "" {
+	if setting.SaveType.isFile() && setting.FileAddr == "" {
 		return ErrSqliteDBFileAddrEmpty
 	}
 
@@ -37,6 +58,12 @@ func (m *XStorage) Init(setting XStorageSetting) error {
 	if setting.SaveType == Toml && !misc.HasProperty(setting.Property, UseCache, FullInitLoad) {
 		return ErrUseJsonButNotUseCacheAndNotFullInitLoad
 	}
+	if setting.FileWatchInterval > 0 && setting.SaveType.isFile() && !misc.HasProperty(setting.Property, MultiSafe) {
+		return ErrFileWatchNeedMultiSafe
+	}
+	if setting.Cache.isSet() && (!misc.HasProperty(setting.Property, UseCache, UseDisk) || misc.HasProperty(setting.Property, FullInitLoad) || setting.SaveType.isFile()) {
+		return ErrCachePolicy
+	}
 	switch setting.SaveType {
 	case SqlLiteDB:
 		dbCore, err := NewSqliteCore(setting.DBAddr)
@@ -44,15 +71,55 @@ func (m *XStorage) Init(setting XStorageSetting) error {
 			return errors.Join(ErrNewSqliteCore, err)
 		}
 		m.dbCore = dbCore
+	case JsonLineDB:
+		dbCore, err := NewJsonLineCore(setting.DBAddr)
+		if err != nil {
+			return errors.Join(ErrNewDBCore, err)
+		}
+		m.dbCore = dbCore
+	case BTreeDB:
+		dbCore, err := NewBTreeCore(setting.DBAddr)
+		if err != nil {
+			return errors.Join(ErrNewDBCore, err)
+		}
+		m.dbCore = dbCore
+	case GormDB:
+		dialector := setting.Dialector
+		if dialector == nil {
+			var err error
+			dialector, err = OpenGormDialector(setting.Driver, setting.DBAddr)
+			if err != nil {
+				return errors.Join(ErrNewGormCore, err)
+			}
+		}
+		dbCore, err := NewGormCore(dialector)
+		if err != nil {
+			return errors.Join(ErrNewGormCore, err)
+		}
+		m.dbCore = dbCore
 	case Toml:
 		fileCore := NewTomlCore(setting.FileAddr)
 		m.fileCore = fileCore
 	}
+	if setting.Encrypt != nil {
+		crypt, err := newCryptLayer(*setting.Encrypt)
+		if err != nil {
+			return err
+		}
+		m.crypt = crypt
+		if m.dbCore != nil {
+			m.dbCore = &cryptDBCore{core: m.dbCore, c: crypt}
+		}
+		if m.fileCore != nil {
+			m.fileCore = &cryptFileCore{core: m.fileCore, c: crypt}
+		}
+	}
 	if misc.HasProperty(setting.Property, UseCache) {
 		m.kvMap = make(map[string]*ValueUnit)
 		m.pool.New = func() interface{} {
 			return &ValueUnit{}
 		}
+		m.cache = newCacheTracker(setting.Cache)
 	}
 	if misc.HasProperty(setting.Property, FullInitLoad) {
 		if misc.HasProperty(setting.Property, UseDisk) {
@@ -60,7 +127,11 @@ func (m *XStorage) Init(setting XStorageSetting) error {
 			if err != nil {
 				return errors.Join(ErrGetAllValue, err)
 			}
+			now := time.Now()
 			for key, valueUnit := range kvMap {
+				if valueUnit.IsExpired(now) {
+					continue
+				}
 				if misc.HasProperty(setting.Property, UseCache) {
 					err := m.recordToMap(key, valueUnit)
 					if err != nil {
@@ -72,7 +143,44 @@ func (m *XStorage) Init(setting XStorageSetting) error {
 			return ErrNotUseDbAndFullInitLoad
 		}
 	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
 	m.initTag.SetInitialized()
+	if m.crypt != nil && misc.HasProperty(setting.Property, UseDisk) {
+		err := m.loadCryptMarks()
+		if err != nil {
+			return errors.Join(ErrEncrypt, err)
+		}
+	}
+	if setting.ExpireSweepInterval > 0 {
+		go m.sweepExpired(setting.ExpireSweepInterval)
+	}
+	if setting.Cache.WriteBack {
+		interval := setting.Cache.FlushInterval
+		if interval <= 0 {
+			interval = defaultCacheFlushInterval
+		}
+		go m.flushLoop(interval)
+	}
+	if setting.FileWatchInterval > 0 && m.fileCore != nil {
+		go m.watchFile(setting.FileWatchInterval)
+	}
+	return nil
+}
+
+// Close 停止所有后台任务
+func (m *XStorage) Close() error {
+	if !m.initTag.IsInitialized() {
+		return ErrMgrNotInit
+	}
+	m.cancel()
+	err := m.Flush()
+	if err != nil {
+		return err
+	}
+	// 文件类的数据库需要关闭文件句柄
+	if closer, ok := m.dbCore.(io.Closer); ok {
+		return closer.Close()
+	}
 	return nil
 }
 
@@ -92,9 +200,9 @@ func (m *XStorage) FromDiskGetAll() (map[string]*ValueUnit, error) {
 	var kvMap map[string]*ValueUnit
 	var err error
 	switch {
-	case t > DBBegin && t < FileBegin:
+	case t.isDB():
 		kvMap, err = m.dbCore.GetAll()
-	case t > FileBegin:
+	case t.isFile():
 		kvMap, err = m.fileCore.GetAll()
 	}
 	return kvMap, err
@@ -113,46 +221,83 @@ func (m *XStorage) Get(key string) (*ValueUnit, error) {
 }
 
 func (m *XStorage) GetHP(key string, valueUnit *ValueUnit) (bool, error) {
+	if !m.observers.has() {
+		ok, _, err := m.getHP(key, valueUnit)
+		return ok, err
+	}
+	start := time.Now()
+	ok, fromDisk, err := m.getHP(key, valueUnit)
+	source := OpSourceCache
+	if fromDisk {
+		source = OpSourceDisk
+	}
+	m.observers.publish(OpEvent{Op: OpGet, Source: source, Key: key, Start: start, Duration: time.Since(start), Found: ok, Err: err})
+	return ok, err
+}
+
+func (m *XStorage) getHP(key string, valueUnit *ValueUnit) (bool, bool, error) {
 	if !m.initTag.IsInitialized() {
-		return false, ErrMgrNotInit
+		return false, false, ErrMgrNotInit
 	}
 	if valueUnit == nil {
-		return false, ErrValueUnitIsNil
+		return false, false, ErrValueUnitIsNil
 	}
 	valueUnit.Reset()
 	if misc.HasProperty(m.setting.Property, MultiSafe) {
 		m.rwLock.RLock()
-		defer m.rwLock.RUnlock()
 	}
+	ok, fromDisk, gen, err := m.getInner(key, valueUnit)
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.RUnlock()
+	}
+	if err != nil || !ok || !fromDisk || !misc.HasProperty(m.setting.Property, UseCache) {
+		return ok, fromDisk, err
+	}
+	// 写入缓存需要写锁，所以在释放读锁后进行
+	err = m.recordLoaded(key, valueUnit, gen)
+	if err != nil {
+		return false, true, errors.Join(ErrRecordToMap, err)
+	}
+	return true, true, nil
+}
+
+// getInner 依次从缓存、磁盘读取，fromDisk代表读取了磁盘（包括磁盘上也没有的情况），gen为读取时缓存的版本
+func (m *XStorage) getInner(key string, valueUnit *ValueUnit) (ok bool, fromDisk bool, gen uint64, err error) {
+	gen = m.cacheGen
 	if misc.HasProperty(m.setting.Property, UseCache) {
 		if p, ok := m.kvMap[key]; ok {
-			if valueUnit.dirty {
-				return false, ErrValueIsDirty
+			m.cache.touch(key)
+			if p.IsExpired(time.Now()) {
+				return false, false, gen, nil
 			}
 			*valueUnit = *p
-			return true, nil
+			return true, false, gen, nil
+		}
+		m.cache.misses.Add(1)
+		if m.cache.isDeleted(key) {
+			return false, false, gen, nil
 		}
 	}
 	if misc.HasProperty(m.setting.Property, UseDisk) {
+		// 文件存储全部在缓存中，不会读取磁盘
+		fromDisk = m.setting.SaveType.isDB()
 		ok, err := m.onGetFromDisk(key, valueUnit)
 		if err != nil {
-			return false, errors.Join(ErrSqliteDBFileAddrNotExist, err)
+			return false, fromDisk, gen, errors.Join(ErrSqliteDBFileAddrNotExist, err)
 		}
 		if !ok {
-			return false, nil
+			return false, fromDisk, gen, nil
 		}
-		if misc.HasProperty(m.setting.Property, UseCache) {
-			err := m.recordToMap(key, valueUnit)
-			if err != nil {
-				return false, errors.Join(ErrRecordToMap, err)
-			}
+		if valueUnit.IsExpired(time.Now()) {
+			valueUnit.Reset()
+			return false, fromDisk, gen, nil
 		}
-		return true, nil
+		return true, fromDisk, gen, nil
 	}
 	if !misc.HasProperty(m.setting.Property, UseCache) && !misc.HasProperty(m.setting.Property, UseDisk) {
-		return false, ErrNotUseCacheAndNotUseDb
+		return false, false, gen, ErrNotUseCacheAndNotUseDb
 	}
-	return false, nil
+	return false, false, gen, nil
 }
 
 func (m *XStorage) onGetFromDisk(key string, rec *ValueUnit) (bool, error) {
@@ -160,9 +305,9 @@ func (m *XStorage) onGetFromDisk(key string, rec *ValueUnit) (bool, error) {
 	var ok bool
 	var err error
 	switch {
-	case t > DBBegin && t < FileBegin:
+	case t.isDB():
 		ok, err = m.dbCore.Get(key, rec)
-	case t > FileBegin:
+	case t.isFile():
 		return false, nil
 	}
 	return ok, err
@@ -302,6 +447,16 @@ func (m *XStorage) GetFromJson(key string, value interface{}) error {
 }
 
 func (m *XStorage) Set(key string, value *ValueUnit) error {
+	if !m.observers.has() {
+		return m.set(key, value)
+	}
+	start := time.Now()
+	err := m.set(key, value)
+	m.observers.publish(OpEvent{Op: OpSet, Source: m.writeSource(), Key: key, Start: start, Duration: time.Since(start), Err: err})
+	return err
+}
+
+func (m *XStorage) set(key string, value *ValueUnit) error {
 	if !m.initTag.IsInitialized() {
 		return ErrMgrNotInit
 	}
@@ -315,6 +470,11 @@ func (m *XStorage) Set(key string, value *ValueUnit) error {
 		m.rwLock.Lock()
 		defer m.rwLock.Unlock()
 	}
+	needEvent := m.watchHub.has(key)
+	var old *ValueUnit
+	if needEvent {
+		old = m.loadOldValue(key)
+	}
 	if misc.HasProperty(m.setting.Property, UseCache) {
 		err := m.recordToMap(key, value)
 		if err != nil {
@@ -327,6 +487,9 @@ func (m *XStorage) Set(key string, value *ValueUnit) error {
 			return errors.Join(ErrSetValue, err)
 		}
 	}
+	if needEvent {
+		m.watchHub.publish(newWatchEvent(key, old, value))
+	}
 	return nil
 }
 
@@ -334,15 +497,29 @@ func (m *XStorage) onSave2Disk(key string, value *ValueUnit) error {
 	t := m.setting.SaveType
 	var err error
 	switch {
-	case t > DBBegin && t < FileBegin:
+	case t.isDB():
+		if m.writeBack() {
+			m.cache.markDirty(key, true)
+			return nil
+		}
 		err = m.dbCore.Set(key, value)
-	case t > FileBegin:
-		err = m.fileCore.SaveAll(m.kvMap)
+	case t.isFile():
+		err = m.saveFile()
 	}
 	return err
 }
 
 func (m *XStorage) SetAsync(key string, value *ValueUnit) (error, chan error) {
+	start := time.Now()
+	err, errChan := m.setAsync(key, value, start)
+	// 落盘的事件在后台完成后发送
+	if errChan == nil && m.observers.has() {
+		m.observers.publish(OpEvent{Op: OpSet, Source: m.writeSource(), Key: key, Start: start, Duration: time.Since(start), Err: err})
+	}
+	return err, errChan
+}
+
+func (m *XStorage) setAsync(key string, value *ValueUnit, start time.Time) (error, chan error) {
 	if !m.initTag.IsInitialized() {
 		return ErrMgrNotInit, nil
 	}
@@ -356,37 +533,93 @@ func (m *XStorage) SetAsync(key string, value *ValueUnit) (error, chan error) {
 		m.rwLock.Lock()
 		defer m.rwLock.Unlock()
 	}
+	needEvent := m.watchHub.has(key)
+	var old *ValueUnit
+	if needEvent {
+		old = m.loadOldValue(key)
+	}
 	if misc.HasProperty(m.setting.Property, UseCache) {
 		err := m.recordToMap(key, value)
 		if err != nil {
 			return errors.Join(ErrRecordToMap, err), nil
 		}
 	}
+	var events []WatchEvent
+	if needEvent {
+		events = append(events, newWatchEvent(key, old, value))
+	}
 	if misc.HasProperty(m.setting.Property, UseDisk) {
+		// 落盘成功后才算提交，事件在saveAsync中持有锁时投递
 		errChan := make(chan error)
 		go func() {
-			err := m.onSave2Disk(key, value)
+			err := m.saveAsync(key, value, events...)
+			if m.observers.has() {
+				m.observers.publish(OpEvent{Op: OpSet, Source: m.writeSource(), Key: key, Start: start, Duration: time.Since(start), Err: err})
+			}
 			if err != nil {
 				errChan <- errors.Join(ErrSetValue, err)
+				return
 			}
 			errChan <- nil
 		}()
 		return nil, errChan
 	} else {
+		m.watchHub.publish(events...)
 		return nil, nil
 	}
 }
 
+// saveAsync SetAsync在后台落盘，成功后通知events。
+// 文件落盘时会将外部修改应用到缓存，所以开启MultiSafe时需要重新加锁，
+// 没有开启时无法保证缓存不被同时修改，只写入文件，外部修改留到下一次同步写入或ReloadFile时应用
+func (m *XStorage) saveAsync(key string, value *ValueUnit, events ...WatchEvent) error {
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.Lock()
+		defer m.rwLock.Unlock()
+	}
+	var err error
+	if m.setting.SaveType.isFile() && !misc.HasProperty(m.setting.Property, MultiSafe) {
+		err = m.fileCore.SaveAll(m.kvMap)
+	} else {
+		err = m.onSave2Disk(key, value)
+	}
+	if err != nil {
+		return err
+	}
+	m.watchHub.publish(events...)
+	return nil
+}
+
 func (m *XStorage) Delete(key string) error {
+	if !m.observers.has() {
+		return m.delete(key)
+	}
+	start := time.Now()
+	err := m.delete(key)
+	m.observers.publish(OpEvent{Op: OpDelete, Source: m.writeSource(), Key: key, Start: start, Duration: time.Since(start), Err: err})
+	return err
+}
+
+func (m *XStorage) delete(key string) error {
 	if !m.initTag.IsInitialized() {
 		return ErrMgrNotInit
 	}
 	if key == "" {
 		return ErrKeyIsEmpty
 	}
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.Lock()
+		defer m.rwLock.Unlock()
+	}
+	needEvent := m.watchHub.has(key)
+	var old *ValueUnit
+	if needEvent {
+		old = m.loadOldValue(key)
+	}
 	if misc.HasProperty(m.setting.Property, UseCache) {
 		err := m.removeFromMap(key)
-		if err != nil {
+		// 缓存中只有部分数据时，key可能只在磁盘上
+		if err != nil && !(errors.Is(err, ErrKeyNotExist) && !m.cacheIsFull()) {
 			return errors.Join(ErrRemoveFromMap, err)
 		}
 	}
@@ -396,6 +629,9 @@ func (m *XStorage) Delete(key string) error {
 			return errors.Join(ErrDeleteValue, err)
 		}
 	}
+	if needEvent {
+		m.watchHub.publish(newWatchEvent(key, old, nil))
+	}
 	return nil
 }
 
@@ -403,10 +639,14 @@ func (m *XStorage) fromDiskDelete(key string) error {
 	t := m.setting.SaveType
 	var err error
 	switch {
-	case t > DBBegin && t < FileBegin:
+	case t.isDB():
+		if m.writeBack() {
+			m.cache.markDirty(key, false)
+			return nil
+		}
 		err = m.dbCore.Delete(key)
-	case t > FileBegin:
-		err = m.fileCore.SaveAll(m.kvMap)
+	case t.isFile():
+		err = m.saveFile()
 	}
 	return err
 }
@@ -426,7 +666,13 @@ func (m *XStorage) recordToMap(key string, value *ValueUnit) error {
 		return ErrPoolType
 	}
 	Copy(value, newValue)
+	m.cacheGen++
+	if _, ok := m.kvMap[key]; !ok {
+		m.sortedKeysDirty = true
+	}
 	m.kvMap[key] = newValue
+	// 淘汰失败时只是暂时超出容量，不影响本次写入
+	_ = m.evict(m.cache.add(key, newValue))
 	return nil
 }
 
@@ -437,13 +683,16 @@ func (m *XStorage) removeFromMap(key string) error {
 	if !misc.HasProperty(m.setting.Property, UseCache) {
 		return ErrNotUseCache
 	}
+	m.cacheGen++
 	// 释放
 	if _, ok := m.kvMap[key]; !ok {
 		return ErrKeyNotExist
 	}
+	m.cache.remove(key)
 	m.kvMap[key].Reset()
 	m.pool.Put(m.kvMap[key])
 	delete(m.kvMap, key)
+	m.sortedKeysDirty = true
 	return nil
 }
 
@@ -455,15 +704,249 @@ func (m *XStorage) GetAll() (map[string]*ValueUnit, error) {
 		m.rwLock.RLock()
 		defer m.rwLock.RUnlock()
 	}
-	if misc.HasProperty(m.setting.Property, UseCache) {
-		return m.kvMap, nil
+	if m.cacheIsFull() {
+		return hideInternal(filterExpired(m.kvMap)), nil
 	}
 	if misc.HasProperty(m.setting.Property, UseDisk) {
+		err := m.flushDirty()
+		if err != nil {
+			return nil, errors.Join(ErrGetAllValue, err)
+		}
 		kvMap, err := m.FromDiskGetAll()
 		if err != nil {
 			return nil, errors.Join(ErrGetAllValue, err)
 		}
-		return kvMap, nil
+		return hideInternal(filterExpired(kvMap)), nil
 	}
 	return nil, ErrNotUseCacheAndNotUseDb
 }
+
+// filterExpired 过滤掉已经过期的数据，没有过期数据时直接返回原map，避免复制
+func filterExpired(kvMap map[string]*ValueUnit) map[string]*ValueUnit {
+	now := time.Now()
+	hasExpired := false
+	for _, v := range kvMap {
+		if v.IsExpired(now) {
+			hasExpired = true
+			break
+		}
+	}
+	if !hasExpired {
+		return kvMap
+	}
+	ret := make(map[string]*ValueUnit, len(kvMap))
+	for k, v := range kvMap {
+		if !v.IsExpired(now) {
+			ret[k] = v
+		}
+	}
+	return ret
+}
+
+// SetWithTTL 设置一个ttl后过期的值，过期后Get、GetAll、Scan都会视为不存在，ttl<=0时永不过期
+func (m *XStorage) SetWithTTL(key string, value *ValueUnit, ttl time.Duration) error {
+	if value == nil {
+		return ErrValueIsNil
+	}
+	return m.Set(key, value.WithTTL(ttl))
+}
+
+// PurgeExpired 从缓存与磁盘中删除所有已过期的key
+func (m *XStorage) PurgeExpired() error {
+	if !m.observers.has() {
+		_, err := m.purgeExpired()
+		return err
+	}
+	start := time.Now()
+	expired, err := m.purgeExpired()
+	ops := make([]BatchOp, 0, len(expired))
+	for k := range expired {
+		ops = append(ops, BatchOp{Type: BatchOpDelete, Key: k})
+	}
+	m.publishOps(ops, m.directSource(), start, err)
+	return err
+}
+
+// purgeExpired 返回过期的key与过期前的值，出错时为出错前找到的过期key
+func (m *XStorage) purgeExpired() (map[string]*ValueUnit, error) {
+	if !m.initTag.IsInitialized() {
+		return nil, ErrMgrNotInit
+	}
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.Lock()
+		defer m.rwLock.Unlock()
+	}
+	err := m.flushDirty()
+	if err != nil {
+		return nil, errors.Join(ErrDeleteExpired, err)
+	}
+	now := time.Now()
+	// 过期的key会以删除事件通知监听者，旧值为过期前的值
+	expired := make(map[string]*ValueUnit)
+	if misc.HasProperty(m.setting.Property, UseCache) {
+		for k, v := range m.kvMap {
+			if v.IsExpired(now) {
+				old := &ValueUnit{}
+				Copy(v, old)
+				expired[k] = old
+			}
+		}
+		for k := range expired {
+			err := m.removeFromMap(k)
+			if err != nil {
+				return expired, errors.Join(ErrRemoveFromMap, err)
+			}
+		}
+	}
+	if misc.HasProperty(m.setting.Property, UseDisk) {
+		t := m.setting.SaveType
+		switch {
+		case t.isDB():
+			keys, err := m.dbCore.DeleteExpired(now.UnixMilli())
+			if err != nil {
+				return expired, errors.Join(ErrDeleteExpired, err)
+			}
+			for _, k := range keys {
+				if _, ok := expired[k]; !ok {
+					expired[k] = nil
+				}
+			}
+		case t.isFile():
+			if len(expired) > 0 {
+				err := m.saveFile()
+				if err != nil {
+					return expired, errors.Join(ErrDeleteExpired, err)
+				}
+			}
+		}
+	}
+	for k, old := range expired {
+		if m.watchHub.has(k) {
+			m.watchHub.publish(newWatchEvent(k, old, nil))
+		}
+	}
+	return expired, nil
+}
+
+func (m *XStorage) sweepExpired(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.ctx.Done():
+			return
+		case <-ticker.C:
+			_ = m.PurgeExpired()
+		}
+	}
+}
+
+// Scan 按key升序进行前缀、范围查询，支持分页。
+// 缓存中有全量数据时直接在缓存上查询，否则交由数据库查询。内部的key（例如配置的修改历史）只有在Prefix为其前缀时才会返回
+func (m *XStorage) Scan(option ScanOption) (*ScanResult, error) {
+	if internalPrefixOf(option.Prefix) != "" {
+		return m.scan(option)
+	}
+	limit := option.Limit
+	ret := &ScanResult{}
+	for {
+		page, err := m.scan(option)
+		if err != nil {
+			return nil, err
+		}
+		for _, pair := range page.Pairs {
+			if internalPrefixOf(pair.Key) == "" {
+				ret.Pairs = append(ret.Pairs, pair)
+			}
+		}
+		ret.Next = page.Next
+		if page.Next == "" || limit <= 0 || len(ret.Pairs) >= limit {
+			return ret, nil
+		}
+		// 这一页中有内部的key被去掉，继续读取补满，跳过整个内部前缀
+		option.Start = page.Next
+		if prefix := internalPrefixOf(page.Next); prefix != "" {
+			option.Start = prefixUpper(prefix)
+		}
+		option.Limit = limit - len(ret.Pairs)
+	}
+}
+
+// scan 与Scan相同，但是包含内部的key
+func (m *XStorage) scan(option ScanOption) (*ScanResult, error) {
+	if !m.initTag.IsInitialized() {
+		return nil, ErrMgrNotInit
+	}
+	if misc.HasProperty(m.setting.Property, MultiSafe) {
+		m.rwLock.RLock()
+		defer m.rwLock.RUnlock()
+	}
+	if m.cacheIsFull() {
+		return m.scanCache(option), nil
+	}
+	if misc.HasProperty(m.setting.Property, UseDisk) {
+		t := m.setting.SaveType
+		if t.isDB() {
+			err := m.flushDirty()
+			if err != nil {
+				return nil, errors.Join(ErrScanValue, err)
+			}
+			ret, err := m.dbCore.Scan(option)
+			if err != nil {
+				return nil, errors.Join(ErrScanValue, err)
+			}
+			return ret, nil
+		}
+	}
+	return nil, ErrNotUseCacheAndNotUseDb
+}
+
+// GetByPrefix 取出所有以prefix开头的数据，按key升序排列
+func (m *XStorage) GetByPrefix(prefix string) ([]KVPair, error) {
+	ret, err := m.Scan(ScanOption{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	return ret.Pairs, nil
+}
+
+// cacheIsFull 缓存中是否持有全量数据
+func (m *XStorage) cacheIsFull() bool {
+	if !misc.HasProperty(m.setting.Property, UseCache) {
+		return false
+	}
+	return !misc.HasProperty(m.setting.Property, UseDisk) || misc.HasProperty(m.setting.Property, FullInitLoad)
+}
+
+func (m *XStorage) scanCache(option ScanOption) *ScanResult {
+	m.sortedKeysLock.Lock()
+	defer m.sortedKeysLock.Unlock()
+	if m.sortedKeysDirty || len(m.sortedKeys) != len(m.kvMap) {
+		m.sortedKeys = m.sortedKeys[:0]
+		for k := range m.kvMap {
+			m.sortedKeys = append(m.sortedKeys, k)
+		}
+		sort.Strings(m.sortedKeys)
+		m.sortedKeysDirty = false
+	}
+	lower, upper := scanRange(option)
+	now := time.Now()
+	ret := &ScanResult{}
+	for i := sort.SearchStrings(m.sortedKeys, lower); i < len(m.sortedKeys); i++ {
+		key := m.sortedKeys[i]
+		if upper != "" && key >= upper {
+			break
+		}
+		if m.kvMap[key].IsExpired(now) {
+			continue
+		}
+		if option.Limit > 0 && len(ret.Pairs) >= option.Limit {
+			ret.Next = key
+			break
+		}
+		value := &ValueUnit{}
+		Copy(m.kvMap[key], value)
+		ret.Pairs = append(ret.Pairs, KVPair{Key: key, Value: value})
+	}
+	return ret
+}
@@ -1,10 +1,25 @@
 package xstorage
 
 import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	d1 "github.com/intmian/mian_go_lib/fork/d1_gorm_adapter"
+	"github.com/intmian/mian_go_lib/fork/d1_gorm_adapter/gormd1"
 	"github.com/intmian/mian_go_lib/tool/misc"
+	"github.com/intmian/mian_go_lib/xlog"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
 	"math/rand"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -424,8 +439,8 @@ func TestMgrSlice(t *testing.T) {
 
 func TestMgrToml(t *testing.T) {
 	// 删除test.db文件
-	os.Remove("test6.toml")
-	os.Remove("test7.toml")
+	os.Remove("test6.json")
+	os.Remove("test7.json")
 	m, _ := NewXStorage(XStorageSetting{
 		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk, FullInitLoad),
 		SaveType: Toml,
@@ -702,8 +717,10 @@ func TestMgrToml(t *testing.T) {
 			}
 		})
 	}
-	os.Remove("test6.toml")
-	os.Remove("test7.toml")
+	os.Remove("test6.json")
+	os.Remove("test7.json")
+	os.Remove("test6.json.lock")
+	os.Remove("test7.json.lock")
 }
 
 func TestMem(t *testing.T) {
@@ -858,3 +875,1857 @@ func TestMem(t *testing.T) {
 		}
 	}
 }
+
+func TestMgrScan(t *testing.T) {
+	os.Remove("test8.db")
+	defer os.Remove("test8.db")
+	mCache, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mDisk, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test8.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*XStorage{mCache, mDisk} {
+		for i := 0; i < 5; i++ {
+			err = m.Set(Join("user", strconv.Itoa(i), "setting"), ToUnit(i, ValueTypeInt))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = m.Set("user.list", ToUnit([]int{1, 2}, ValueTypeSliceInt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.Set("userx", ToUnit("x", ValueTypeString))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pairs, err := m.GetByPrefix("user.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pairs) != 6 || pairs[0].Key != "user.0.setting" || pairs[5].Key != "user.list" {
+			t.Fatalf("prefix scan error %v", pairs)
+		}
+		if !Compare(pairs[5].Value, ToUnit([]int{1, 2}, ValueTypeSliceInt)) {
+			t.Fatal("slice value error")
+		}
+
+		// 分页
+		var keys []string
+		option := ScanOption{Prefix: "user.", End: "user.list", Limit: 2}
+		for {
+			ret, err := m.Scan(option)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, pair := range ret.Pairs {
+				keys = append(keys, pair.Key)
+			}
+			if ret.Next == "" {
+				break
+			}
+			option.Start = ret.Next
+		}
+		if len(keys) != 5 || keys[4] != "user.4.setting" {
+			t.Fatalf("page scan error %v", keys)
+		}
+
+		err = m.Delete("user.0.setting")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret, err := m.Scan(ScanOption{Start: "user.0", Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ret.Pairs) != 1 || ret.Pairs[0].Key != "user.1.setting" || ret.Next != "user.2.setting" {
+			t.Fatalf("scan after delete error %v", ret)
+		}
+	}
+}
+
+func TestMgrBatch(t *testing.T) {
+	os.Remove("test9.db")
+	defer os.Remove("test9.db")
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk, FullInitLoad),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test9.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv := make(map[string]*ValueUnit)
+	for i := 0; i < 1000; i++ {
+		kv[strconv.Itoa(i)] = ToUnit(i, ValueTypeInt)
+	}
+	kv["slice"] = ToUnit([]string{"a", "b"}, ValueTypeSliceString)
+	err = m.SetBatch(kv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 第二个操作类型不匹配，整批都应该回滚
+	err = m.NewBatch().Set("0", ToUnit(100, ValueTypeInt)).Set("slice", ToUnit([]int{1}, ValueTypeSliceInt)).Delete("1").Commit()
+	if err == nil {
+		t.Fatal("batch should fail")
+	}
+	m2, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test9.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []*XStorage{m, m2} {
+		if ToBaseF[int](s.Get("0")) != 0 {
+			t.Fatal("key 0 should be rolled back")
+		}
+		v, err := s.Get("1")
+		if err != nil || v == nil {
+			t.Fatal("key 1 should not be deleted")
+		}
+		if !Compare(ToUnit([]string{"a", "b"}, ValueTypeSliceString), unitOf(s.Get("slice"))) {
+			t.Fatal("slice should be rolled back")
+		}
+	}
+
+	err = m.Txn(func(b *Batch) error {
+		b.Delete("slice")
+		for i := 0; i < 500; i++ {
+			b.Delete(strconv.Itoa(i))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := m2.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 500 {
+		t.Fatalf("len error %d", len(all))
+	}
+}
+
+func unitOf(unit *ValueUnit, _ error) *ValueUnit {
+	return unit
+}
+
+func TestMgrTTL(t *testing.T) {
+	os.Remove("test10.db")
+	defer os.Remove("test10.db")
+	setting := XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk, FullInitLoad),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test10.db",
+	}
+	m, err := NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.SetWithTTL("token", ToUnit("abc", ValueTypeString), time.Millisecond*100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.SetWithTTL("long", ToUnit([]int{1, 2}, ValueTypeSliceInt), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ToBaseF[string](m.Get("token")) != "abc" {
+		t.Fatal("token should exist")
+	}
+	time.Sleep(time.Millisecond * 150)
+	v, err := m.Get("token")
+	if err != nil || v != nil {
+		t.Fatal("token should be expired")
+	}
+	all, err := m.GetAll()
+	if err != nil || len(all) != 1 {
+		t.Fatal("GetAll should filter expired")
+	}
+
+	// 重启后过期时间依然有效
+	m2, err := NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = m2.Get("token")
+	if err != nil || v != nil {
+		t.Fatal("token should be expired after reboot")
+	}
+	v, err = m2.Get("long")
+	if err != nil || v == nil || v.ExpireAt == 0 {
+		t.Fatal("long should keep expire after reboot")
+	}
+
+	err = m.PurgeExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, err := NewSqliteCore("test10.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := core.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := raw["token"]; ok || len(raw) != 1 {
+		t.Fatal("token should be purged from disk")
+	}
+
+	// 后台清理
+	os.Remove("test11.json")
+	defer os.Remove("test11.json")
+	defer os.Remove("test11.json.lock")
+	m3, err := NewXStorage(XStorageSetting{
+		Property:            misc.CreateProperty(MultiSafe, UseCache, UseDisk, FullInitLoad),
+		SaveType:            Toml,
+		FileAddr:            "test11.json",
+		ExpireSweepInterval: time.Millisecond * 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m3.Close()
+	err = m3.SetWithTTL("token", ToUnit(1, ValueTypeInt), time.Millisecond*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	raw, err = NewTomlCore("test11.json").GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 0 {
+		t.Fatal("token should be swept from file")
+	}
+}
+
+func TestMgrWatch(t *testing.T) {
+	os.Remove("test12.db")
+	defer os.Remove("test12.db")
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test12.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set("cfg.a", ToUnit(1, ValueTypeInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := m.Watch("cfg.")
+	defer w.Close()
+	var funcEvents []WatchEvent
+	done := make(chan struct{})
+	cancel := m.WatchFunc("other", func(event WatchEvent) {
+		funcEvents = append(funcEvents, event)
+		close(done)
+	})
+	defer cancel()
+
+	// 新建一个实例，旧值只能从磁盘读到
+	m2, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test12.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w2 := m2.Watch("")
+	defer w2.Close()
+	err = m2.Set("cfg.a", ToUnit(2, ValueTypeInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := <-w2.C
+	if e.Type != WatchEventSet || ToBase[int](e.OldValue) != 1 || ToBase[int](e.NewValue) != 2 {
+		t.Fatalf("event error %v", e)
+	}
+
+	err = m.NewBatch().Set("cfg.b", ToUnit("b", ValueTypeString)).Set("other", ToUnit(1, ValueTypeInt)).Delete("cfg.a").Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = <-w.C
+	if e.Type != WatchEventSet || e.Key != "cfg.b" || e.OldValue != nil || ToBase[string](e.NewValue) != "b" {
+		t.Fatalf("event error %v", e)
+	}
+	e = <-w.C
+	if e.Type != WatchEventDelete || e.Key != "cfg.a" || ToBase[int](e.OldValue) != 1 || e.NewValue != nil {
+		t.Fatalf("event error %v", e)
+	}
+	<-done
+	if len(funcEvents) != 1 || funcEvents[0].Key != "other" {
+		t.Fatalf("func event error %v", funcEvents)
+	}
+
+	// 失败的提交不会产生事件
+	err = m.Set("cfg.b", ToUnit(1, ValueTypeInt))
+	if err == nil {
+		t.Fatal("type not match should fail")
+	}
+	select {
+	case e = <-w.C:
+		t.Fatalf("should not receive event %v", e)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// 异步写入在落盘成功后投递事件
+	err, c := m.SetAsync("cfg.c", ToUnit(1, ValueTypeInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-c; err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set("cfg.c", ToUnit(2, ValueTypeInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e = <-w.C
+	e2 := <-w.C
+	if ToBase[int](e.NewValue) != 1 || ToBase[int](e2.NewValue) != 2 || ToBase[int](e2.OldValue) != 1 {
+		t.Fatalf("async event order error %v %v", e, e2)
+	}
+
+	// 异步落盘失败时不会产生事件
+	addr := filepath.Join(t.TempDir(), "watch.db")
+	m3, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk),
+		SaveType: JsonLineDB,
+		DBAddr:   addr,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w3 := m3.Watch("")
+	defer w3.Close()
+	_ = m3.Close()
+	err, c = m3.SetAsync("a", ToUnit(1, ValueTypeInt))
+	if err != nil || <-c == nil {
+		t.Fatalf("async save to closed file should fail %v", err)
+	}
+	select {
+	case e = <-w3.C:
+		t.Fatalf("failed async save should not notify %v", e)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestMgrAtomic(t *testing.T) {
+	os.Remove("test13.db")
+	defer os.Remove("test13.db")
+	mDisk, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(UseCache, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test13.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mCache, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []*XStorage{mDisk, mCache} {
+		// 并发计数不应丢失
+		wg := sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 10; j++ {
+					_, err := m.Incr("counter", ToUnit(1, ValueTypeInt))
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if ToBaseF[int](m.Get("counter")) != 200 {
+			t.Fatalf("counter error %v", ToBaseF[int](m.Get("counter")))
+		}
+		v, err := m.Incr("f", ToUnit(float32(1.5), ValueTypeFloat))
+		if err != nil || ToBase[float32](v) != 1.5 {
+			t.Fatal("incr float error")
+		}
+		_, err = m.Incr("f", ToUnit(1, ValueTypeInt))
+		if err == nil {
+			t.Fatal("incr type not match should fail")
+		}
+
+		ok, err := m.CompareAndSwap("cas", nil, ToUnit("a", ValueTypeString))
+		if err != nil || !ok {
+			t.Fatal("cas on empty key should succeed")
+		}
+		ok, err = m.CompareAndSwap("cas", nil, ToUnit("b", ValueTypeString))
+		if err != nil || ok {
+			t.Fatal("cas on exist key should fail")
+		}
+		ok, err = m.CompareAndSwap("cas", ToUnit("a", ValueTypeString), ToUnit("b", ValueTypeString))
+		if err != nil || !ok || ToBaseF[string](m.Get("cas")) != "b" {
+			t.Fatal("cas should succeed")
+		}
+
+		_, err = m.Append("list", ToUnit([]string{"a"}, ValueTypeSliceString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err = m.Append("list", ToUnit([]string{"b", "c"}, ValueTypeSliceString))
+		if err != nil || !Compare(v, ToUnit([]string{"a", "b", "c"}, ValueTypeSliceString)) {
+			t.Fatal("append error")
+		}
+	}
+	m2, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test13.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ToBaseF[int](m2.Get("counter")) != 200 || len(ToBaseF[[]string](m2.Get("list"))) != 3 {
+		t.Fatal("disk value error")
+	}
+}
+
+func TestMgrFileDB(t *testing.T) {
+	for _, saveType := range []keyValueSaveType{JsonLineDB, BTreeDB} {
+		addr := "test14.db"
+		os.Remove(addr)
+		setting := XStorageSetting{
+			Property: misc.CreateProperty(MultiSafe, UseDisk),
+			SaveType: saveType,
+			DBAddr:   addr,
+		}
+		m, err := NewXStorage(setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 足够多的key让b树发生分裂
+		for i := 0; i < 1000; i++ {
+			err = m.Set(Join("k", fmt.Sprintf("%04d", i)), ToUnit(i, ValueTypeInt))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 0; i < 1000; i += 2 {
+			err = m.Delete(Join("k", fmt.Sprintf("%04d", i)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = m.Set("list", ToUnit([]string{"a", "b"}, ValueTypeSliceString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.Txn(func(b *Batch) error {
+			b.Set("b1", ToUnit(float32(1.5), ValueTypeFloat))
+			b.Delete("k.0001")
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		check := func(m *XStorage) {
+			v, err := m.Get("k.0003")
+			if err != nil || v == nil || ToBase[int](v) != 3 {
+				t.Fatalf("%d get error %v", saveType, err)
+			}
+			v, err = m.Get("k.0002")
+			if err != nil || v != nil {
+				t.Fatalf("%d deleted key still exist", saveType)
+			}
+			v, err = m.Get("list")
+			if err != nil || v == nil || !Compare(v, ToUnit([]string{"a", "b"}, ValueTypeSliceString)) {
+				t.Fatalf("%d slice error", saveType)
+			}
+			ret, err := m.Scan(ScanOption{Prefix: "k.", Limit: 10})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ret.Pairs) != 10 || ret.Pairs[0].Key != "k.0003" || ret.Next != "k.0023" {
+				t.Fatalf("%d scan error %v", saveType, ret)
+			}
+			all, err := m.GetAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(all) != 501 {
+				t.Fatalf("%d get all error %d", saveType, len(all))
+			}
+		}
+		check(m)
+		err = m.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// 模拟写了一半崩溃
+		f, err := os.OpenFile(addr, os.O_APPEND|os.O_WRONLY, 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = f.WriteString(`{"ops":[{"k":"broken"`)
+		_ = f.Close()
+		m, err = NewXStorage(setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(m)
+		v, err := m.Get("broken")
+		if err != nil || v != nil {
+			t.Fatalf("%d broken tail not truncated", saveType)
+		}
+
+		err = m.dbCore.(interface{ Compact() error }).Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		check(m)
+		err = m.Set("after", ToUnit("compact", ValueTypeString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = m.Close()
+		m, err = NewXStorage(setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err = m.Get("after")
+		if err != nil || v == nil || ToBase[string](v) != "compact" {
+			t.Fatalf("%d reboot after compact error", saveType)
+		}
+		if saveType == JsonLineDB {
+			// 自动压缩失败时写入依然成功，缓存与磁盘保持一致
+			_ = os.Mkdir(addr+".compact", 0777)
+			for i := 0; i < 1100; i++ {
+				err = m.Set("hot", ToUnit(i, ValueTypeInt))
+				if err != nil {
+					t.Fatalf("write should not fail on compact error %v", err)
+				}
+			}
+			if m.dbCore.(*JsonLineCore).CompactErr() == nil {
+				t.Fatal("compact error should be kept")
+			}
+			v, err = m.Get("hot")
+			if err != nil || v == nil || ToBase[int](v) != 1099 {
+				t.Fatal("value after compact error wrong")
+			}
+			_ = os.Remove(addr + ".compact")
+			err = m.Set("hot", ToUnit(0, ValueTypeInt))
+			if err != nil || m.dbCore.(*JsonLineCore).CompactErr() != nil {
+				t.Fatalf("compact should retry on next write %v", err)
+			}
+
+			// 中间的行损坏时报错，不能截断之后的记录
+			_ = m.Close()
+			f, err = os.OpenFile(addr, os.O_APPEND|os.O_WRONLY, 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = f.WriteString("{broken}\n{\"ops\":[{\"k\":\"later\",\"v\":{\"t\":1,\"d\":\"x\"}}]}\n")
+			_ = f.Close()
+			before, _ := os.Stat(addr)
+			m, err = NewXStorage(setting)
+			if !errors.Is(err, ErrJsonLineFileBroken) {
+				t.Fatalf("broken line in middle should fail %v", err)
+			}
+			after, _ := os.Stat(addr)
+			if before.Size() != after.Size() {
+				t.Fatal("broken file should not be truncated")
+			}
+			// 没有值也不是删除的操作同样是损坏
+			err = os.WriteFile(addr, []byte("{\"ops\":[{\"k\":\"a\"}]}\n"), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = NewJsonLineCore(addr)
+			if !errors.Is(err, ErrJsonLineFileBroken) {
+				t.Fatalf("op without value should fail %v", err)
+			}
+			// 压缩后无法重新打开文件时，之后的操作都返回错误
+			_ = os.Remove(addr)
+			core, err := NewJsonLineCore(addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = core.Set("a", ToUnit(1, ValueTypeInt))
+			_ = os.Mkdir(addr+".dir", 0777)
+			_ = os.WriteFile(addr+".dir/x", nil, 0666)
+			core.addr = addr + ".dir"
+			if !errors.Is(core.Compact(), ErrJsonLineCoreBroken) {
+				t.Fatal("compact should mark core broken")
+			}
+			_, err = core.Get("a", &ValueUnit{})
+			if !errors.Is(err, ErrJsonLineCoreBroken) || !errors.Is(core.Set("a", ToUnit(2, ValueTypeInt)), ErrJsonLineCoreBroken) {
+				t.Fatalf("broken core should not be used %v", err)
+			}
+			_ = core.Close()
+			_ = os.RemoveAll(addr + ".dir")
+			os.Remove(addr)
+			continue
+		}
+		_ = m.Close()
+		os.Remove(addr)
+	}
+}
+
+func TestMgrSnapshot(t *testing.T) {
+	os.Remove("test15.toml")
+	os.Remove("test15.db")
+	defer os.Remove("test15.toml")
+	defer os.Remove("test15.toml.lock")
+	defer os.Remove("test15.db")
+	tomlSetting := XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk, FullInitLoad),
+		SaveType: Toml,
+		FileAddr: "test15.toml",
+	}
+	sqliteSetting := XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test15.db",
+	}
+	data := map[string]*ValueUnit{
+		"s":  ToUnit("1", ValueTypeString),
+		"i":  ToUnit(2, ValueTypeInt),
+		"f":  ToUnit(float32(3.5), ValueTypeFloat),
+		"b":  ToUnit(true, ValueTypeBool),
+		"si": ToUnit([]int{1, 2, 3}, ValueTypeSliceInt),
+		"ss": ToUnit([]string{"1", "2"}, ValueTypeSliceString),
+		"sf": ToUnit([]float32{1.5, 2}, ValueTypeSliceFloat),
+		"sb": ToUnit([]bool{true, false}, ValueTypeSliceBool),
+		"t":  ToUnit("ttl", ValueTypeString).WithTTL(time.Hour),
+	}
+	m, err := NewXStorage(tomlSetting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.SetBatch(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Close()
+
+	// toml -> sqlite
+	err = Migrate(tomlSetting, sqliteSetting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mDB, err := NewXStorage(sqliteSetting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range data {
+		v2, err := mDB.Get(k)
+		if err != nil || v2 == nil || !Compare(v, v2) || v.ExpireAt != v2.ExpireAt {
+			t.Fatalf("migrate %s error %v", k, v2)
+		}
+	}
+
+	// 导出后导入到另一个存储
+	var buf bytes.Buffer
+	err = mDB.Export(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mMem, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mMem.Import(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := mMem.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(data) {
+		t.Fatalf("import count error %d", len(all))
+	}
+	for k, v := range data {
+		v2, err := mMem.Get(k)
+		if err != nil || v2 == nil || v2.Type != v.Type || !Compare(v, v2) {
+			t.Fatalf("import %s error %v", k, v2)
+		}
+	}
+	err = mMem.Import(strings.NewReader(`{"format":"other","version":1}`))
+	if !errors.Is(err, ErrSnapshotFormat) {
+		t.Fatal("format error not found")
+	}
+}
+
+func TestMgrTyped(t *testing.T) {
+	os.Remove("test16.db")
+	os.Remove("test16.toml")
+	defer os.Remove("test16.db")
+	defer os.Remove("test16.toml")
+	defer os.Remove("test16.toml.lock")
+	settings := []XStorageSetting{
+		{
+			Property: misc.CreateProperty(MultiSafe, UseCache),
+		},
+		{
+			Property: misc.CreateProperty(MultiSafe, UseDisk),
+			SaveType: SqlLiteDB,
+			DBAddr:   "test16.db",
+		},
+		{
+			Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk, FullInitLoad),
+			SaveType: Toml,
+			FileAddr: "test16.toml",
+		},
+	}
+	type news struct {
+		Title string
+		Tags  []string
+	}
+	now := time.Unix(1700000000, 0).UTC()
+	for i, setting := range settings {
+		m, err := NewXStorage(setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		i64 := NewTyped[int64](m)
+		f64 := NewTyped[float64](m)
+		tm := NewTyped[time.Time](m)
+		ms := NewTyped[map[string]string](m)
+		mi := NewTyped[map[string]int](m)
+		st := NewTyped[news](m)
+		if i64.Set("i64", 1<<40) != nil || f64.Set("f64", 1.25) != nil || tm.Set("time", now) != nil ||
+			ms.Set("ms", map[string]string{"a": "1"}) != nil || mi.Set("mi", map[string]int{"a": 1, "b": 2}) != nil ||
+			st.Set("news", news{Title: "t", Tags: []string{"x"}}) != nil {
+			t.Fatalf("%d set error", i)
+		}
+		check := func(m *XStorage) {
+			if v, ok, err := NewTyped[int64](m).Get("i64"); err != nil || !ok || v != 1<<40 {
+				t.Fatalf("%d int64 error %v %v", i, v, err)
+			}
+			if v, ok, err := NewTyped[float64](m).Get("f64"); err != nil || !ok || v != 1.25 {
+				t.Fatalf("%d float64 error %v %v", i, v, err)
+			}
+			if v, ok, err := NewTyped[time.Time](m).Get("time"); err != nil || !ok || !v.Equal(now) {
+				t.Fatalf("%d time error %v %v", i, v, err)
+			}
+			if v, ok, err := NewTyped[map[string]string](m).Get("ms"); err != nil || !ok || v["a"] != "1" {
+				t.Fatalf("%d map string error %v %v", i, v, err)
+			}
+			if v, ok, err := NewTyped[map[string]int](m).Get("mi"); err != nil || !ok || len(v) != 2 || v["b"] != 2 {
+				t.Fatalf("%d map int error %v %v", i, v, err)
+			}
+			if v, ok, err := NewTyped[news](m).Get("news"); err != nil || !ok || v.Title != "t" || v.Tags[0] != "x" {
+				t.Fatalf("%d struct error %v %v", i, v, err)
+			}
+		}
+		check(m)
+		// 类型不匹配
+		_, ok, err := NewTyped[int](m).Get("i64")
+		if !ok || !errors.Is(err, ErrValueTypeNotMatch) {
+			t.Fatalf("%d type not match error %v", i, err)
+		}
+		_, ok, err = NewTyped[int](m).Get("none")
+		if ok || err != nil {
+			t.Fatalf("%d not exist error %v", i, err)
+		}
+		if i > 0 {
+			// 重启后依然可以读取
+			_ = m.Close()
+			m, err = NewXStorage(setting)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(m)
+		}
+		_ = m.Close()
+	}
+}
+
+func TestMgrCache(t *testing.T) {
+	os.Remove("test17.db")
+	defer os.Remove("test17.db")
+	setting := XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test17.db",
+		Cache:    CachePolicy{MaxEntries: 10},
+	}
+	_, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk, FullInitLoad),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test17.db",
+		Cache:    CachePolicy{MaxEntries: 10},
+	})
+	if !errors.Is(err, ErrCachePolicy) {
+		t.Fatal("full init load with cache policy should fail")
+	}
+
+	// LRU
+	m, err := NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		err = m.Set(strconv.Itoa(i), ToUnit(i, ValueTypeInt))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats := m.CacheStats()
+	if stats.Entries != 10 || stats.Evictions != 10 {
+		t.Fatalf("lru evict error %+v", stats)
+	}
+	if _, ok := m.kvMap["0"]; ok {
+		t.Fatal("oldest key not evicted")
+	}
+	for i := 0; i < 20; i++ {
+		if ToBaseF[int](m.Get(strconv.Itoa(i))) != i {
+			t.Fatalf("get %d error", i)
+		}
+	}
+	// 顺序读取时每次都会淘汰掉即将读取的key，最近读取的key会命中
+	_, _ = m.Get("19")
+	stats = m.CacheStats()
+	if stats.Entries != 10 || stats.Hits == 0 || stats.Misses == 0 {
+		t.Fatalf("stats error %+v", stats)
+	}
+	all, err := m.GetAll()
+	if err != nil || len(all) != 20 {
+		t.Fatalf("get all error %d %v", len(all), err)
+	}
+	_ = m.Close()
+
+	// LFU
+	setting.Cache = CachePolicy{MaxEntries: 5, Evict: CacheEvictLFU}
+	m, err = NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		_, _ = m.Get("0")
+	}
+	for i := 1; i < 20; i++ {
+		_, _ = m.Get(strconv.Itoa(i))
+	}
+	if _, ok := m.kvMap["0"]; !ok {
+		t.Fatal("hot key evicted")
+	}
+	_ = m.Close()
+
+	// 容量
+	setting.Cache = CachePolicy{MaxBytes: 4096}
+	m, err = NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		err = m.Set(Join("big", strconv.Itoa(i)), ToUnit(strings.Repeat("x", 1000), ValueTypeString))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	stats = m.CacheStats()
+	if stats.Bytes > 4096 || stats.Entries >= 10 {
+		t.Fatalf("max bytes error %+v", stats)
+	}
+	_ = m.Close()
+
+	// 写回
+	setting.Cache = CachePolicy{MaxEntries: 3, WriteBack: true, FlushInterval: time.Hour}
+	m, err = NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set("wb", ToUnit("new", ValueTypeString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Delete("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	onDisk := func(key string) *ValueUnit {
+		v := &ValueUnit{}
+		ok, err := m.dbCore.Get(key, v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return nil
+		}
+		return v
+	}
+	if onDisk("wb") != nil || onDisk("1") == nil || m.CacheStats().Dirty != 2 {
+		t.Fatal("write back should not write disk")
+	}
+	v, err := m.Get("1")
+	if err != nil || v != nil {
+		t.Fatal("deleted key still exist")
+	}
+	err = m.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ToBase[string](onDisk("wb")) != "new" || onDisk("1") != nil || m.CacheStats().Dirty != 0 {
+		t.Fatal("flush error")
+	}
+	// 淘汰时落盘
+	for i := 0; i < 5; i++ {
+		err = m.Set(Join("wb", strconv.Itoa(i)), ToUnit(i, ValueTypeInt))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if onDisk("wb.0") == nil {
+		t.Fatal("evicted dirty key not flushed")
+	}
+	err = m.Set("close", ToUnit(1, ValueTypeInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Close()
+	m, err = NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ToBaseF[int](m.Get("close")) != 1 || ToBaseF[int](m.Get("wb.4")) != 4 {
+		t.Fatal("close not flush")
+	}
+	_ = m.Close()
+}
+
+func TestMgrNamespace(t *testing.T) {
+	os.Remove("test18.db")
+	defer os.Remove("test18.db")
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test18.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	news := m.Namespace("news")
+	blog := m.Namespace("blog")
+	for _, n := range []*Namespace{news, blog} {
+		err = n.Set("title", ToUnit(n.Name(), ValueTypeString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = n.Txn(func(b *Batch) error {
+			b.Set("a", ToUnit(1, ValueTypeInt))
+			b.Set("b", ToUnit(2, ValueTypeInt))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = news.Namespace("sub").Set("c", ToUnit(3, ValueTypeInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ToBaseF[string](news.Get("title")) != "news" || ToBaseF[string](blog.Get("title")) != "blog" {
+		t.Fatal("namespace collide")
+	}
+	all, err := blog.GetAll()
+	if err != nil || len(all) != 3 || all["a"] == nil {
+		t.Fatalf("namespace get all error %v", all)
+	}
+	ret, err := news.Scan(ScanOption{Start: "b", Limit: 1})
+	if err != nil || len(ret.Pairs) != 1 || ret.Pairs[0].Key != "b" || ret.Next != "title" {
+		t.Fatalf("namespace scan error %v", ret)
+	}
+
+	// 导出到另一个命名空间
+	var buf bytes.Buffer
+	err = blog.Export(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Namespace("copy").Import(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ToBaseF[int](m.Namespace("copy").Get("b")) != 2 {
+		t.Fatal("namespace import error")
+	}
+
+	watcher := blog.Watch("")
+	defer watcher.Close()
+	err = blog.DeleteAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err = blog.GetAll()
+	if err != nil || len(all) != 0 {
+		t.Fatalf("delete all error %v", all)
+	}
+	e := <-watcher.C
+	if e.Type != WatchEventDelete || strings.HasPrefix(e.Key, "__ns") {
+		t.Fatalf("namespace watch error %v", e)
+	}
+	all, err = news.GetAll()
+	if err != nil || len(all) != 4 || ToBase[int](all[Join("__ns", "sub", "c")]) != 3 {
+		t.Fatalf("delete all affect other namespace %v", all)
+	}
+}
+
+func TestMgrSqliteV2(t *testing.T) {
+	os.Remove("test19.db")
+	defer os.Remove("test19.db")
+	// 按第一版的表结构写入数据
+	db, err := gorm.Open(sqlite.Open("test19.db"), &gorm.Config{Logger: EmptyLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&KeyValueModel{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i0, i1, i2 := 0, 1, 2
+	f1 := float32(1.5)
+	s1, s2, s3 := "s", "a", "b"
+	t1 := `"2024-01-02T03:04:05Z"`
+	rows := []KeyValueModel{
+		{Key: "int", ValueType: int(ValueTypeInt), ValueInt: &i1},
+		{Key: "float", ValueType: int(ValueTypeFloat), ValueFloat: &f1},
+		{Key: "str", ValueType: int(ValueTypeString), ValueString: &s1, ExpireAt: 1},
+		{Key: "time", ValueType: int(ValueTypeTime), ValueString: &t1},
+		{Key: "slice", ValueType: int(ValueTypeSliceString), ValueInt: &i2},
+		{Key: "slice[0]", ValueType: int(ValueTypeString), ValueString: &s2},
+		{Key: "slice[1]", ValueType: int(ValueTypeString), ValueString: &s3},
+		{Key: "emptySlice", ValueType: int(ValueTypeSliceInt), ValueInt: &i0},
+	}
+	err = db.Create(&rows).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, _ := db.DB()
+	_ = sqlDB.Close()
+
+	core, err := NewSqliteCore("test19.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := core.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 6 || ToBase[int](all["int"]) != 1 || ToBase[float32](all["float"]) != 1.5 ||
+		ToBase[string](all["str"]) != "s" || all["str"].ExpireAt != 1 ||
+		!ToBase[time.Time](all["time"]).Equal(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)) ||
+		strings.Join(ToBase[[]string](all["slice"]), ",") != "a,b" ||
+		all["emptySlice"] == nil || all["emptySlice"].Type != ValueTypeSliceInt || len(ToBase[[]int](all["emptySlice"])) != 0 {
+		t.Fatalf("migrate error %v", all)
+	}
+	if core.db.Migrator().HasTable(&KeyValueModel{}) {
+		t.Fatal("v1 table should be dropped")
+	}
+
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test19.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]*ValueUnit{
+		"empty":    ToUnit([]int{}, ValueTypeSliceInt),
+		"key[0]":   ToUnit("[] is allowed", ValueTypeString),
+		"int64":    ToUnit(int64(1)<<62+1, ValueTypeInt64),
+		"float64":  ToUnit(0.1+0.2, ValueTypeFloat64),
+		"bools":    ToUnit([]bool{true, false}, ValueTypeSliceBool),
+		"floats":   ToUnit([]float32{0.5, 1.25}, ValueTypeSliceFloat),
+		"map":      ToUnit(map[string]int{"a": 1}, ValueTypeMapInt),
+		"boolTrue": ToUnit(true, ValueTypeBool),
+	}
+	for k, v := range values {
+		err = m.Set(k, v)
+		if err != nil {
+			t.Fatalf("set %s error %v", k, err)
+		}
+	}
+	for k, v := range values {
+		got, err := m.Get(k)
+		if err != nil || got == nil || got.Type != v.Type || !Compare(got, v) {
+			t.Fatalf("get %s error %v %v", k, got, err)
+		}
+	}
+	if ToBase[float64](values["float64"]) != 0.1+0.2 {
+		t.Fatal("float64 precision lost")
+	}
+	if !errors.Is(m.Set("int", ToUnit("1", ValueTypeString)), ErrValueTypeNotMatch) {
+		t.Fatal("type of existing key should not change")
+	}
+	// 重新打开时不会再次迁移
+	core, err = NewSqliteCore("test19.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err = core.GetAll()
+	if err != nil || len(all) != 6+len(values) {
+		t.Fatalf("reopen error %d %v", len(all), err)
+	}
+	pairs, err := m.GetByPrefix("key")
+	if err != nil || len(pairs) != 1 || pairs[0].Key != "key[0]" {
+		t.Fatal("scan should include key with []")
+	}
+}
+
+// newD1StandIn 在本地模拟cloudflare d1的http api，数据存放在内存中的sqlite
+func newD1StandIn(t *testing.T) *httptest.Server {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 内存数据库每个连接都是独立的
+	db.SetMaxOpenConns(1)
+	reply := func(w http.ResponseWriter, result *d1.D1RespQueryResult, err error) {
+		resp := d1.D1Resp{Success: err == nil}
+		if err != nil {
+			resp.Errors = []d1.D1RespError{{Code: 7500, Message: err.Error()}}
+		} else if result != nil {
+			resp.Result = []*d1.D1RespQueryResult{result}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/tokens/verify") {
+			reply(w, nil, nil)
+			return
+		}
+		if !strings.HasSuffix(r.URL.Path, "/raw") || r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var stmt d1.ParameterizedStatement
+		err := json.NewDecoder(r.Body).Decode(&stmt)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		result := &d1.D1RespQueryResult{}
+		upper := strings.ToUpper(strings.TrimSpace(stmt.SQL))
+		if !strings.HasPrefix(upper, "SELECT") && !strings.HasPrefix(upper, "PRAGMA") {
+			res, err := db.Exec(stmt.SQL, stmt.Params...)
+			if err != nil {
+				reply(w, nil, err)
+				return
+			}
+			result.Meta.Changes, _ = res.RowsAffected()
+			result.Meta.LastRowID, _ = res.LastInsertId()
+			reply(w, result, nil)
+			return
+		}
+		rows, err := db.Query(stmt.SQL, stmt.Params...)
+		if err != nil {
+			reply(w, nil, err)
+			return
+		}
+		defer rows.Close()
+		result.Results.Columns, _ = rows.Columns()
+		result.Results.Rows = make([][]interface{}, 0)
+		for rows.Next() {
+			row := make([]interface{}, len(result.Results.Columns))
+			ptrs := make([]interface{}, len(row))
+			for i := range row {
+				ptrs[i] = &row[i]
+			}
+			err = rows.Scan(ptrs...)
+			if err != nil {
+				reply(w, nil, err)
+				return
+			}
+			for i, v := range row {
+				if b, ok := v.([]byte); ok {
+					row[i] = string(b)
+				}
+			}
+			result.Results.Rows = append(result.Results.Rows, row)
+		}
+		reply(w, result, rows.Err())
+	}))
+	t.Cleanup(func() {
+		srv.Close()
+		_ = db.Close()
+	})
+	return srv
+}
+
+func testGormStorage(t *testing.T, setting XStorageSetting) {
+	m, err := NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]*ValueUnit{
+		"str":    ToUnit("s", ValueTypeString),
+		"int":    ToUnit(1, ValueTypeInt),
+		"int64":  ToUnit(int64(1)<<40, ValueTypeInt64),
+		"float":  ToUnit(float32(1.5), ValueTypeFloat),
+		"f64":    ToUnit(0.1+0.2, ValueTypeFloat64),
+		"bool":   ToUnit(true, ValueTypeBool),
+		"time":   ToUnit(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), ValueTypeTime),
+		"map":    ToUnit(map[string]string{"a": "b"}, ValueTypeMapString),
+		"ints":   ToUnit([]int{1, 2}, ValueTypeSliceInt),
+		"empty":  ToUnit([]string{}, ValueTypeSliceString),
+		"key[0]": ToUnit("[] is allowed", ValueTypeString),
+	}
+	for k, v := range values {
+		err = m.Set(k, v)
+		if err != nil {
+			t.Fatalf("set %s error %v", k, err)
+		}
+	}
+	for k, v := range values {
+		got, err := m.Get(k)
+		if err != nil || got == nil || got.Type != v.Type || !Compare(got, v) {
+			t.Fatalf("get %s error %v %v", k, got, err)
+		}
+	}
+	// 覆盖写入
+	err = m.Set("str", ToUnit("s2", ValueTypeString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := m.Get("str")
+	if err != nil || ToBase[string](got) != "s2" {
+		t.Fatalf("overwrite error %v %v", got, err)
+	}
+	if !errors.Is(m.Set("int", ToUnit("1", ValueTypeString)), ErrValueTypeNotMatch) {
+		t.Fatal("type of existing key should not change")
+	}
+	pairs, err := m.GetByPrefix("key")
+	if err != nil || len(pairs) != 1 || pairs[0].Key != "key[0]" {
+		t.Fatalf("scan error %v %v", pairs, err)
+	}
+	b := m.NewBatch()
+	b.Delete("int")
+	b.Set("batch", ToUnit(2, ValueTypeInt))
+	err = b.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = m.Get("int")
+	if err != nil || got != nil {
+		t.Fatal("batch delete error")
+	}
+	n, err := m.Incr("batch", ToUnit(3, ValueTypeInt))
+	if err != nil || ToBase[int](n) != 5 {
+		t.Fatalf("incr error %v %v", n, err)
+	}
+	err = m.SetWithTTL("ttl", ToUnit("x", ValueTypeString), time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	err = m.PurgeExpired()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := m.dbCore.GetAll()
+	if err != nil || len(all) != len(values) {
+		t.Fatalf("get all error %d %v", len(all), err)
+	}
+	err = m.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMgrGorm(t *testing.T) {
+	os.Remove("test20.db")
+	defer os.Remove("test20.db")
+	t.Run("sqlite", func(t *testing.T) {
+		testGormStorage(t, XStorageSetting{
+			Property:  misc.CreateProperty(MultiSafe, UseDisk),
+			SaveType:  GormDB,
+			Dialector: sqlite.Open("test20.db"),
+		})
+	})
+	t.Run("d1", func(t *testing.T) {
+		srv := newD1StandIn(t)
+		dsn := "d1://account:token@00000000-0000-0000-0000-000000000000?endpoint=" + srv.URL + "/client/v4"
+		testGormStorage(t, XStorageSetting{
+			Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk),
+			SaveType: GormDB,
+			DBAddr:   dsn,
+		})
+		// 已经存在的表不会重复创建，数据依然可以读取
+		core, err := NewGormCore(gormd1.Open(dsn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		unit := &ValueUnit{}
+		ok, err := core.Get("map", unit)
+		if err != nil || !ok || ToBase[map[string]string](unit)["a"] != "b" {
+			t.Fatalf("reopen error %v %v", unit, err)
+		}
+	})
+	_, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(UseDisk),
+		SaveType: GormDB,
+		DBAddr:   "nodriver://x",
+	})
+	if !errors.Is(err, ErrGormDriverNotFound) {
+		t.Fatalf("unknown driver should fail %v", err)
+	}
+}
+
+func TestMgrEncrypt(t *testing.T) {
+	os.Remove("test21.db")
+	defer os.Remove("test21.db")
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210fedcba9876543210")
+	// 加密开启前的明文
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test21.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set("push.count", ToUnit(1, ValueTypeInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Close()
+
+	ring, err := NewKeyRing("k1", key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting := XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test21.db",
+		Encrypt:  &EncryptSetting{Provider: ring, Prefixes: []string{"push."}},
+	}
+	m, err = NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set("push.dingding.secret", ToUnit("ding-secret", ValueTypeString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.SetEncrypted("deer", ToUnit([]string{"deer-token"}, ValueTypeSliceString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Set("plain", ToUnit("visible", ValueTypeString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Close()
+
+	raw, err := NewSqliteCore("test21.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawAll, err := raw.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"push.dingding.secret", "deer"} {
+		id, _, _, ok := envelope(rawAll[k])
+		if !ok || id != "k1" || strings.Contains(ToBase[string](rawAll[k]), "secret") || strings.Contains(ToBase[string](rawAll[k]), "token") {
+			t.Fatalf("%s should be encrypted %v", k, rawAll[k])
+		}
+	}
+	if ToBase[string](rawAll["plain"]) != "visible" || rawAll["push.count"].Type != ValueTypeInt {
+		t.Fatal("other keys should not change")
+	}
+	// 同一个值每次加密的结果不同，并且不能挪到其他key下
+	crypt, _ := newCryptLayer(*setting.Encrypt)
+	a, _ := crypt.encrypt("x", ToUnit("same", ValueTypeString))
+	b, _ := crypt.encrypt("x", ToUnit("same", ValueTypeString))
+	if ToBase[string](a) == ToBase[string](b) {
+		t.Fatal("ciphertext should be random")
+	}
+	_, err = crypt.decrypt("y", a)
+	if !errors.Is(err, ErrCryptMacNotMatch) {
+		t.Fatalf("moved ciphertext should fail %v", err)
+	}
+
+	m, err = NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := m.Get("push.dingding.secret")
+	if err != nil || ToBase[string](v) != "ding-secret" {
+		t.Fatalf("decrypt error %v %v", v, err)
+	}
+	// 重启后SetEncrypted的标记依然有效，没有读取过也会加密
+	err = m.Set("deer", ToUnit([]string{"deer-token2"}, ValueTypeSliceString))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawDeer := &ValueUnit{}
+	_, err = raw.Get("deer", rawDeer)
+	if id, _, _, ok := envelope(rawDeer); err != nil || !ok || id != "k1" {
+		t.Fatalf("marked key should be encrypted after restart %v %v", rawDeer, err)
+	}
+	v, err = m.Get("deer")
+	if err != nil || ToBase[[]string](v)[0] != "deer-token2" {
+		t.Fatalf("decrypt error %v %v", v, err)
+	}
+	pairs, err := m.GetByPrefix("push.")
+	if err != nil || len(pairs) != 2 {
+		t.Fatalf("scan error %v %v", pairs, err)
+	}
+	all, err := m.GetAll()
+	if err != nil || len(all) != 4 {
+		t.Fatalf("marks should be hidden %v %v", all, err)
+	}
+
+	// 轮换：加入新密钥，重新加密所有值，包括加密开启前的明文
+	err = ring.AddKey("k2", key2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ring.SetCurrent("k2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := m.RotateKey()
+	if err != nil || n != 3 {
+		t.Fatalf("rotate error %d %v", n, err)
+	}
+	err = ring.RemoveKey("k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(ring.RemoveKey("k2"), ErrCryptKeyInUse) {
+		t.Fatal("current key should not be removed")
+	}
+	rawAll, err = raw.GetAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"push.dingding.secret", "deer", "push.count"} {
+		id, _, _, ok := envelope(rawAll[k])
+		if !ok || id != "k2" {
+			t.Fatalf("%s should be encrypted with k2 %v", k, rawAll[k])
+		}
+	}
+	_ = m.Close()
+	m, err = NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err = m.Get("deer")
+	if err != nil || ToBase[[]string](v)[0] != "deer-token2" {
+		t.Fatalf("decrypt after rotate error %v %v", v, err)
+	}
+	v, err = m.Incr("push.count", ToUnit(1, ValueTypeInt))
+	if err != nil || ToBase[int](v) != 2 {
+		t.Fatalf("incr encrypted error %v %v", v, err)
+	}
+	if !errors.Is(m.Set("push.count", ToUnit("2", ValueTypeString)), ErrValueTypeNotMatch) {
+		t.Fatal("type of encrypted key should not change")
+	}
+	_ = m.Close()
+
+	// 没有密钥时无法读取
+	other, _ := NewKeyRing("k1", key1)
+	setting.Encrypt = &EncryptSetting{Provider: other, Prefixes: []string{"push."}}
+	m, err = NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = m.Get("deer")
+	if !errors.Is(err, ErrCryptKeyNotFound) {
+		t.Fatalf("missing key should fail %v", err)
+	}
+	_ = m.Close()
+
+	t.Run("toml", func(t *testing.T) {
+		os.Remove("test21.toml")
+		defer os.Remove("test21.toml")
+		defer os.Remove("test21.toml.lock")
+		ring, _ := NewKeyRing("k1", key1)
+		setting := XStorageSetting{
+			Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk, FullInitLoad),
+			SaveType: Toml,
+			FileAddr: "test21.toml",
+			Encrypt:  &EncryptSetting{Provider: ring, Prefixes: []string{"push."}},
+		}
+		m, err := NewXStorage(setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.Set("push.token", ToUnit("toml-secret", ValueTypeString))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := os.ReadFile("test21.toml")
+		if bytes.Contains(b, []byte("toml-secret")) || !bytes.Contains(b, []byte(cryptPrefix+"k1")) {
+			t.Fatalf("toml should be encrypted %s", b)
+		}
+		_ = ring.AddKey("k2", key2)
+		_ = ring.SetCurrent("k2")
+		n, err := m.RotateKey()
+		if err != nil || n != 1 {
+			t.Fatalf("rotate error %d %v", n, err)
+		}
+		_ = ring.RemoveKey("k1")
+		m, err = NewXStorage(setting)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v, err := m.Get("push.token")
+		if err != nil || ToBase[string](v) != "toml-secret" {
+			t.Fatalf("toml decrypt error %v %v", v, err)
+		}
+	})
+
+	t.Run("cache only", func(t *testing.T) {
+		ring, _ := NewKeyRing("k1", key1)
+		m, err := NewXStorage(XStorageSetting{
+			Property: misc.CreateProperty(MultiSafe, UseCache),
+			Encrypt:  &EncryptSetting{Provider: ring},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = m.RotateKey()
+		if !errors.Is(err, ErrEncryptNotEnabled) {
+			t.Fatalf("rotate without disk should fail %v", err)
+		}
+	})
+}
+
+func TestMgrObserver(t *testing.T) {
+	os.Remove("test22.db")
+	defer os.Remove("test22.db")
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk),
+		SaveType: SqlLiteDB,
+		DBAddr:   "test22.db",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metrics := NewMetrics()
+	remove := m.AddObserver(metrics)
+	var logs []string
+	var logLock sync.Mutex
+	logSetting := xlog.DefaultSetting()
+	logSetting.LogAddr = t.TempDir()
+	logSetting.IfFile = false
+	logSetting.Printer = func(string) bool { return true }
+	logSetting.OnLog = func(s string) {
+		logLock.Lock()
+		defer logLock.Unlock()
+		logs = append(logs, s)
+	}
+	log, err := xlog.NewXLog(logSetting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 阈值为0时所有操作都是慢操作
+	removeSlow := m.AddObserver(NewSlowOpLog(log, "STORAGE", 0))
+
+	err = m.Set("a", ToUnit(1, ValueTypeInt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = m.Get("a")
+	_, _ = m.Get("none")
+	_ = m.Delete("a")
+	_ = m.Set("", ToUnit(1, ValueTypeInt))
+	removeSlow()
+	_, _ = m.Get("a")
+
+	got := make(map[string]MetricSeries)
+	for _, s := range metrics.Snapshot() {
+		got[s.Op.String()+"/"+s.Source.String()] = s
+	}
+	if got["get/cache"].Count != 1 || got["get/cache"].Misses != 0 {
+		t.Fatalf("cache hit error %+v", got["get/cache"])
+	}
+	// 没有缓存的key与已经删除的key会读取磁盘
+	if got["get/disk"].Count != 2 || got["get/disk"].Misses != 2 {
+		t.Fatalf("disk miss error %+v", got["get/disk"])
+	}
+	if got["set/disk"].Count != 2 || got["set/disk"].Errors != 1 || got["delete/disk"].Count != 1 {
+		t.Fatalf("write error %+v", got)
+	}
+	s := got["set/disk"]
+	if s.Counts[len(s.Counts)-1] > s.Count || s.Sum <= 0 {
+		t.Fatalf("histogram error %+v", s)
+	}
+	logLock.Lock()
+	if len(logs) != 5 || !strings.Contains(logs[0], "slow set a on disk") || !strings.Contains(logs[4], "failed") {
+		t.Fatalf("slow log error %q", logs)
+	}
+	logLock.Unlock()
+
+	// 异步写入、批量写入、原子操作与过期清理同样会记录
+	writes := NewMetrics()
+	removeWrites := m.AddObserver(writes)
+	err, c := m.SetAsync("async", ToUnit(1, ValueTypeInt))
+	if err != nil || <-c != nil {
+		t.Fatal("set async error")
+	}
+	_ = m.SetBatch(map[string]*ValueUnit{"b1": ToUnit(1, ValueTypeInt), "b2": ToUnit(2, ValueTypeInt)})
+	_ = m.DeleteBatch("b1")
+	_, _ = m.CompareAndSwap("b2", ToUnit(0, ValueTypeInt), ToUnit(3, ValueTypeInt))
+	_, _ = m.CompareAndSwap("b2", ToUnit(2, ValueTypeInt), ToUnit(3, ValueTypeInt))
+	_, _ = m.Incr("b2", ToUnit(1, ValueTypeInt))
+	_, _ = m.Append("list", ToUnit([]int{1}, ValueTypeSliceInt))
+	_ = m.SetWithTTL("ttl", ToUnit(1, ValueTypeInt), time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	_ = m.PurgeExpired()
+	removeWrites()
+	got = make(map[string]MetricSeries)
+	for _, s := range writes.Snapshot() {
+		got[s.Op.String()+"/"+s.Source.String()] = s
+	}
+	// 不匹配的CompareAndSwap没有写入，不记录
+	if got["set/disk"].Count != 7 || got["set/disk"].Errors != 0 || got["delete/disk"].Count != 2 {
+		t.Fatalf("write paths error %+v", got)
+	}
+
+	total := func() uint64 {
+		var n uint64
+		for _, s := range metrics.Snapshot() {
+			n += s.Count
+		}
+		return n
+	}
+	before := total()
+	remove()
+	_, _ = m.Get("a")
+	if total() != before {
+		t.Fatal("removed observer should not be called")
+	}
+}
+
+func TestMgrTomlShare(t *testing.T) {
+	os.Remove("test23.toml")
+	defer os.Remove("test23.toml")
+	defer os.Remove("test23.toml.lock")
+	conflicts := make(chan []FileConflict, 1)
+	setting := XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache, UseDisk, FullInitLoad),
+		SaveType: Toml,
+		FileAddr: "test23.toml",
+	}
+	_, err := NewXStorage(XStorageSetting{
+		Property:          misc.CreateProperty(UseCache, UseDisk, FullInitLoad),
+		SaveType:          Toml,
+		FileAddr:          "test23.toml",
+		FileWatchInterval: time.Millisecond,
+	})
+	if !errors.Is(err, ErrFileWatchNeedMultiSafe) {
+		t.Fatalf("file watch without MultiSafe should fail %v", err)
+	}
+	a, err := NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setting.OnFileConflict = func(c []FileConflict) {
+		conflicts <- c
+	}
+	b, err := NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 两个实例的写入不会互相覆盖，写入时顺便读到对方的修改
+	_ = a.Set("x", ToUnit(1, ValueTypeInt))
+	_ = b.Set("y", ToUnit(2, ValueTypeInt))
+	v, _ := b.Get("x")
+	if v == nil || ToBase[int](v) != 1 {
+		t.Fatalf("b should see x %v", v)
+	}
+	if v, _ = a.Get("y"); v != nil {
+		t.Fatalf("a should not see y before reload %v", v)
+	}
+	err = a.ReloadFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ = a.Get("y"); v == nil || ToBase[int](v) != 2 {
+		t.Fatalf("a should see y after reload %v", v)
+	}
+
+	// 同时修改同一个key时后写入的为准，并报告冲突
+	_ = a.Set("z", ToUnit("a", ValueTypeString))
+	_ = b.Set("z", ToUnit("b", ValueTypeString))
+	select {
+	case c := <-conflicts:
+		if len(c) != 1 || c[0].Key != "z" || ToBase[string](c[0].Local) != "b" || ToBase[string](c[0].External) != "a" {
+			t.Fatalf("conflict error %+v", c)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("conflict not reported")
+	}
+	_ = a.ReloadFile()
+	if v, _ = a.Get("z"); v == nil || ToBase[string](v) != "b" {
+		t.Fatalf("a should see z from b %v", v)
+	}
+
+	// 异步写入时合并的外部修改在锁内应用到缓存，与同步写入并发也不会冲突
+	var asyncChans []chan error
+	for i := 0; i < 20; i++ {
+		_ = b.Set("w", ToUnit(i+10, ValueTypeInt))
+		err, c := a.SetAsync(Join("async", strconv.Itoa(i)), ToUnit(i+10, ValueTypeInt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		asyncChans = append(asyncChans, c)
+		_ = a.Set("sync", ToUnit(i+10, ValueTypeInt))
+	}
+	for _, c := range asyncChans {
+		if err = <-c; err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = a.ReloadFile()
+	if v, _ = a.Get("w"); v == nil || ToBase[int](v) != 29 {
+		t.Fatalf("a should see w after async save %v", v)
+	}
+	_ = a.Close()
+	_ = b.Close()
+
+	// 手动编辑文件后后台自动重新读取
+	setting.FileWatchInterval = time.Millisecond * 5
+	setting.OnFileConflict = nil
+	c, err := NewXStorage(setting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	w := c.Watch("x")
+	defer w.Close()
+	b2, _ := os.ReadFile("test23.toml")
+	b2 = bytes.Replace(b2, []byte("Data = 1\n"), []byte("Data = 100\n"), 1)
+	err = os.WriteFile("test23.toml", b2, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case e := <-w.C:
+		if e.Type != WatchEventSet || ToBase[int](e.NewValue) != 100 || ToBase[int](e.OldValue) != 1 {
+			t.Fatalf("watch event error %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hand edit not reloaded")
+	}
+	if v, _ = c.Get("x"); v == nil || ToBase[int](v) != 100 {
+		t.Fatalf("x should be reloaded %v", v)
+	}
+	if v, _ = c.Get("y"); v == nil || ToBase[int](v) != 2 {
+		t.Fatalf("y should not change %v", v)
+	}
+}
+
+func TestMgrBindLogLevel(t *testing.T) {
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logSetting := xlog.DefaultSetting()
+	logSetting.LogAddr = t.TempDir()
+	logSetting.IfFile = false
+	logSetting.Printer = func(string) bool { return true }
+	log, err := xlog.NewXLog(logSetting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = m.Set("log.level.NEWS", ToUnit("debug", ValueTypeString))
+	cancel, err := m.BindLogLevel(log, "log.level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel()
+	if log.Levels()["NEWS"] != xlog.LogLevelDebug {
+		t.Fatalf("existing level not loaded %v", log.Levels())
+	}
+	wait := func(ok func(map[string]xlog.LogLevel) bool) {
+		deadline := time.Now().Add(time.Second)
+		for !ok(log.Levels()) {
+			if time.Now().After(deadline) {
+				t.Fatalf("level not applied %v", log.Levels())
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	_ = m.Set("log.level.STORAGE", ToUnit("WARNING", ValueTypeString))
+	wait(func(l map[string]xlog.LogLevel) bool {
+		level, ok := l["STORAGE"]
+		return ok && level == xlog.LogLevelWarning
+	})
+	_ = m.Delete("log.level.NEWS")
+	wait(func(l map[string]xlog.LogLevel) bool {
+		_, ok := l["NEWS"]
+		return !ok
+	})
+
+	// 绑定时的读取与同时发生的修改，最终以最后一次修改为准
+	log2, err := xlog.NewXLog(logSetting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			level := "INFO"
+			if i%2 == 0 {
+				level = "DEBUG"
+			}
+			_ = m.Set("log.level.HOT", ToUnit(level, ValueTypeString))
+		}
+		_ = m.Set("log.level.HOT", ToUnit("ERROR", ValueTypeString))
+	}()
+	cancel2, err := m.BindLogLevel(log2, "log.level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancel2()
+	<-done
+	deadline := time.Now().Add(time.Second)
+	for log2.Levels()["HOT"] != xlog.LogLevelError {
+		if time.Now().After(deadline) {
+			t.Fatalf("last level not applied %v", log2.Levels())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(time.Millisecond * 20)
+	if log2.Levels()["HOT"] != xlog.LogLevelError {
+		t.Fatalf("stale level applied %v", log2.Levels())
+	}
+}
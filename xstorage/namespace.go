@@ -0,0 +1,187 @@
+package xstorage
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+// 命名空间中的key在存储中的实际前缀为 __ns.<name>.
+const namespacePrefix = "__ns"
+
+/*
+Namespace 存储的一个命名空间视图，多个模块共用同一个存储时用于隔离key。
+命名空间中的key会被加上固定的前缀后存入同一个存储，所以可以用于所有类型的存储，读取时会去掉前缀。
+命名空间可以嵌套，Namespace("")代表整个存储。
+例如
+
+	news := storage.Namespace("news")
+	err := news.Set("keyword", ToUnit("go", ValueTypeString)) // 实际存储的key为 __ns.news.keyword
+*/
+type Namespace struct {
+	storage *XStorage
+	name    string
+	prefix  string
+}
+
+// Namespace 返回name对应的命名空间视图，name为空时返回整个存储
+func (m *XStorage) Namespace(name string) *Namespace {
+	n := &Namespace{
+		storage: m,
+		name:    name,
+	}
+	if name != "" {
+		n.prefix = Join(namespacePrefix, name, "")
+	}
+	return n
+}
+
+// Namespace 返回嵌套的命名空间
+func (n *Namespace) Namespace(name string) *Namespace {
+	if name == "" {
+		return n
+	}
+	return &Namespace{
+		storage: n.storage,
+		name:    Join(n.name, name),
+		prefix:  n.prefix + Join(namespacePrefix, name, ""),
+	}
+}
+
+func (n *Namespace) Name() string {
+	return n.name
+}
+
+// Key 返回key在存储中实际的key
+func (n *Namespace) Key(key string) string {
+	if key == "" {
+		return ""
+	}
+	return n.prefix + key
+}
+
+func (n *Namespace) Get(key string) (*ValueUnit, error) {
+	return n.storage.Get(n.Key(key))
+}
+
+func (n *Namespace) GetHP(key string, valueUnit *ValueUnit) (bool, error) {
+	return n.storage.GetHP(n.Key(key), valueUnit)
+}
+
+func (n *Namespace) Set(key string, value *ValueUnit) error {
+	return n.storage.Set(n.Key(key), value)
+}
+
+func (n *Namespace) SetWithTTL(key string, value *ValueUnit, ttl time.Duration) error {
+	return n.storage.SetWithTTL(n.Key(key), value, ttl)
+}
+
+func (n *Namespace) Delete(key string) error {
+	return n.storage.Delete(n.Key(key))
+}
+
+func (n *Namespace) CompareAndSwap(key string, old *ValueUnit, newValue *ValueUnit) (bool, error) {
+	return n.storage.CompareAndSwap(n.Key(key), old, newValue)
+}
+
+func (n *Namespace) Incr(key string, delta *ValueUnit) (*ValueUnit, error) {
+	return n.storage.Incr(n.Key(key), delta)
+}
+
+func (n *Namespace) Append(key string, values *ValueUnit) (*ValueUnit, error) {
+	return n.storage.Append(n.Key(key), values)
+}
+
+// Scan 在命名空间内进行范围查询，返回的key不含命名空间前缀
+func (n *Namespace) Scan(option ScanOption) (*ScanResult, error) {
+	if n.prefix == "" {
+		return n.storage.Scan(option)
+	}
+	option.Prefix = n.prefix + option.Prefix
+	if option.Start != "" {
+		option.Start = n.prefix + option.Start
+	}
+	if option.End != "" {
+		option.End = n.prefix + option.End
+	}
+	ret, err := n.storage.Scan(option)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ret.Pairs {
+		ret.Pairs[i].Key = strings.TrimPrefix(ret.Pairs[i].Key, n.prefix)
+	}
+	ret.Next = strings.TrimPrefix(ret.Next, n.prefix)
+	return ret, nil
+}
+
+func (n *Namespace) GetByPrefix(prefix string) ([]KVPair, error) {
+	ret, err := n.Scan(ScanOption{Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	return ret.Pairs, nil
+}
+
+// GetAll 返回命名空间中的所有数据，key不含命名空间前缀
+func (n *Namespace) GetAll() (map[string]*ValueUnit, error) {
+	if n.prefix == "" {
+		return n.storage.GetAll()
+	}
+	pairs, err := n.GetByPrefix("")
+	if err != nil {
+		return nil, errors.Join(ErrGetAllValue, err)
+	}
+	ret := make(map[string]*ValueUnit, len(pairs))
+	for _, pair := range pairs {
+		ret[pair.Key] = pair.Value
+	}
+	return ret, nil
+}
+
+// DeleteAll 原子的删除命名空间中的所有数据，包括嵌套的命名空间
+func (n *Namespace) DeleteAll() error {
+	pairs, err := n.storage.GetByPrefix(n.prefix)
+	if err != nil {
+		return errors.Join(ErrDeleteValue, err)
+	}
+	keys := make([]string, 0, len(pairs))
+	for _, pair := range pairs {
+		keys = append(keys, pair.Key)
+	}
+	return n.storage.DeleteBatch(keys...)
+}
+
+// NewBatch 返回的Batch中的key都在命名空间中
+func (n *Namespace) NewBatch() *Batch {
+	return &Batch{storage: n.storage, prefix: n.prefix}
+}
+
+func (n *Namespace) Txn(fn func(b *Batch) error) error {
+	b := n.NewBatch()
+	err := fn(b)
+	if err != nil {
+		return err
+	}
+	return b.Commit()
+}
+
+// Export 导出命名空间中的数据，导出的key不含命名空间前缀，可以导入到其他命名空间
+func (n *Namespace) Export(w io.Writer) error {
+	pairs, err := n.GetByPrefix("")
+	if err != nil {
+		return errors.Join(ErrExport, err)
+	}
+	return exportPairs(w, pairs)
+}
+
+// Import 将Export导出的数据导入到命名空间中
+func (n *Namespace) Import(r io.Reader) error {
+	return n.storage.importWithPrefix(r, n.prefix)
+}
+
+// Watch 监听命名空间中以prefix开头的key，事件中的key不含命名空间前缀
+func (n *Namespace) Watch(prefix string) *Watcher {
+	return n.storage.watchHub.add(n.prefix+prefix, len(n.prefix))
+}
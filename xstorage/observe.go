@@ -0,0 +1,327 @@
+package xstorage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intmian/mian_go_lib/tool/misc"
+	"github.com/intmian/mian_go_lib/xlog"
+)
+
+type OpType int
+
+const (
+	OpGet OpType = iota
+	OpSet
+	OpDelete
+)
+
+func (o OpType) String() string {
+	switch o {
+	case OpGet:
+		return "get"
+	case OpSet:
+		return "set"
+	case OpDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
+// OpSource 操作实际落在哪一层，读取时命中缓存为cache，否则为disk；写入时同步落盘为disk，只写缓存（包括写回缓存）为cache
+type OpSource int
+
+const (
+	OpSourceCache OpSource = iota
+	OpSourceDisk
+)
+
+func (s OpSource) String() string {
+	if s == OpSourceDisk {
+		return "disk"
+	}
+	return "cache"
+}
+
+// OpEvent 一次Get、Set或Delete的结果。
+// 批量写入、原子操作与过期清理同样会按涉及的每个key发送Set或Delete事件，批量写入中的事件共用开始时间与耗时
+type OpEvent struct {
+	Op       OpType
+	Source   OpSource
+	Key      string
+	Start    time.Time
+	Duration time.Duration
+	Found    bool // 只对Get有效，是否读取到了值
+	Err      error
+}
+
+// IObserver 在每次操作结束后同步调用，实现需要并发安全并且尽量快，耗时的处理应异步进行
+type IObserver interface {
+	OnOp(event OpEvent)
+}
+
+// ObserverFunc 将函数转换为IObserver
+type ObserverFunc func(event OpEvent)
+
+func (f ObserverFunc) OnOp(event OpEvent) {
+	f(event)
+}
+
+type observerHub struct {
+	lock      sync.RWMutex
+	observers map[uint64]IObserver
+	nextID    uint64
+	count     atomic.Int32 // 没有观察者时跳过计时
+}
+
+func (h *observerHub) add(o IObserver) func() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.observers == nil {
+		h.observers = make(map[uint64]IObserver)
+	}
+	h.nextID++
+	id := h.nextID
+	h.observers[id] = o
+	h.count.Add(1)
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			h.lock.Lock()
+			defer h.lock.Unlock()
+			delete(h.observers, id)
+			h.count.Add(-1)
+		})
+	}
+}
+
+func (h *observerHub) has() bool {
+	return h.count.Load() > 0
+}
+
+func (h *observerHub) publish(event OpEvent) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, o := range h.observers {
+		o.OnOp(event)
+	}
+}
+
+// AddObserver 添加一个观察者，返回用于移除的函数
+func (m *XStorage) AddObserver(o IObserver) func() {
+	return m.observers.add(o)
+}
+
+// writeSource 写入与删除落在哪一层
+func (m *XStorage) writeSource() OpSource {
+	if misc.HasProperty(m.setting.Property, UseDisk) && !m.writeBack() {
+		return OpSourceDisk
+	}
+	return OpSourceCache
+}
+
+// directSource 批量写入、原子操作与过期清理不经过写回缓存，开启UseDisk时直接落盘
+func (m *XStorage) directSource() OpSource {
+	if misc.HasProperty(m.setting.Property, UseDisk) {
+		return OpSourceDisk
+	}
+	return OpSourceCache
+}
+
+// publishOps 为一批操作中的每个key发送事件
+func (m *XStorage) publishOps(ops []BatchOp, source OpSource, start time.Time, err error) {
+	d := time.Since(start)
+	for _, op := range ops {
+		t := OpSet
+		if op.Type == BatchOpDelete {
+			t = OpDelete
+		}
+		m.observers.publish(OpEvent{Op: t, Source: source, Key: op.Key, Start: start, Duration: d, Err: err})
+	}
+}
+
+// DefaultMetricsBuckets 默认的耗时分布的上界
+var DefaultMetricsBuckets = []time.Duration{
+	10 * time.Microsecond,
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+type metricKey struct {
+	Op     OpType
+	Source OpSource
+}
+
+// MetricSeries 一种操作在一层上的统计
+type MetricSeries struct {
+	Op      OpType
+	Source  OpSource
+	Count   uint64
+	Errors  uint64
+	Misses  uint64          // 没有读取到值的Get
+	Sum     time.Duration   // 总耗时
+	Buckets []time.Duration // 耗时分布的上界
+	Counts  []uint64        // 耗时不超过对应上界的次数，累计值
+	Max     time.Duration   // 最大耗时
+}
+
+// Metrics 内置的IObserver，统计各操作的次数、错误与耗时分布
+type Metrics struct {
+	buckets []time.Duration
+	lock    sync.Mutex
+	series  map[metricKey]*MetricSeries
+}
+
+// NewMetrics buckets为耗时分布的上界，为空时使用DefaultMetricsBuckets
+func NewMetrics(buckets ...time.Duration) *Metrics {
+	if len(buckets) == 0 {
+		buckets = DefaultMetricsBuckets
+	}
+	b := append([]time.Duration(nil), buckets...)
+	sort.Slice(b, func(i, j int) bool {
+		return b[i] < b[j]
+	})
+	return &Metrics{
+		buckets: b,
+		series:  make(map[metricKey]*MetricSeries),
+	}
+}
+
+func (m *Metrics) OnOp(event OpEvent) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	k := metricKey{Op: event.Op, Source: event.Source}
+	s, ok := m.series[k]
+	if !ok {
+		s = &MetricSeries{
+			Op:      event.Op,
+			Source:  event.Source,
+			Buckets: m.buckets,
+			Counts:  make([]uint64, len(m.buckets)),
+		}
+		m.series[k] = s
+	}
+	s.Count++
+	if event.Err != nil {
+		s.Errors++
+	} else if event.Op == OpGet && !event.Found {
+		s.Misses++
+	}
+	s.Sum += event.Duration
+	if event.Duration > s.Max {
+		s.Max = event.Duration
+	}
+	for i, b := range m.buckets {
+		if event.Duration <= b {
+			s.Counts[i]++
+		}
+	}
+}
+
+// Snapshot 返回当前统计的副本，按操作与层排序
+func (m *Metrics) Snapshot() []MetricSeries {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ret := make([]MetricSeries, 0, len(m.series))
+	for _, s := range m.series {
+		c := *s
+		c.Counts = append([]uint64(nil), s.Counts...)
+		ret = append(ret, c)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Op != ret[j].Op {
+			return ret[i].Op < ret[j].Op
+		}
+		return ret[i].Source < ret[j].Source
+	})
+	return ret
+}
+
+// WritePrometheus 以prometheus的文本格式输出，只包含操作与层，不包含key
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	all := m.Snapshot()
+	bw := bufio.NewWriter(w)
+	labels := func(s MetricSeries) string {
+		return fmt.Sprintf(`op="%s",source="%s"`, s.Op, s.Source)
+	}
+	seconds := func(d time.Duration) string {
+		return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+	}
+	fmt.Fprintln(bw, "# HELP xstorage_ops_total Number of xstorage operations by result.")
+	fmt.Fprintln(bw, "# TYPE xstorage_ops_total counter")
+	for _, s := range all {
+		fmt.Fprintf(bw, "xstorage_ops_total{%s,result=\"ok\"} %d\n", labels(s), s.Count-s.Errors-s.Misses)
+		fmt.Fprintf(bw, "xstorage_ops_total{%s,result=\"miss\"} %d\n", labels(s), s.Misses)
+		fmt.Fprintf(bw, "xstorage_ops_total{%s,result=\"error\"} %d\n", labels(s), s.Errors)
+	}
+	fmt.Fprintln(bw, "# HELP xstorage_op_duration_seconds Latency of xstorage operations.")
+	fmt.Fprintln(bw, "# TYPE xstorage_op_duration_seconds histogram")
+	for _, s := range all {
+		for i, b := range s.Buckets {
+			fmt.Fprintf(bw, "xstorage_op_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels(s), seconds(b), s.Counts[i])
+		}
+		fmt.Fprintf(bw, "xstorage_op_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels(s), s.Count)
+		fmt.Fprintf(bw, "xstorage_op_duration_seconds_sum{%s} %s\n", labels(s), seconds(s.Sum))
+		fmt.Fprintf(bw, "xstorage_op_duration_seconds_count{%s} %d\n", labels(s), s.Count)
+	}
+	return bw.Flush()
+}
+
+// SlowOpLog 将耗时超过Threshold的操作与失败的操作记录到日志中
+type SlowOpLog struct {
+	Log       *xlog.XLog
+	From      string
+	Threshold time.Duration
+}
+
+func NewSlowOpLog(log *xlog.XLog, from string, threshold time.Duration) *SlowOpLog {
+	return &SlowOpLog{Log: log, From: from, Threshold: threshold}
+}
+
+func (s *SlowOpLog) OnOp(event OpEvent) {
+	if s.Log == nil {
+		return
+	}
+	if event.Err != nil {
+		s.Log.Warning(s.From, "xstorage %s %s on %s failed after %s: %v", event.Op, event.Key, event.Source, event.Duration, event.Err)
+		return
+	}
+	if event.Duration >= s.Threshold {
+		s.Log.Warning(s.From, "xstorage slow %s %s on %s cost %s", event.Op, event.Key, event.Source, event.Duration)
+	}
+}
+
+// RegisterMetrics 设置了WebPackSetting.Metrics时注册/metrics
+func (w *WebPack) RegisterMetrics(r gin.IRouter) {
+	if w.setting.Metrics == nil {
+		return
+	}
+	r.GET("/metrics", w.WebMetrics)
+}
+
+func (w *WebPack) WebMetrics(c *gin.Context) {
+	if !w.IsInitialized() || w.setting.Metrics == nil {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	c.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	c.Status(http.StatusOK)
+	_ = w.setting.Metrics.WritePrometheus(c.Writer)
+}
@@ -0,0 +1,376 @@
+package xstorage
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intmian/mian_go_lib/tool/token"
+)
+
+/*
+REST接口，注册在StartWeb中，也可以通过RegisterRest注册到自己的gin路由上
+	GET    /kv/:key           读取
+	PUT    /kv/:key           写入，body为 {"type":1,"value":"abc","ttl":60}，value为对应类型的json，ttl单位为秒，可省略
+	DELETE /kv/:key           删除
+	GET    /kv?prefix=&start=&limit=  按前缀分页列出，下一页的start为返回的next
+	POST   /kv/batch_get      批量读取，body为 {"keys":["a","b"]}
+	POST   /kv/batch          原子的批量写入，body为 {"ops":[{"op":"set","key":"a","type":1,"value":"abc"},{"op":"delete","key":"b"}]}
+所有接口都可以通过ns参数指定命名空间。
+设置了WebPackSetting.JwtMgr后需要在请求头token中放入token.Data的json，并按PrefixPerms检查权限。
+*/
+
+// PrefixPerm 以Prefix开头的key需要的权限，多条规则都匹配时使用Prefix最长的一条。
+// Prefix是存储中实际的key，所以命名空间中的key需要带上命名空间的前缀，例如 __ns.news.
+type PrefixPerm struct {
+	Prefix string
+	Read   string // 读取需要的权限，为空时只需要有效的token
+	Write  string // 写入、删除需要的权限，为空时只需要有效的token
+}
+
+const (
+	webTokenHeader         = "token"
+	defaultAdminPermission = "xstorage.admin"
+	defaultRestListLimit   = 100
+)
+
+// RegisterRest 注册REST接口
+func (w *WebPack) RegisterRest(r gin.IRouter) {
+	r.GET("/kv/:key", w.RestGet)
+	r.PUT("/kv/:key", w.RestPut)
+	r.DELETE("/kv/:key", w.RestDelete)
+	r.GET("/kv", w.RestList)
+	r.POST("/kv/batch_get", w.RestBatchGet)
+	r.POST("/kv/batch", w.RestBatch)
+}
+
+func (w *WebPack) restFail(c *gin.Context, status int, reason WebFailReason) {
+	c.AbortWithStatusJSON(status, gin.H{
+		"code": WebCodeFail,
+		"msg":  reason,
+	})
+}
+
+func (w *WebPack) restSuc(c *gin.Context, result interface{}) {
+	c.JSON(http.StatusOK, gin.H{
+		"code":   WebCodeSuc,
+		"result": result,
+	})
+}
+
+// parseToken 读取并校验请求中的token，没有设置JwtMgr时返回nil, true
+func (w *WebPack) parseToken(c *gin.Context) (*token.Data, bool) {
+	if w.setting.JwtMgr == nil {
+		return nil, true
+	}
+	s := c.GetHeader(webTokenHeader)
+	if s == "" {
+		return nil, false
+	}
+	data := &token.Data{}
+	err := json.Unmarshal([]byte(s), data)
+	if err != nil {
+		return nil, false
+	}
+	if data.ValidTime < time.Now().Unix() || !w.setting.JwtMgr.CheckToken(data) {
+		return nil, false
+	}
+	return data, true
+}
+
+func hasPermission(data *token.Data, permission string) bool {
+	if permission == "" {
+		return true
+	}
+	for _, p := range data.Permission {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// checkKey 检查token是否有key的读或写权限，没有匹配的规则时拒绝
+func (w *WebPack) checkKey(data *token.Data, key string, write bool) bool {
+	if w.setting.JwtMgr == nil {
+		return true
+	}
+	var rule *PrefixPerm
+	for i, p := range w.setting.PrefixPerms {
+		if strings.HasPrefix(key, p.Prefix) && (rule == nil || len(p.Prefix) > len(rule.Prefix)) {
+			rule = &w.setting.PrefixPerms[i]
+		}
+	}
+	if rule == nil {
+		return false
+	}
+	if write {
+		return hasPermission(data, rule.Write)
+	}
+	return hasPermission(data, rule.Read)
+}
+
+// auth 校验token，失败时直接返回错误
+func (w *WebPack) auth(c *gin.Context) (*token.Data, bool) {
+	if !w.IsInitialized() {
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return nil, false
+	}
+	data, ok := w.parseToken(c)
+	if !ok {
+		w.restFail(c, http.StatusUnauthorized, WebFailReasonUnauthorized)
+		return nil, false
+	}
+	if data != nil {
+		c.Set(ginTokenKey, data)
+	}
+	return data, true
+}
+
+// adminAuth 旧接口的中间件，设置了JwtMgr时需要管理员权限
+func (w *WebPack) adminAuth(c *gin.Context) {
+	data, ok := w.auth(c)
+	if !ok {
+		return
+	}
+	if w.setting.JwtMgr == nil {
+		return
+	}
+	permission := w.setting.AdminPermission
+	if permission == "" {
+		permission = defaultAdminPermission
+	}
+	if !hasPermission(data, permission) {
+		w.restFail(c, http.StatusForbidden, WebFailReasonNoPermission)
+	}
+}
+
+func (w *WebPack) RestGet(c *gin.Context) {
+	data, ok := w.auth(c)
+	if !ok {
+		return
+	}
+	n := w.namespace(c)
+	key := c.Param("key")
+	if !w.checkKey(data, n.Key(key), false) {
+		w.restFail(c, http.StatusForbidden, WebFailReasonNoPermission)
+		return
+	}
+	value, err := n.Get(key)
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:RestGet:get value error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	if value == nil {
+		w.restFail(c, http.StatusNotFound, WebFailReasonNotFound)
+		return
+	}
+	w.restSuc(c, value)
+}
+
+type restValue struct {
+	Type  ValueType       `json:"type"`
+	Value json.RawMessage `json:"value"`
+	TTL   int64           `json:"ttl"` // 秒，<=0时永不过期
+}
+
+func (v restValue) toUnit() *ValueUnit {
+	unit := StringToUnit(string(v.Value), v.Type)
+	if unit == nil {
+		return nil
+	}
+	if v.TTL > 0 {
+		return unit.WithTTL(time.Duration(v.TTL) * time.Second)
+	}
+	return unit
+}
+
+func (w *WebPack) RestPut(c *gin.Context) {
+	data, ok := w.auth(c)
+	if !ok {
+		return
+	}
+	n := w.namespace(c)
+	key := c.Param("key")
+	if !w.checkKey(data, n.Key(key), true) {
+		w.restFail(c, http.StatusForbidden, WebFailReasonNoPermission)
+		return
+	}
+	var req restValue
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+		return
+	}
+	value := req.toUnit()
+	if value == nil {
+		w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+		return
+	}
+	done := w.noteChange(c, "rest", n.Key(key))
+	err = n.Set(key, value)
+	done(err == nil)
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:RestPut:set value error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	w.restSuc(c, nil)
+}
+
+func (w *WebPack) RestDelete(c *gin.Context) {
+	data, ok := w.auth(c)
+	if !ok {
+		return
+	}
+	n := w.namespace(c)
+	key := c.Param("key")
+	if !w.checkKey(data, n.Key(key), true) {
+		w.restFail(c, http.StatusForbidden, WebFailReasonNoPermission)
+		return
+	}
+	done := w.noteChange(c, "rest", n.Key(key))
+	err := n.Delete(key)
+	done(err == nil)
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:RestDelete:delete value error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	w.restSuc(c, nil)
+}
+
+// RestList 按前缀分页列出，没有权限的key会被跳过
+func (w *WebPack) RestList(c *gin.Context) {
+	data, ok := w.auth(c)
+	if !ok {
+		return
+	}
+	n := w.namespace(c)
+	limit := defaultRestListLimit
+	if s := c.Query("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+			return
+		}
+	}
+	ret, err := n.Scan(ScanOption{
+		Prefix: c.Query("prefix"),
+		Start:  c.Query("start"),
+		Limit:  limit,
+	})
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:RestList:scan error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	pairs := make([]KVPair, 0, len(ret.Pairs))
+	for _, pair := range ret.Pairs {
+		if w.checkKey(data, n.Key(pair.Key), false) {
+			pairs = append(pairs, pair)
+		}
+	}
+	w.restSuc(c, gin.H{
+		"pairs": pairs,
+		"next":  ret.Next,
+	})
+}
+
+// RestBatchGet 批量读取，返回key到值的映射，不存在的key不会出现在结果中
+func (w *WebPack) RestBatchGet(c *gin.Context) {
+	data, ok := w.auth(c)
+	if !ok {
+		return
+	}
+	n := w.namespace(c)
+	var req struct {
+		Keys []string `json:"keys"`
+	}
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+		return
+	}
+	for _, key := range req.Keys {
+		if !w.checkKey(data, n.Key(key), false) {
+			w.restFail(c, http.StatusForbidden, WebFailReasonNoPermission)
+			return
+		}
+	}
+	result := make(map[string]*ValueUnit, len(req.Keys))
+	for _, key := range req.Keys {
+		value, err := n.Get(key)
+		if err != nil {
+			w.log.Error(w.setting.LogFrom, "xStorage:RestBatchGet:get value error:"+err.Error())
+			w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+			return
+		}
+		if value != nil {
+			result[key] = value
+		}
+	}
+	w.restSuc(c, result)
+}
+
+// RestBatch 原子的批量写入与删除
+func (w *WebPack) RestBatch(c *gin.Context) {
+	data, ok := w.auth(c)
+	if !ok {
+		return
+	}
+	n := w.namespace(c)
+	var req struct {
+		Ops []struct {
+			Op  string `json:"op"`
+			Key string `json:"key"`
+			restValue
+		} `json:"ops"`
+	}
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+		return
+	}
+	b := n.NewBatch()
+	keys := make([]string, 0, len(req.Ops))
+	for _, op := range req.Ops {
+		if op.Key == "" {
+			w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+			return
+		}
+		if !w.checkKey(data, n.Key(op.Key), true) {
+			w.restFail(c, http.StatusForbidden, WebFailReasonNoPermission)
+			return
+		}
+		switch op.Op {
+		case "set":
+			value := op.toUnit()
+			if value == nil {
+				w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+				return
+			}
+			b.Set(op.Key, value)
+		case "delete":
+			b.Delete(op.Key)
+		default:
+			w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+			return
+		}
+		keys = append(keys, n.Key(op.Key))
+	}
+	done := w.noteChange(c, "rest", keys...)
+	err = b.Commit()
+	done(err == nil)
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:RestBatch:commit error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	w.restSuc(c, nil)
+}
@@ -0,0 +1,209 @@
+package xstorage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/intmian/mian_go_lib/tool/misc"
+)
+
+/*
+快照格式，第一行为头部，其后每行一个key，按key升序排列，例如
+{"format":"xstorage","version":1,"time":1700000000000,"count":2}
+{"k":"a","v":{"t":2,"d":1}}
+{"k":"b","v":{"t":102,"d":["1","2"],"e":1700000000000}}
+值的格式与JsonLineCore相同，保留了ValueType，slice导入后依然是原本的类型。
+*/
+
+const (
+	snapshotFormat  = "xstorage"
+	snapshotVersion = 1
+)
+
+type snapshotHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Time    int64  `json:"time"`
+	Count   int    `json:"count"`
+}
+
+type snapshotLine struct {
+	Key   string      `json:"k"`
+	Value *unitRecord `json:"v"`
+}
+
+// Export 将所有未过期的数据写入w，不包含内部的key
+func (m *XStorage) Export(w io.Writer) error {
+	pairs, err := m.snapshotPairs(false)
+	if err != nil {
+		return errors.Join(ErrExport, err)
+	}
+	return exportPairs(w, pairs)
+}
+
+func exportPairs(w io.Writer, pairs []KVPair) error {
+	writer := bufio.NewWriter(w)
+	encoder := json.NewEncoder(writer)
+	err := encoder.Encode(snapshotHeader{
+		Format:  snapshotFormat,
+		Version: snapshotVersion,
+		Time:    time.Now().UnixMilli(),
+		Count:   len(pairs),
+	})
+	if err != nil {
+		return errors.Join(ErrExport, err)
+	}
+	for _, pair := range pairs {
+		r, err := newUnitRecord(pair.Value)
+		if err != nil {
+			return errors.Join(ErrExport, err)
+		}
+		err = encoder.Encode(snapshotLine{Key: pair.Key, Value: r})
+		if err != nil {
+			return errors.Join(ErrExport, err)
+		}
+	}
+	err = writer.Flush()
+	if err != nil {
+		return errors.Join(ErrExport, err)
+	}
+	return nil
+}
+
+// Import 读取Export导出的数据并在一次批量写入中原子的写入，已有的key会被覆盖，已经过期的数据会被跳过
+func (m *XStorage) Import(r io.Reader) error {
+	return m.importWithPrefix(r, "")
+}
+
+// importWithPrefix 导入时为每个key加上prefix
+func (m *XStorage) importWithPrefix(r io.Reader, prefix string) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+	var header snapshotHeader
+	err := decoder.Decode(&header)
+	if err != nil {
+		return errors.Join(ErrImport, err)
+	}
+	if header.Format != snapshotFormat {
+		return ErrSnapshotFormat
+	}
+	if header.Version > snapshotVersion {
+		return ErrSnapshotVersion
+	}
+	now := time.Now()
+	b := m.NewBatch()
+	for {
+		var line snapshotLine
+		err = decoder.Decode(&line)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return errors.Join(ErrImport, err)
+		}
+		if line.Value == nil {
+			return errors.Join(ErrImport, ErrValueIsNil)
+		}
+		unit := &ValueUnit{}
+		err = line.Value.toUnit(unit)
+		if err != nil {
+			return errors.Join(ErrImport, err)
+		}
+		if unit.IsExpired(now) {
+			continue
+		}
+		b.Set(prefix+line.Key, unit)
+	}
+	err = b.Commit()
+	if err != nil {
+		return errors.Join(ErrImport, err)
+	}
+	return nil
+}
+
+// snapshotPairs 返回按key排序的所有未过期数据的副本，internal为false时不包含内部的key
+func (m *XStorage) snapshotPairs(internal bool) ([]KVPair, error) {
+	if !m.initTag.IsInitialized() {
+		return nil, ErrMgrNotInit
+	}
+	var kvMap map[string]*ValueUnit
+	if m.cacheIsFull() {
+		if misc.HasProperty(m.setting.Property, MultiSafe) {
+			m.rwLock.RLock()
+			defer m.rwLock.RUnlock()
+		}
+		kvMap = m.kvMap
+	} else {
+		if misc.HasProperty(m.setting.Property, MultiSafe) {
+			m.rwLock.RLock()
+			defer m.rwLock.RUnlock()
+		}
+		err := m.flushDirty()
+		if err != nil {
+			return nil, err
+		}
+		kvMap, err = m.FromDiskGetAll()
+		if err != nil {
+			return nil, err
+		}
+	}
+	now := time.Now()
+	pairs := make([]KVPair, 0, len(kvMap))
+	for k, v := range kvMap {
+		if v.IsExpired(now) || !internal && internalPrefixOf(k) != "" {
+			continue
+		}
+		newValue := &ValueUnit{}
+		Copy(v, newValue)
+		pairs = append(pairs, KVPair{Key: k, Value: newValue})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+	return pairs, nil
+}
+
+// Migrate 将src中的所有数据复制到dst，并逐个校验复制后的结果
+func Migrate(src XStorageSetting, dst XStorageSetting) error {
+	srcStorage, err := NewXStorage(src)
+	if err != nil {
+		return errors.Join(ErrMigrate, err)
+	}
+	defer srcStorage.Close()
+	dstStorage, err := NewXStorage(dst)
+	if err != nil {
+		return errors.Join(ErrMigrate, err)
+	}
+	defer dstStorage.Close()
+	// 迁移时保留配置的修改历史等内部的key
+	pairs, err := srcStorage.snapshotPairs(true)
+	if err != nil {
+		return errors.Join(ErrMigrate, err)
+	}
+	kv := make(map[string]*ValueUnit, len(pairs))
+	for _, pair := range pairs {
+		kv[pair.Key] = pair.Value
+	}
+	err = dstStorage.SetBatch(kv)
+	if err != nil {
+		return errors.Join(ErrMigrate, err)
+	}
+	// 校验，期间过期的数据不再校验
+	now := time.Now()
+	for _, pair := range pairs {
+		if pair.Value.IsExpired(now) {
+			continue
+		}
+		v, err := dstStorage.Get(pair.Key)
+		if err != nil {
+			return errors.Join(ErrMigrate, err)
+		}
+		if v == nil || v.ExpireAt != pair.Value.ExpireAt || !Compare(v, pair.Value) {
+			return errors.Join(ErrMigrateVerify, errors.New(pair.Key))
+		}
+	}
+	return nil
+}
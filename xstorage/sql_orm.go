@@ -2,6 +2,7 @@ package xstorage
 
 import "gorm.io/gorm"
 
+// KeyValueModel 第一版的表结构，slice会被拆成多行，只用于迁移到KeyValueModelV2
 type KeyValueModel struct {
 	gorm.Model
 	// Key 主键、索引
@@ -10,4 +11,20 @@ type KeyValueModel struct {
 	ValueInt    *int
 	ValueString *string
 	ValueFloat  *float32
+	ExpireAt    int64 // 过期时间戳（毫秒），0代表永不过期，只记录在slice的长度节点上
+}
+
+// KeyValueModelV2 第二版的表结构，一个key只有一行
+type KeyValueModelV2 struct {
+	Key          string   `gorm:"primaryKey;size:255"` // mysql中主键不能是text，所以限制长度
+	ValueType    int      // ValueType
+	ValueInt64   *int64   // int、int64、bool
+	ValueFloat64 *float64 // float、float64
+	ValueString  *string  // string，time、map以json的形式存放
+	ValueBytes   []byte   // slice以json的形式存放
+	ExpireAt     int64    `gorm:"index"` // 过期时间戳（毫秒），0代表永不过期
+}
+
+func (KeyValueModelV2) TableName() string {
+	return "key_value_v2"
 }
@@ -0,0 +1,189 @@
+package xstorage
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gorm.io/gorm"
+)
+
+/*
+第一版的表结构中slice会被存储于key[0]、key[1]、key[2]...行中，长度存放在key行的ValueInt中，
+所以key中不能包含[]，空slice只有长度为0的key行，float也只有float32的精度。
+NewSqliteCore时如果发现第一版的表，会在一个事务中把数据转换到第二版的表中并删除第一版的表。
+*/
+
+// migrateSqliteV1 将第一版的表迁移到第二版，没有第一版的表时什么都不做
+func migrateSqliteV1(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&KeyValueModel{}) {
+		return nil
+	}
+	return db.Transaction(func(tx *gorm.DB) error {
+		all, err := loadSqliteV1(tx)
+		if err != nil {
+			return err
+		}
+		for key, value := range all {
+			model, err := gormData2Model(key, value)
+			if err != nil {
+				return errors.Join(fmt.Errorf("migrate key %s failed", key), err)
+			}
+			result := tx.Create(model)
+			if result.Error != nil {
+				return errors.Join(fmt.Errorf("migrate key %s failed", key), result.Error)
+			}
+		}
+		return tx.Migrator().DropTable(&KeyValueModel{})
+	})
+}
+
+// loadSqliteV1 读取第一版的表中的所有数据，包括已经过期的
+func loadSqliteV1(db *gorm.DB) (map[string]*ValueUnit, error) {
+	var models []KeyValueModel
+	result := db.Find(&models)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	rows := make(map[string]KeyValueModel, len(models))
+	for _, model := range models {
+		rows[model.Key] = model
+	}
+	ret := make(map[string]*ValueUnit)
+	for _, model := range models {
+		// 跳过所有含有[]的key，因为这些key是slice的成员，不是真正的key
+		if strings.Contains(model.Key, "[") || strings.Contains(model.Key, "]") {
+			continue
+		}
+		unit := &ValueUnit{}
+		sliceNum, err := sqliteV1Model2Data(model, unit)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("read key %s failed", model.Key), err)
+		}
+		switch unit.Type {
+		case ValueTypeSliceInt, ValueTypeSliceString, ValueTypeSliceFloat, ValueTypeSliceBool:
+			err = sqliteV1Slice(rows, model, sliceNum, unit)
+			if err != nil {
+				return nil, errors.Join(fmt.Errorf("read key %s failed", model.Key), err)
+			}
+		}
+		ret[model.Key] = unit
+	}
+	return ret, nil
+}
+
+// sqliteV1Slice 从key[0]、key[1]...行中读取slice的成员
+func sqliteV1Slice(rows map[string]KeyValueModel, model KeyValueModel, sliceNum int, rec *ValueUnit) error {
+	members := make([]KeyValueModel, sliceNum)
+	for i := 0; i < sliceNum; i++ {
+		member, ok := rows[model.Key+"["+strconv.Itoa(i)+"]"]
+		if !ok {
+			return fmt.Errorf("slice member %s[%d] not exist", model.Key, i)
+		}
+		members[i] = member
+	}
+	rec.Type = ValueType(model.ValueType)
+	rec.ExpireAt = model.ExpireAt
+	switch rec.Type {
+	case ValueTypeSliceInt:
+		data := make([]int, sliceNum)
+		for i, member := range members {
+			if member.ValueInt == nil {
+				return fmt.Errorf("slice but ValueInt is nil, Key: %s[%d]", model.Key, i)
+			}
+			data[i] = *member.ValueInt
+		}
+		rec.Data = data
+	case ValueTypeSliceString:
+		data := make([]string, sliceNum)
+		for i, member := range members {
+			if member.ValueString == nil {
+				return fmt.Errorf("slice but ValueString is nil, Key: %s[%d]", model.Key, i)
+			}
+			data[i] = *member.ValueString
+		}
+		rec.Data = data
+	case ValueTypeSliceFloat:
+		data := make([]float32, sliceNum)
+		for i, member := range members {
+			if member.ValueFloat == nil {
+				return fmt.Errorf("slice but ValueFloat is nil, Key: %s[%d]", model.Key, i)
+			}
+			data[i] = *member.ValueFloat
+		}
+		rec.Data = data
+	case ValueTypeSliceBool:
+		data := make([]bool, sliceNum)
+		for i, member := range members {
+			if member.ValueInt == nil {
+				return fmt.Errorf("slice but ValueInt is nil, Key: %s[%d]", model.Key, i)
+			}
+			data[i] = *member.ValueInt != 0
+		}
+		rec.Data = data
+	default:
+		return ErrValueType
+	}
+	return nil
+}
+
+// sqliteV1Model2Data 将第一版的model转化为ValueUnit，但是需要注意的是，如果是slice类型，只返回slice的长度与类型，不返回具体的值
+func sqliteV1Model2Data(keyValueModel KeyValueModel, rec *ValueUnit) (int, error) {
+	value := &ValueUnit{}
+	sliceNum := 0
+	// 判断合法性
+	switch ValueType(keyValueModel.ValueType) {
+	case ValueTypeInt, ValueTypeBool:
+		if keyValueModel.ValueInt == nil {
+			return 0, ErrValueIsNil
+		}
+	case ValueTypeString, ValueTypeInt64, ValueTypeFloat64, ValueTypeTime, ValueTypeMapString, ValueTypeMapInt:
+		if keyValueModel.ValueString == nil {
+			return 0, ErrValueIsNil
+		}
+	case ValueTypeFloat:
+		if keyValueModel.ValueFloat == nil {
+			return 0, ErrValueIsNil
+		}
+	case ValueTypeSliceInt, ValueTypeSliceString, ValueTypeSliceFloat, ValueTypeSliceBool:
+		if keyValueModel.ValueInt == nil {
+			return 0, ErrSliceButValueIntIsNil
+		}
+	default:
+		return 0, ErrValueType
+	}
+
+	// 读取值
+	switch ValueType(keyValueModel.ValueType) {
+	case ValueTypeInt:
+		value.Data = *keyValueModel.ValueInt
+		value.Type = ValueTypeInt
+	case ValueTypeBool:
+		value.Data = *keyValueModel.ValueInt != 0
+		value.Type = ValueTypeBool
+	case ValueTypeString:
+		value.Data = *keyValueModel.ValueString
+		value.Type = ValueTypeString
+	case ValueTypeFloat:
+		value.Data = *keyValueModel.ValueFloat
+		value.Type = ValueTypeFloat
+	case ValueTypeInt64, ValueTypeFloat64, ValueTypeTime, ValueTypeMapString, ValueTypeMapInt:
+		// 没有对应的列，以json的形式存放在ValueString中
+		unit := StringToUnit(*keyValueModel.ValueString, ValueType(keyValueModel.ValueType))
+		if unit == nil {
+			return 0, ErrJsonUnmarshalErr
+		}
+		value = unit
+	case ValueTypeSliceInt, ValueTypeSliceString, ValueTypeSliceFloat, ValueTypeSliceBool:
+		sliceNum = *keyValueModel.ValueInt
+		if sliceNum < 0 {
+			return 0, fmt.Errorf("slice but sliceNum is %d", sliceNum)
+		}
+		// 长度为0时是空slice
+		value.Type = ValueType(keyValueModel.ValueType)
+	}
+	value.ExpireAt = keyValueModel.ExpireAt
+	*rec = *value
+	return sliceNum, nil
+}
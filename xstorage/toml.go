@@ -1,34 +1,351 @@
 package xstorage
 
 import (
-	"github.com/intmian/mian_go_lib/tool/misc"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/BurntSushi/toml"
 )
 
+/*
+TomlCore 将所有数据存放在一个toml文件中，可以被多个进程同时打开，也可以手动编辑。
+读写时对addr.lock加建议锁，写入时先写临时文件再重命名覆盖，不会读到写了一半的文件。
+写入前如果发现文件在上次读写后被外部修改过，会以上次读写时的内容为基准做三方合并：
+只有一方修改的key取修改后的值，双方都修改为不同的值时以本进程为准，并记为冲突。
+外部的修改与冲突通过TakeExternal取出，XStorage据此更新缓存，见XStorageSetting.FileWatchInterval。
+*/
 type TomlCore struct {
 	addr string
+	lock sync.Mutex
+	// 是否读写过文件，没有时SaveAll直接覆盖
+	loaded bool
+	stamp  fileStamp
+	// 上次读写时文件中每个key的编码，用于判断哪一方修改了key
+	base      map[string][]byte
+	external  map[string]*ValueUnit
+	conflicts []FileConflict
+}
+
+// racyStampWindow 修改时间在这段时间内的文件不能只凭修改时间与大小判断是否变化
+const racyStampWindow = 2 * time.Second
+
+// fileStamp 用于判断文件是否被修改过，修改时间与大小只用于快速判断，以内容的hash为准
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+	sum     [sha256.Size]byte
+}
+
+// FileConflict 同一个key在本进程与外部都被修改为不同的值，nil代表被删除
+type FileConflict struct {
+	Key      string
+	Local    *ValueUnit // 本进程的值，也是最终写入文件的值
+	External *ValueUnit // 被覆盖的外部的值
 }
 
 func NewTomlCore(addr string) *TomlCore {
-	return &TomlCore{addr: addr}
+	return &TomlCore{
+		addr:     addr,
+		external: make(map[string]*ValueUnit),
+	}
 }
 
-func (j TomlCore) GetAll() (map[string]*ValueUnit, error) {
-	tt := misc.TomlTool{}
-	m := make(map[string]*ValueUnit)
+func (j *TomlCore) GetAll() (map[string]*ValueUnit, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	unlock, err := j.lockFile()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 	// 如果文件不存在，会返回空map
-	_, err := os.Stat(j.addr)
+	m, stamp, err := j.read()
 	if err != nil {
-		return m, nil
+		return nil, err
 	}
-	err = tt.Read(j.addr, &m)
+	base, err := encodeAll(m)
 	if err != nil {
 		return nil, err
 	}
+	j.loaded = true
+	j.stamp = stamp
+	j.base = base
 	return m, nil
 }
 
-func (j TomlCore) SaveAll(data map[string]*ValueUnit) error {
-	tt := &misc.TomlTool{}
-	return tt.Write(j.addr, data)
+func (j *TomlCore) SaveAll(data map[string]*ValueUnit) error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	unlock, err := j.lockFile()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	out := data
+	encoded, err := encodeAll(data)
+	if err != nil {
+		return err
+	}
+	if j.loaded {
+		disk, stamp, err := j.read()
+		if err != nil {
+			return err
+		}
+		if stamp.sum != j.stamp.sum {
+			out, encoded, err = j.merge(data, encoded, disk)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	stamp, err := j.write(out)
+	if err != nil {
+		return err
+	}
+	j.loaded = true
+	j.stamp = stamp
+	j.base = encoded
+	return nil
+}
+
+// Reload 文件在上次读写后被外部修改过时重新读取，返回是否有key发生了变化，变化通过TakeExternal取出。
+// 先比较修改时间与大小，没有变化时不会读取文件
+func (j *TomlCore) Reload() (bool, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if !j.loaded {
+		return false, nil
+	}
+	info, err := os.Stat(j.addr)
+	switch {
+	case err == nil:
+		// 修改时间的精度有限，刚修改过的文件即使时间与大小都相同也可能已经被改过，需要比较内容
+		racy := time.Since(info.ModTime()) < racyStampWindow
+		if !racy && info.ModTime().Equal(j.stamp.modTime) && info.Size() == j.stamp.size {
+			return false, nil
+		}
+	case os.IsNotExist(err):
+		if j.stamp == (fileStamp{}) {
+			return false, nil
+		}
+	default:
+		return false, err
+	}
+	unlock, err := j.lockFile()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	disk, stamp, err := j.read()
+	if err != nil {
+		return false, err
+	}
+	if stamp.sum == j.stamp.sum {
+		j.stamp = stamp
+		return false, nil
+	}
+	diskEncoded, err := encodeAll(disk)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for key := range unionKeys(j.base, diskEncoded) {
+		base, inBase := j.base[key]
+		theirs, inTheirs := diskEncoded[key]
+		if inBase == inTheirs && bytes.Equal(base, theirs) {
+			continue
+		}
+		j.external[key] = disk[key]
+		changed = true
+	}
+	j.stamp = stamp
+	j.base = diskEncoded
+	return changed, nil
+}
+
+// TakeExternal 取出并清空外部的修改与冲突，修改中的nil代表key被删除
+func (j *TomlCore) TakeExternal() (map[string]*ValueUnit, []FileConflict, error) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	external, conflicts := j.external, j.conflicts
+	j.external = make(map[string]*ValueUnit)
+	j.conflicts = nil
+	return external, conflicts, nil
+}
+
+// merge 以base为基准合并本进程与文件中的数据，返回合并后的数据与编码
+func (j *TomlCore) merge(data map[string]*ValueUnit, encoded map[string][]byte, disk map[string]*ValueUnit) (map[string]*ValueUnit, map[string][]byte, error) {
+	diskEncoded, err := encodeAll(disk)
+	if err != nil {
+		return nil, nil, err
+	}
+	out := make(map[string]*ValueUnit, len(data))
+	outEncoded := make(map[string][]byte, len(encoded))
+	for key, value := range data {
+		out[key] = value
+		outEncoded[key] = encoded[key]
+	}
+	for key := range unionKeys(j.base, encoded, diskEncoded) {
+		base, inBase := j.base[key]
+		mine, inMine := encoded[key]
+		theirs, inTheirs := diskEncoded[key]
+		if inBase == inTheirs && bytes.Equal(base, theirs) {
+			continue
+		}
+		if inBase != inMine || !bytes.Equal(base, mine) {
+			if inMine != inTheirs || !bytes.Equal(mine, theirs) {
+				j.conflicts = append(j.conflicts, FileConflict{
+					Key:      key,
+					Local:    cloneUnit(data[key]),
+					External: disk[key],
+				})
+			}
+			continue
+		}
+		// 只有外部修改过
+		if inTheirs {
+			out[key] = disk[key]
+			outEncoded[key] = theirs
+		} else {
+			delete(out, key)
+			delete(outEncoded, key)
+		}
+		j.external[key] = disk[key]
+	}
+	return out, outEncoded, nil
+}
+
+// lockFile 对addr.lock加锁，而不是文件本身，因为文件会被重命名覆盖
+func (j *TomlCore) lockFile() (func(), error) {
+	f, err := os.OpenFile(j.addr+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = unlockFile(f)
+		_ = f.Close()
+	}, nil
+}
+
+// read 读取文件中的所有数据，文件不存在时返回空map
+func (j *TomlCore) read() (map[string]*ValueUnit, fileStamp, error) {
+	m := make(map[string]*ValueUnit)
+	f, err := os.Open(j.addr)
+	if os.IsNotExist(err) {
+		return m, fileStamp{}, nil
+	}
+	if err != nil {
+		return nil, fileStamp{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fileStamp{}, err
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fileStamp{}, err
+	}
+	_, err = toml.Decode(string(b), &m)
+	if err != nil {
+		return nil, fileStamp{}, err
+	}
+	// toml中的整数与数组会被解析为int64与[]interface{}，按Type还原为具体类型
+	for key, value := range m {
+		if value == nil {
+			delete(m, key)
+			continue
+		}
+		encoded, err := encodeUnit(value)
+		if err == nil {
+			err = decodeUnit(encoded, value)
+		}
+		if err != nil {
+			return nil, fileStamp{}, errors.Join(fmt.Errorf("key %s", key), err)
+		}
+	}
+	return m, fileStamp{modTime: info.ModTime(), size: info.Size(), sum: sha256.Sum256(b)}, nil
+}
+
+// write 写入同目录下的临时文件后重命名覆盖原文件
+func (j *TomlCore) write(data map[string]*ValueUnit) (fileStamp, error) {
+	var buf bytes.Buffer
+	err := toml.NewEncoder(&buf).Encode(data)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(j.addr); err == nil {
+		mode = info.Mode().Perm()
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(j.addr), filepath.Base(j.addr)+".*.tmp")
+	if err != nil {
+		return fileStamp{}, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(buf.Bytes())
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), mode)
+	}
+	if err != nil {
+		return fileStamp{}, err
+	}
+	err = os.Rename(tmp.Name(), j.addr)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	info, err := os.Stat(j.addr)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size(), sum: sha256.Sum256(buf.Bytes())}, nil
+}
+
+func encodeAll(data map[string]*ValueUnit) (map[string][]byte, error) {
+	ret := make(map[string][]byte, len(data))
+	for key, value := range data {
+		b, err := encodeUnit(value)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("key %s", key), err)
+		}
+		ret[key] = b
+	}
+	return ret, nil
+}
+
+func unionKeys(maps ...map[string][]byte) map[string]struct{} {
+	ret := make(map[string]struct{})
+	for _, m := range maps {
+		for key := range m {
+			ret[key] = struct{}{}
+		}
+	}
+	return ret
+}
+
+func cloneUnit(unit *ValueUnit) *ValueUnit {
+	if unit == nil {
+		return nil
+	}
+	ret := &ValueUnit{}
+	Copy(unit, ret)
+	return ret
 }
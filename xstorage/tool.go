@@ -16,3 +16,65 @@ func Join(src ...string) string {
 func Split(src string) []string {
 	return strings.Split(src, ".")
 }
+
+// prefixUpper 返回大于所有以prefix开头的字符串的最小字符串，用于将前缀查询转化为范围查询。如果不存在这样的字符串则返回空
+func prefixUpper(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// scanRange 将ScanOption转化为[lower, upper)的范围，upper为空代表没有上限
+func scanRange(option ScanOption) (string, string) {
+	lower := option.Prefix
+	if option.Start > lower {
+		lower = option.Start
+	}
+	upper := ""
+	if option.Prefix != "" {
+		upper = prefixUpper(option.Prefix)
+	}
+	if option.End != "" && (upper == "" || option.End < upper) {
+		upper = option.End
+	}
+	return lower, upper
+}
+
+// internalPrefixes 存储内部使用的key的前缀，这些key不会出现在GetAll、Scan与Export中，Scan的Prefix本身在其中时除外
+var internalPrefixes = []string{cfgHistoryPrefix + ".", cryptMarkPrefix + "."}
+
+// internalPrefixOf 返回key所在的内部前缀，不是内部的key时返回空
+func internalPrefixOf(key string) string {
+	for _, prefix := range internalPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// hideInternal 去掉内部的key，没有时直接返回原map，避免复制
+func hideInternal(kvMap map[string]*ValueUnit) map[string]*ValueUnit {
+	has := false
+	for k := range kvMap {
+		if internalPrefixOf(k) != "" {
+			has = true
+			break
+		}
+	}
+	if !has {
+		return kvMap
+	}
+	ret := make(map[string]*ValueUnit, len(kvMap))
+	for k, v := range kvMap {
+		if internalPrefixOf(k) == "" {
+			ret[k] = v
+		}
+	}
+	return ret
+}
@@ -0,0 +1,182 @@
+package xstorage
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ValueTypeOf 返回T对应的ValueType，T不是IValueType中的类型时返回ValueTypeNormalBegin
+func ValueTypeOf[T any]() ValueType {
+	var v T
+	switch any(v).(type) {
+	case string:
+		return ValueTypeString
+	case int:
+		return ValueTypeInt
+	case float32:
+		return ValueTypeFloat
+	case bool:
+		return ValueTypeBool
+	case int64:
+		return ValueTypeInt64
+	case float64:
+		return ValueTypeFloat64
+	case time.Time:
+		return ValueTypeTime
+	case map[string]string:
+		return ValueTypeMapString
+	case map[string]int:
+		return ValueTypeMapInt
+	case []string:
+		return ValueTypeSliceString
+	case []int:
+		return ValueTypeSliceInt
+	case []float32:
+		return ValueTypeSliceFloat
+	case []bool:
+		return ValueTypeSliceBool
+	default:
+		return ValueTypeNormalBegin
+	}
+}
+
+// NewUnit 根据T自动推导ValueType
+func NewUnit[T IValueType](value T) *ValueUnit {
+	return ToUnit(value, ValueTypeOf[T]())
+}
+
+// ToBaseE 与ToBase相同，但是类型不匹配时返回错误而不是零值
+func ToBaseE[T IValueType](unit *ValueUnit) (T, error) {
+	var empty T
+	if unit == nil {
+		return empty, ErrValueUnitIsNil
+	}
+	if unit.Type != ValueTypeOf[T]() {
+		return empty, ErrValueTypeNotMatch
+	}
+	t, ok := unit.Data.(T)
+	if !ok {
+		return empty, ErrValueTypeNotMatch
+	}
+	return t, nil
+}
+
+/*
+Typed 在XStorage之上按T读写，类型不匹配时返回错误。
+T为IValueType中的类型时直接存储，其他类型（例如结构体）会被序列化为json后以ValueTypeString存储，与JStructToUnit的格式相同。
+例如
+
+	news := NewTyped[[]string](storage)
+	err := news.Set("news.keywords", []string{"a", "b"})
+	keywords, ok, err := news.Get("news.keywords")
+*/
+type Typed[T any] struct {
+	storage   *XStorage
+	valueType ValueType
+	isJson    bool
+}
+
+func NewTyped[T any](storage *XStorage) *Typed[T] {
+	t := &Typed[T]{
+		storage:   storage,
+		valueType: ValueTypeOf[T](),
+	}
+	if t.valueType == ValueTypeNormalBegin {
+		t.valueType = ValueTypeString
+		t.isJson = true
+	}
+	return t
+}
+
+// Get 读取key，不存在时返回false。已有的值类型与T不一致时返回ErrValueTypeNotMatch
+func (t *Typed[T]) Get(key string) (T, bool, error) {
+	var empty T
+	unit, err := t.storage.Get(key)
+	if err != nil {
+		return empty, false, err
+	}
+	if unit == nil {
+		return empty, false, nil
+	}
+	v, err := t.FromUnit(unit)
+	if err != nil {
+		return empty, true, err
+	}
+	return v, true, nil
+}
+
+// GetOr 读取key，不存在时返回def
+func (t *Typed[T]) GetOr(key string, def T) (T, error) {
+	v, ok, err := t.Get(key)
+	if err != nil {
+		return v, err
+	}
+	if !ok {
+		return def, nil
+	}
+	return v, nil
+}
+
+func (t *Typed[T]) Set(key string, value T) error {
+	unit, err := t.ToUnit(value)
+	if err != nil {
+		return err
+	}
+	return t.storage.Set(key, unit)
+}
+
+func (t *Typed[T]) SetWithTTL(key string, value T, ttl time.Duration) error {
+	unit, err := t.ToUnit(value)
+	if err != nil {
+		return err
+	}
+	return t.storage.SetWithTTL(key, unit, ttl)
+}
+
+func (t *Typed[T]) Delete(key string) error {
+	return t.storage.Delete(key)
+}
+
+// ToUnit 将T转为ValueUnit
+func (t *Typed[T]) ToUnit(value T) (*ValueUnit, error) {
+	if !t.isJson {
+		return &ValueUnit{
+			Type: t.valueType,
+			Data: any(value),
+		}, nil
+	}
+	s, err := json.Marshal(value)
+	if err != nil {
+		return nil, errors.Join(ErrJsonMarshalErr, err)
+	}
+	return ToUnit(string(s), ValueTypeString), nil
+}
+
+// FromUnit 将ValueUnit转为T，类型不一致时返回ErrValueTypeNotMatch
+func (t *Typed[T]) FromUnit(unit *ValueUnit) (T, error) {
+	var empty T
+	if unit == nil {
+		return empty, ErrValueUnitIsNil
+	}
+	if unit.Type != t.valueType {
+		return empty, ErrValueTypeNotMatch
+	}
+	if !t.isJson {
+		v, ok := unit.Data.(T)
+		if !ok {
+			return empty, ErrValueTypeNotMatch
+		}
+		return v, nil
+	}
+	s, ok := unit.Data.(string)
+	if !ok {
+		return empty, ErrValueTypeNotMatch
+	}
+	var v T
+	err := json.Unmarshal([]byte(s), &v)
+	if err != nil {
+		return empty, errors.Join(ErrValueTypeNotMatch, ErrJsonUnmarshalErr, err)
+	}
+	return v, nil
+}
@@ -4,21 +4,40 @@ import (
 	"encoding/json"
 	"strconv"
 	"strings"
+	"time"
 )
 
-// TODO: 考虑用泛型改写一个v2的
+// 泛型的读写见Typed
 
 // ValueUnit 加入类型，用于在非反射的情况下直接处理类型
 type ValueUnit struct {
-	Type  ValueType
-	Data  interface{}
-	dirty bool
+	Type     ValueType
+	Data     interface{}
+	ExpireAt int64 `json:",omitempty" toml:",omitempty"` // 过期时间戳（毫秒），0代表永不过期
+	dirty    bool
 }
 
 func (v *ValueUnit) Reset() {
 	*v = ValueUnit{}
 }
 
+// IsExpired 在now时是否已经过期
+func (v *ValueUnit) IsExpired(now time.Time) bool {
+	return v.ExpireAt != 0 && v.ExpireAt <= now.UnixMilli()
+}
+
+// WithTTL 返回一个ttl后过期的副本，ttl<=0时返回永不过期的副本
+func (v *ValueUnit) WithTTL(ttl time.Duration) *ValueUnit {
+	newValue := &ValueUnit{}
+	Copy(v, newValue)
+	if ttl > 0 {
+		newValue.ExpireAt = time.Now().Add(ttl).UnixMilli()
+	} else {
+		newValue.ExpireAt = 0
+	}
+	return newValue
+}
+
 // ToBase 直接转换为基础类型，一方面是为了避免频繁的类型转换，另一方面是为了限制类型
 func ToBase[T IValueType](unit *ValueUnit) T {
 	// 判断类型是否正确
@@ -100,6 +119,41 @@ func StringToUnit(value string, valueType ValueType) *ValueUnit {
 			return nil
 		}
 		return ToUnit(v, valueType)
+	case ValueTypeInt64:
+		var v int64
+		err := json.Unmarshal([]byte(value), &v)
+		if err != nil {
+			return nil
+		}
+		return ToUnit(v, valueType)
+	case ValueTypeFloat64:
+		var v float64
+		err := json.Unmarshal([]byte(value), &v)
+		if err != nil {
+			return nil
+		}
+		return ToUnit(v, valueType)
+	case ValueTypeTime:
+		var v time.Time
+		err := json.Unmarshal([]byte(value), &v)
+		if err != nil {
+			return nil
+		}
+		return ToUnit(v, valueType)
+	case ValueTypeMapString:
+		var v map[string]string
+		err := json.Unmarshal([]byte(value), &v)
+		if err != nil {
+			return nil
+		}
+		return ToUnit(v, valueType)
+	case ValueTypeMapInt:
+		var v map[string]int
+		err := json.Unmarshal([]byte(value), &v)
+		if err != nil {
+			return nil
+		}
+		return ToUnit(v, valueType)
 	case ValueTypeSliceInt:
 		var v []int
 		err := json.Unmarshal([]byte(value), &v)
@@ -148,9 +202,20 @@ func UnitToString(unit *ValueUnit) string {
 		}
 	case ValueTypeBool:
 		s = strconv.FormatBool(ToBase[bool](unit))
-
+	case ValueTypeInt64:
+		s = strconv.FormatInt(ToBase[int64](unit), 10)
+	case ValueTypeFloat64:
+		s = strconv.FormatFloat(ToBase[float64](unit), 'f', -1, 64)
+		if !strings.Contains(s, ".") {
+			s += ".0"
+		}
+	case ValueTypeTime:
+		s = ToBase[time.Time](unit).Format(time.RFC3339Nano)
+	case ValueTypeMapString, ValueTypeMapInt:
+		b, _ := json.Marshal(unit.Data)
+		s = string(b)
 	}
-	return ""
+	return s
 }
 
 func Compare(unit1 *ValueUnit, unit2 *ValueUnit) bool {
@@ -180,6 +245,38 @@ func Compare(unit1 *ValueUnit, unit2 *ValueUnit) bool {
 		if ToBase[bool](unit1) != ToBase[bool](unit2) {
 			return false
 		}
+	case ValueTypeInt64:
+		if ToBase[int64](unit1) != ToBase[int64](unit2) {
+			return false
+		}
+	case ValueTypeFloat64:
+		if ToBase[float64](unit1) != ToBase[float64](unit2) {
+			return false
+		}
+	case ValueTypeTime:
+		if !ToBase[time.Time](unit1).Equal(ToBase[time.Time](unit2)) {
+			return false
+		}
+	case ValueTypeMapString:
+		m1, m2 := ToBase[map[string]string](unit1), ToBase[map[string]string](unit2)
+		if len(m1) != len(m2) {
+			return false
+		}
+		for k, val := range m1 {
+			if val2, ok := m2[k]; !ok || val != val2 {
+				return false
+			}
+		}
+	case ValueTypeMapInt:
+		m1, m2 := ToBase[map[string]int](unit1), ToBase[map[string]int](unit2)
+		if len(m1) != len(m2) {
+			return false
+		}
+		for k, val := range m1 {
+			if val2, ok := m2[k]; !ok || val != val2 {
+				return false
+			}
+		}
 	case ValueTypeSliceInt:
 		if len(ToBase[[]int](unit1)) != len(ToBase[[]int](unit2)) {
 			return false
@@ -222,8 +319,52 @@ func Compare(unit1 *ValueUnit, unit2 *ValueUnit) bool {
 
 func Copy(srcValue *ValueUnit, newValue *ValueUnit) {
 	switch srcValue.Type {
-	case ValueTypeString, ValueTypeInt, ValueTypeFloat, ValueTypeBool:
+	case ValueTypeString, ValueTypeBool:
+		*newValue = *srcValue
+	case ValueTypeInt:
+		*newValue = *srcValue
+		// toml读取出的整数为int64
+		if v, ok := srcValue.Data.(int64); ok {
+			newValue.Data = int(v)
+		}
+	case ValueTypeFloat:
+		*newValue = *srcValue
+		// toml读取出的浮点数为float64
+		if v, ok := srcValue.Data.(float64); ok {
+			newValue.Data = float32(v)
+		}
+	case ValueTypeInt64, ValueTypeFloat64, ValueTypeTime:
 		*newValue = *srcValue
+	case ValueTypeMapString:
+		newValue.Type = ValueTypeMapString
+		newData := make(map[string]string)
+		switch data := srcValue.Data.(type) {
+		case map[string]string:
+			for k, val := range data {
+				newData[k] = val
+			}
+		case map[string]interface{}:
+			// toml读取出的表为map[string]interface{}
+			for k, val := range data {
+				newData[k], _ = val.(string)
+			}
+		}
+		newValue.Data = newData
+	case ValueTypeMapInt:
+		newValue.Type = ValueTypeMapInt
+		newData := make(map[string]int)
+		switch data := srcValue.Data.(type) {
+		case map[string]int:
+			for k, val := range data {
+				newData[k] = val
+			}
+		case map[string]interface{}:
+			for k, val := range data {
+				v, _ := val.(int64)
+				newData[k] = int(v)
+			}
+		}
+		newValue.Data = newData
 	case ValueTypeSliceInt:
 		newValue.Type = ValueTypeSliceInt
 		_, ok := srcValue.Data.([]int)
@@ -285,4 +426,5 @@ func Copy(srcValue *ValueUnit, newValue *ValueUnit) {
 		}
 		newValue.Data = newData
 	}
+	newValue.ExpireAt = srcValue.ExpireAt
 }
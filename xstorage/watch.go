@@ -0,0 +1,179 @@
+package xstorage
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type WatchEventType int
+
+const (
+	WatchEventNull WatchEventType = iota
+	WatchEventSet
+	WatchEventDelete
+)
+
+// WatchEvent 一次已经提交成功的修改
+type WatchEvent struct {
+	Type     WatchEventType
+	Key      string
+	OldValue *ValueUnit // 修改前的值，原本不存在时为nil
+	NewValue *ValueUnit // 修改后的值，删除时为nil
+	Time     int64      // 提交时间戳（毫秒）
+}
+
+const watchBufferSize = 1024
+
+// Watcher 监听某个前缀下的修改，事件在提交成功后按顺序投递到C中。
+// 为了不阻塞写入，C满了以后新的事件会被丢弃并计数，使用者应及时消费
+type Watcher struct {
+	C       <-chan WatchEvent
+	c       chan WatchEvent
+	prefix  string
+	trim    int // 投递时去掉key的前trim个字节，用于命名空间
+	id      uint64
+	hub     *watchHub
+	dropped atomic.Uint64
+	once    sync.Once
+}
+
+// Close 停止监听并关闭C
+func (w *Watcher) Close() {
+	w.once.Do(func() {
+		w.hub.remove(w.id)
+		close(w.c)
+	})
+}
+
+// Dropped 因为C已满而被丢弃的事件数
+func (w *Watcher) Dropped() uint64 {
+	return w.dropped.Load()
+}
+
+type watchHub struct {
+	lock     sync.RWMutex
+	watchers map[uint64]*Watcher
+	nextID   uint64
+}
+
+func (h *watchHub) add(prefix string, trim int) *Watcher {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.watchers == nil {
+		h.watchers = make(map[uint64]*Watcher)
+	}
+	h.nextID++
+	c := make(chan WatchEvent, watchBufferSize)
+	w := &Watcher{
+		C:      c,
+		c:      c,
+		prefix: prefix,
+		trim:   trim,
+		id:     h.nextID,
+		hub:    h,
+	}
+	h.watchers[w.id] = w
+	return w
+}
+
+func (h *watchHub) remove(id uint64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	delete(h.watchers, id)
+}
+
+// has 是否有监听者关心key，没有时可以跳过旧值的读取
+func (h *watchHub) has(key string) bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, w := range h.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// publish 投递事件，不会阻塞，所以可以在持有存储锁时调用
+func (h *watchHub) publish(events ...WatchEvent) {
+	if len(events) == 0 {
+		return
+	}
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	for _, w := range h.watchers {
+		for _, e := range events {
+			if !strings.HasPrefix(e.Key, w.prefix) {
+				continue
+			}
+			e.Key = e.Key[w.trim:]
+			select {
+			case w.c <- e:
+			default:
+				w.dropped.Add(1)
+			}
+		}
+	}
+}
+
+// Watch 监听所有以prefix开头的key的修改，prefix为空时监听全部，不再使用时需要调用Close
+func (m *XStorage) Watch(prefix string) *Watcher {
+	return m.watchHub.add(prefix, 0)
+}
+
+// WatchFunc 监听所有以prefix开头的key的修改，fn在单独的协程中按顺序调用，返回的函数用于取消监听
+func (m *XStorage) WatchFunc(prefix string, fn func(event WatchEvent)) func() {
+	w := m.Watch(prefix)
+	go func() {
+		for e := range w.C {
+			fn(e)
+		}
+	}()
+	return w.Close
+}
+
+// loadOldValue 读取key当前的值用于生成事件，需要在持有写锁时调用，读取失败或不存在时返回nil
+func (m *XStorage) loadOldValue(key string) *ValueUnit {
+	now := time.Now()
+	if m.kvMap != nil {
+		if p, ok := m.kvMap[key]; ok {
+			if p.IsExpired(now) {
+				return nil
+			}
+			old := &ValueUnit{}
+			Copy(p, old)
+			return old
+		}
+		if m.cacheIsFull() || m.cache.isDeleted(key) {
+			return nil
+		}
+	}
+	t := m.setting.SaveType
+	if m.dbCore != nil && t.isDB() {
+		old := &ValueUnit{}
+		ok, err := m.dbCore.Get(key, old)
+		if err != nil || !ok || old.IsExpired(now) {
+			return nil
+		}
+		return old
+	}
+	return nil
+}
+
+func newWatchEvent(key string, old *ValueUnit, value *ValueUnit) WatchEvent {
+	e := WatchEvent{
+		Type:     WatchEventSet,
+		Key:      key,
+		OldValue: old,
+		Time:     time.Now().UnixMilli(),
+	}
+	if value == nil {
+		e.Type = WatchEventDelete
+	} else {
+		e.NewValue = &ValueUnit{}
+		Copy(value, e.NewValue)
+	}
+	return e
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/intmian/mian_go_lib/tool/misc"
+	"github.com/intmian/mian_go_lib/tool/token"
 	"github.com/intmian/mian_go_lib/xlog"
+	"io"
 	"regexp"
 )
 
@@ -25,6 +27,7 @@ type WebPack struct {
 	log         *xlog.XLog
 	logFrom     string
 	setting     WebPackSetting
+	changes     changeLog
 	misc.InitTag
 }
 
@@ -32,6 +35,20 @@ type WebPackSetting struct {
 	LogFrom string
 	Log     *xlog.XLog
 	WebPort int
+	// Namespace 默认使用的命名空间，为空时为整个存储。请求中可以通过ns参数指定其他命名空间
+	Namespace string
+	// WebHost 监听的地址，为空时为127.0.0.1。监听其他地址时建议设置JwtMgr
+	WebHost string
+	// JwtMgr 不为nil时所有接口都需要token，REST接口按PrefixPerms检查权限，其他接口需要AdminPermission
+	JwtMgr          *token.JwtMgr
+	PrefixPerms     []PrefixPerm
+	AdminPermission string // 为空时为xstorage.admin
+	// Cfg 不为nil时管理页面中会展示其中的参数
+	Cfg           *CfgExt
+	ChangeLogSize int // 管理页面中保留的修改记录数量，<=0时为200
+	// Metrics 不为nil时在/metrics以prometheus的文本格式输出，需要自行通过XStorage.AddObserver添加。
+	// 其中不包含key与值，所以不需要token
+	Metrics *Metrics
 }
 
 func (w *WebPack) Init(setting WebPackSetting, core *XStorage) error {
@@ -39,10 +56,25 @@ func (w *WebPack) Init(setting WebPackSetting, core *XStorage) error {
 	w.storageCore = core
 	w.log = setting.Log
 	w.logFrom = setting.LogFrom
+	w.changes.size = setting.ChangeLogSize
+	// 修改记录来自监听，保证包括所有写入并且旧值与提交顺序一致
+	w.changes.watcher = core.Watch("")
+	go func(watcher *Watcher) {
+		for e := range watcher.C {
+			w.changes.onEvent(e)
+		}
+	}(w.changes.watcher)
 	w.SetInitialized()
 	return nil
 }
 
+// Close 停止记录修改
+func (w *WebPack) Close() {
+	if w.changes.watcher != nil {
+		w.changes.watcher.Close()
+	}
+}
+
 func NewWebPack(setting WebPackSetting, core *XStorage) (*WebPack, error) {
 	m := &WebPack{}
 	err := m.Init(setting, core)
@@ -52,21 +84,46 @@ func NewWebPack(setting WebPackSetting, core *XStorage) (*WebPack, error) {
 	return m, nil
 }
 
+// namespace 返回请求所使用的命名空间，请求的ns参数优先于WebPackSetting.Namespace
+func (w *WebPack) namespace(c *gin.Context) *Namespace {
+	ns, ok := c.GetQuery("ns")
+	if !ok {
+		ns = w.setting.Namespace
+	}
+	return w.storageCore.Namespace(ns)
+}
+
 type WebFailReason int // web失败原因
 
 const (
 	WebFailReasonNull WebFailReason = iota
 	WebFailReasonNoLegalParam
 	WebFailReasonInnerError
+	WebFailReasonUnauthorized
+	WebFailReasonNoPermission
+	WebFailReasonNotFound
 )
 
 func (w *WebPack) StartWeb() error {
 
 	w.ginEngine = gin.Default()
-	w.ginEngine.GET("/get", w.WebGet)
-	w.ginEngine.GET("/set", w.WebSet)
-	w.ginEngine.GET("/get_all", w.WebGetAll)
-	addr := fmt.Sprintf("127.0.0.1:%d", w.setting.WebPort)
+	w.RegisterRest(w.ginEngine)
+	w.RegisterUI(w.ginEngine)
+	w.RegisterMetrics(w.ginEngine)
+	// 旧接口，设置了JwtMgr时需要管理员权限
+	legacy := w.ginEngine.Group("/", w.adminAuth)
+	legacy.GET("/get", w.WebGet)
+	legacy.GET("/set", w.WebSet)
+	legacy.GET("/get_all", w.WebGetAll)
+	legacy.GET("/watch", w.WebWatch)
+	legacy.POST("/cas", w.WebCas)
+	legacy.POST("/incr", w.WebIncr)
+	legacy.POST("/append", w.WebAppend)
+	host := w.setting.WebHost
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	addr := fmt.Sprintf("%s:%d", host, w.setting.WebPort)
 	err := w.ginEngine.Run(addr)
 	if err != nil {
 		return errors.Join(ErrGinEngineRun, err)
@@ -104,7 +161,7 @@ func (w *WebPack) WebGet(c *gin.Context) {
 	var results []ValueUnit
 	if !useRe {
 		result := &ValueUnit{}
-		ok, err := w.storageCore.GetHP(perm, result)
+		ok, err := w.namespace(c).GetHP(perm, result)
 		if err != nil {
 			w.log.Error(w.setting.LogFrom, "xStorage:WebGet:get value error:"+err.Error())
 			c.JSON(200, gin.H{
@@ -123,7 +180,7 @@ func (w *WebPack) WebGet(c *gin.Context) {
 		results = append(results, *result)
 	} else {
 		// 遍历并且搜索正则
-		all, err := w.storageCore.GetAll()
+		all, err := w.namespace(c).GetAll()
 		if err != nil {
 			w.log.Error(w.setting.LogFrom, "xStorage:WebGet:get all value error:"+err.Error())
 			c.JSON(200, gin.H{
@@ -189,9 +246,13 @@ func (w *WebPack) WebSet(c *gin.Context) {
 			"code": WebCodeFail,
 			"msg":  WebFailReasonNoLegalParam,
 		})
+		return
 	}
+	n := w.namespace(c)
 	if req.Value == "\"\"" {
-		err := w.storageCore.Delete(req.Key)
+		done := w.noteChange(c, "web", n.Key(req.Key))
+		err := n.Delete(req.Key)
+		done(err == nil)
 		if err != nil {
 			w.log.Error(w.setting.LogFrom, "xStorage:WebSet:delete value error:"+err.Error())
 			c.JSON(200, gin.H{
@@ -206,7 +267,9 @@ func (w *WebPack) WebSet(c *gin.Context) {
 		})
 		return
 	}
-	err = w.storageCore.Set(req.Key, StringToUnit(req.Value, ValueType(req.Type)))
+	done := w.noteChange(c, "web", n.Key(req.Key))
+	err = n.Set(req.Key, StringToUnit(req.Value, ValueType(req.Type)))
+	done(err == nil)
 	if err != nil {
 		w.log.Error(w.setting.LogFrom, "xStorage:WebSet:set value error:"+err.Error())
 		c.JSON(200, gin.H{
@@ -229,7 +292,7 @@ func (w *WebPack) WebGetAll(c *gin.Context) {
 		})
 		return
 	}
-	all, err := w.storageCore.GetAll()
+	all, err := w.namespace(c).GetAll()
 	if err != nil {
 		w.log.Error(w.setting.LogFrom, "xStorage:WebGet:get all value error:"+err.Error())
 		c.JSON(200, gin.H{
@@ -243,3 +306,154 @@ func (w *WebPack) WebGetAll(c *gin.Context) {
 		"result": all,
 	})
 }
+
+// WebWatch 以SSE的形式持续推送prefix下的修改，事件名为set或delete，数据为WatchEvent的json
+func (w *WebPack) WebWatch(c *gin.Context) {
+	if !w.IsInitialized() {
+		c.JSON(200, gin.H{
+			"code": WebCodeFail,
+			"msg":  WebFailReasonInnerError,
+		})
+		return
+	}
+	watcher := w.namespace(c).Watch(c.Query("prefix"))
+	defer watcher.Close()
+	// 先把头发出去，避免客户端在第一个事件到来前一直等待
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Status(200)
+	c.Writer.Flush()
+	c.Stream(func(_ io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case e, ok := <-watcher.C:
+			if !ok {
+				return false
+			}
+			name := "set"
+			if e.Type == WatchEventDelete {
+				name = "delete"
+			}
+			c.SSEvent(name, e)
+			return true
+		}
+	})
+}
+
+// WebCas 比较并交换，old为空字符串时代表期望key不存在，值的格式同WebSet
+func (w *WebPack) WebCas(c *gin.Context) {
+	if !w.IsInitialized() {
+		c.JSON(200, gin.H{
+			"code": WebCodeFail,
+			"msg":  WebFailReasonInnerError,
+		})
+		return
+	}
+	req := struct {
+		Key  string `json:"key"`
+		Old  string `json:"old"`
+		New  string `json:"new"`
+		Type int    `json:"type"`
+	}{}
+	err := c.BindJSON(&req)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"code": WebCodeFail,
+			"msg":  WebFailReasonNoLegalParam,
+		})
+		return
+	}
+	var old *ValueUnit
+	if req.Old != "" {
+		old = StringToUnit(req.Old, ValueType(req.Type))
+		if old == nil {
+			c.JSON(200, gin.H{
+				"code": WebCodeFail,
+				"msg":  WebFailReasonNoLegalParam,
+			})
+			return
+		}
+	}
+	newValue := StringToUnit(req.New, ValueType(req.Type))
+	if newValue == nil {
+		c.JSON(200, gin.H{
+			"code": WebCodeFail,
+			"msg":  WebFailReasonNoLegalParam,
+		})
+		return
+	}
+	n := w.namespace(c)
+	done := w.noteChange(c, "web", n.Key(req.Key))
+	swapped, err := n.CompareAndSwap(req.Key, old, newValue)
+	done(err == nil && swapped)
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:WebCas:cas value error:"+err.Error())
+		c.JSON(200, gin.H{
+			"code": WebCodeFail,
+			"msg":  WebFailReasonInnerError,
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":    WebCodeSuc,
+		"swapped": swapped,
+	})
+}
+
+// WebIncr 对int或float类型的值做原子加法，返回相加后的值
+func (w *WebPack) WebIncr(c *gin.Context) {
+	w.webUpdate(c, "WebIncr", (*Namespace).Incr)
+}
+
+// WebAppend 对slice类型的值做原子追加，返回追加后的值
+func (w *WebPack) WebAppend(c *gin.Context) {
+	w.webUpdate(c, "WebAppend", (*Namespace).Append)
+}
+
+func (w *WebPack) webUpdate(c *gin.Context, name string, update func(n *Namespace, key string, value *ValueUnit) (*ValueUnit, error)) {
+	if !w.IsInitialized() {
+		c.JSON(200, gin.H{
+			"code": WebCodeFail,
+			"msg":  WebFailReasonInnerError,
+		})
+		return
+	}
+	req := struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+		Type  int    `json:"type"`
+	}{}
+	err := c.BindJSON(&req)
+	if err != nil {
+		c.JSON(200, gin.H{
+			"code": WebCodeFail,
+			"msg":  WebFailReasonNoLegalParam,
+		})
+		return
+	}
+	value := StringToUnit(req.Value, ValueType(req.Type))
+	if value == nil {
+		c.JSON(200, gin.H{
+			"code": WebCodeFail,
+			"msg":  WebFailReasonNoLegalParam,
+		})
+		return
+	}
+	n := w.namespace(c)
+	done := w.noteChange(c, "web", n.Key(req.Key))
+	result, err := update(n, req.Key, value)
+	done(err == nil)
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:%s:update value error:%s", name, err.Error())
+		c.JSON(200, gin.H{
+			"code": WebCodeFail,
+			"msg":  WebFailReasonInnerError,
+		})
+		return
+	}
+	c.JSON(200, gin.H{
+		"code":   WebCodeSuc,
+		"result": result,
+	})
+}
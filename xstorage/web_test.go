@@ -1,15 +1,84 @@
 package xstorage
 
 import (
-	"fmt"
+	"bufio"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
 	"github.com/intmian/mian_go_lib/tool/misc"
-	"io/ioutil"
+	"github.com/intmian/mian_go_lib/tool/token"
+	"github.com/intmian/mian_go_lib/xlog"
+	"io"
 	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
 
 func TestWeb(t *testing.T) {
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logSetting := xlog.DefaultSetting()
+	logSetting.LogAddr = t.TempDir()
+	logSetting.IfFile = false
+	logSetting.Printer = func(string) bool { return true }
+	logSetting.OnLog = func(string) {}
+	log, err := xlog.NewXLog(logSetting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWebPack(WebPackSetting{Log: log}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	engine := gin.New()
+	engine.GET("/set", w.WebSet)
+	engine.GET("/get", w.WebGet)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+	// 旧接口的参数在json body中
+	do := func(path string, body string) string {
+		req, _ := http.NewRequest("GET", server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != 200 {
+			t.Fatalf("%s status %d", path, resp.StatusCode)
+		}
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	// 用http set设置
+	if body := do("/set", `{"key":"test","value":"\"1\"","type":1}`); body != `{"code":0}` {
+		t.Fatalf("web set error %s", body)
+	}
+	// 用http get获取
+	if body := do("/get", `{"perm":"test"}`); body != `{"code":0,"result":[{"Type":1,"Data":"1"}]}` {
+		t.Fatalf("web get error %s", body)
+	}
+	if body := do("/set", `{"key":"test","value":"null","type":1}`); body != `{"code":1,"msg":1}` {
+		t.Fatalf("web set null error %s", body)
+	}
+	changes := waitChanges(w, 1)
+	if len(changes) != 1 || changes[0].Key != "test" || changes[0].Source != "web" {
+		t.Fatalf("web set changes error %+v", changes)
+	}
+}
+
+func TestMgr_WebMa(t *testing.T) {
+	t.Skip("手动启动web服务调试时使用")
 	m, err := NewXStorage(XStorageSetting{
 		Property: misc.CreateProperty(MultiSafe, UseCache),
 	})
@@ -19,66 +88,341 @@ func TestWeb(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	err = w.StartWeb()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestWebWatch(t *testing.T) {
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWebPack(WebPackSetting{}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	engine.GET("/watch", w.WebWatch)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/watch?prefix=news.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
 	go func() {
-		err = w.StartWeb()
+		// 等待监听建立
+		time.Sleep(time.Millisecond * 100)
+		_ = m.Set("other", ToUnit(1, ValueTypeInt))
+		_ = m.Set("news.title", ToUnit("hello", ValueTypeString))
+	}()
+	reader := bufio.NewReader(resp.Body)
+	var lines []string
+	for len(lines) < 2 {
+		line, err := reader.ReadString('\n')
 		if err != nil {
-			t.Error(err)
-			return
+			t.Fatal(err)
 		}
-	}()
-	time.Sleep(time.Second)
-	u1 := ToUnit("1", ValueTypeString)
-	// 用http set设置
-	url := "http://127.0.0.1:11111"
-	urlSet := fmt.Sprintf("%s/set?key=%s&value=%s&value_type=%d", url, "test", ToBase[string](u1), u1.Type)
-	resp, err := http.Get(urlSet)
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	if lines[0] != "event:set" || !strings.Contains(lines[1], `"Key":"news.title"`) {
+		t.Fatalf("sse error %v", lines)
+	}
+}
+
+func TestWebNamespace(t *testing.T) {
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logSetting := xlog.DefaultSetting()
+	logSetting.LogAddr = t.TempDir()
+	logSetting.IfFile = false
+	logSetting.Printer = func(string) bool { return true }
+	logSetting.OnLog = func(string) {}
+	log, err := xlog.NewXLog(logSetting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWebPack(WebPackSetting{Namespace: "news", Log: log}, m)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.StatusCode != 200 {
-		t.Fatal("web set error")
+	engine := gin.New()
+	engine.GET("/set", w.WebSet)
+	engine.GET("/get_all", w.WebGetAll)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	set := func(url string) {
+		req, _ := http.NewRequest("GET", url, strings.NewReader(`{"key":"title","value":"\"hello\"","type":1}`))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
 	}
-	// 打印返回的json
-	body, err := ioutil.ReadAll(resp.Body)
+	set(server.URL + "/set")
+	set(server.URL + "/set?ns=blog")
+	if ToBaseF[string](m.Namespace("news").Get("title")) != "hello" || ToBaseF[string](m.Namespace("blog").Get("title")) != "hello" {
+		t.Fatal("namespace set error")
+	}
+	resp, err := http.Get(server.URL + "/get_all?ns=blog")
 	if err != nil {
 		t.Fatal(err)
 	}
-	if string(body) != "{\"code\":1}" {
-		t.Fatal("web set error")
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(body), `"title"`) || strings.Contains(string(body), "__ns") {
+		t.Fatalf("namespace get all error %s", body)
 	}
+}
 
-	// 用http get获取
-	urlGet := fmt.Sprintf("%s/get?perm=%s", url, "test")
-	resp, err = http.Get(urlGet)
+func TestWebRest(t *testing.T) {
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if resp.StatusCode != 200 {
-		t.Fatal("web get error")
+	jwt := token.NewJwtMgr("1", "2")
+	w, err := NewWebPack(WebPackSetting{
+		JwtMgr: jwt,
+		PrefixPerms: []PrefixPerm{
+			{Prefix: "", Read: "read", Write: "write"},
+			{Prefix: "secret.", Read: "admin", Write: "admin"},
+		},
+	}, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	w.RegisterRest(engine)
+	engine.GET("/get_all", w.adminAuth, w.WebGetAll)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+
+	genToken := func(permission ...string) string {
+		d := &token.Data{User: "test", Permission: permission, ValidTime: time.Now().Add(time.Hour).Unix()}
+		jwt.Signature(d)
+		s, _ := json.Marshal(d)
+		return string(s)
+	}
+	rw := genToken("read", "write")
+	do := func(method string, path string, tk string, body string) (int, string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if tk != "" {
+			req.Header.Set("token", tk)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, _ := do("GET", "/kv/a", "", ""); code != http.StatusUnauthorized {
+		t.Fatalf("no token should be unauthorized %d", code)
+	}
+	if code, _ := do("PUT", "/kv/a", genToken("read"), `{"type":2,"value":1}`); code != http.StatusForbidden {
+		t.Fatalf("read token should not write %d", code)
+	}
+	for i := 0; i < 3; i++ {
+		if code, body := do("PUT", "/kv/list."+strconv.Itoa(i), rw, `{"type":1,"value":"v`+strconv.Itoa(i)+`"}`); code != http.StatusOK {
+			t.Fatalf("put error %d %s", code, body)
+		}
+	}
+	if code, body := do("GET", "/kv/list.1", rw, ""); code != http.StatusOK || !strings.Contains(body, `"v1"`) {
+		t.Fatalf("get error %d %s", code, body)
+	}
+	code, body := do("GET", "/kv?prefix=list.&limit=2", rw, "")
+	if code != http.StatusOK || !strings.Contains(body, `"next":"list.2"`) {
+		t.Fatalf("list error %d %s", code, body)
+	}
+	code, body = do("POST", "/kv/batch", rw, `{"ops":[{"op":"set","key":"b","type":2,"value":2},{"op":"delete","key":"list.0"}]}`)
+	if code != http.StatusOK {
+		t.Fatalf("batch error %d %s", code, body)
+	}
+	changes := waitChanges(w, 5)
+	if len(changes) < 2 || changes[0].Key != "list.0" || changes[0].New != nil || ToBase[string](changes[0].Old) != "v0" ||
+		changes[1].Key != "b" || changes[1].Source != "rest" || ToBase[int](changes[1].New) != 2 || changes[1].Old != nil {
+		t.Fatalf("batch changes error %+v", changes)
+	}
+	code, body = do("POST", "/kv/batch_get", rw, `{"keys":["b","list.0"]}`)
+	if code != http.StatusOK || !strings.Contains(body, `"b"`) || strings.Contains(body, `"list.0"`) {
+		t.Fatalf("batch get error %d %s", code, body)
+	}
+	if code, _ := do("DELETE", "/kv/b", rw, ""); code != http.StatusOK {
+		t.Fatal("delete error")
+	}
+	if code, _ := do("GET", "/kv/b", rw, ""); code != http.StatusNotFound {
+		t.Fatal("deleted key should be not found")
+	}
+	if code, _ := do("PUT", "/kv/secret.a", rw, `{"type":2,"value":1}`); code != http.StatusForbidden {
+		t.Fatal("secret prefix should need admin")
+	}
+	if code, _ := do("PUT", "/kv/secret.a", genToken("admin"), `{"type":2,"value":1}`); code != http.StatusOK {
+		t.Fatal("admin put error")
+	}
+	if code, _ := do("GET", "/get_all", rw, ""); code != http.StatusForbidden {
+		t.Fatal("legacy api should need admin permission")
+	}
+}
+
+func TestWebUI(t *testing.T) {
+	m, err := NewXStorage(XStorageSetting{
+		Property: misc.CreateProperty(MultiSafe, UseCache),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := NewCfgExt(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = misc.JoinErr(
+		cfg.AddParam(&CfgParam{Key: "news.keywords", ValueType: ValueTypeSliceString, CanUser: true}),
+		cfg.AddParam(&CfgParam{Key: "news.limit", ValueType: ValueTypeInt, Default: *ToUnit(10, ValueTypeInt)}),
+	)
+	if err != nil {
+		t.Fatal(err)
 	}
-	body, err = ioutil.ReadAll(resp.Body)
+	w, err := NewWebPack(WebPackSetting{Cfg: cfg}, m)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if string(body) != "{\"code\":1,\"result\":[{\"Type\":1,\"Data\":\"1\"}]}" {
-		t.Fatal("web get error")
+	engine := gin.New()
+	w.RegisterUI(engine)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+	do := func(method string, path string, body string) (int, string) {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	if code, body := do("GET", "/ui", ""); code != http.StatusOK || !strings.Contains(body, "<title>xstorage</title>") {
+		t.Fatal("index error")
+	}
+	if code, body := do("PUT", "/ui/api/key", `{"key":"a.b.c","type":101,"value":["x","y"]}`); code != http.StatusOK {
+		t.Fatalf("set error %d %s", code, body)
+	}
+	if code, _ := do("PUT", "/ui/api/key", `{"key":"a.b.d","type":102,"value":["x"]}`); code != http.StatusBadRequest {
+		t.Fatal("slice element type should be checked")
+	}
+	_ = m.Set("a.e", ToUnit(1, ValueTypeInt))
+	code, body := do("GET", "/ui/api/tree", "")
+	if code != http.StatusOK {
+		t.Fatal("tree error")
+	}
+	var tree struct {
+		Result WebTreeNode `json:"result"`
+	}
+	_ = json.Unmarshal([]byte(body), &tree)
+	if len(tree.Result.Children) != 1 || len(tree.Result.Children[0].Children) != 2 {
+		t.Fatalf("tree error %s", body)
+	}
+	b := tree.Result.Children[0].Children[0]
+	if b.Key != "a.b" || b.Children[0].Key != "a.b.c" || b.Children[0].TypeName != "[]string" {
+		t.Fatalf("tree error %s", body)
+	}
+	if code, body := do("GET", "/ui/api/search?q=Y", ""); code != http.StatusOK || !strings.Contains(body, `"a.b.c"`) || strings.Contains(body, `"a.e"`) {
+		t.Fatalf("search error %s", body)
+	}
+	if code, _ := do("DELETE", "/ui/api/key?key=a.e", ""); code != http.StatusOK {
+		t.Fatal("delete error")
+	}
+
+	if code, _ := do("PUT", "/ui/api/cfg", `{"key":"news.keywords","user":"u1","value":"[\"go\"]"}`); code != http.StatusOK {
+		t.Fatal("set cfg error")
+	}
+	code, body = do("GET", "/ui/api/cfg", "")
+	if code != http.StatusOK || !strings.Contains(body, `"users":{"u1":{"Type":101,"Data":["go"]}}`) || !strings.Contains(body, `"default":{"Type":2,"Data":10}`) {
+		t.Fatalf("cfg error %s", body)
+	}
+
+	// 直接对存储的写入同样会记录，来源为storage，配置的修改历史不记录
+	changes := waitChanges(w, 4)
+	if len(changes) != 4 || changes[0].Key != "news.keywords.u1" || changes[0].Source != "cfg" ||
+		changes[1].Source != "ui" || changes[1].New != nil || changes[1].Old == nil ||
+		changes[2].Key != "a.e" || changes[2].Source != "storage" || changes[2].User != "" ||
+		changes[3].Key != "a.b.c" || changes[3].Old != nil {
+		t.Fatalf("changes error %+v", changes)
 	}
+	w.Close()
 }
 
-func TestMgr_WebMa(t *testing.T) {
-	return
+// waitChanges 修改记录在后台加入，等待至少n条
+func waitChanges(w *WebPack, n int) []WebChange {
+	deadline := time.Now().Add(time.Second)
+	for {
+		changes := w.Changes()
+		if len(changes) >= n || time.Now().After(deadline) {
+			return changes
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWebMetrics(t *testing.T) {
 	m, err := NewXStorage(XStorageSetting{
 		Property: misc.CreateProperty(MultiSafe, UseCache),
 	})
-	w, err := NewWebPack(WebPackSetting{
-		WebPort: 11111,
-	}, m)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = w.StartWeb()
+	metrics := NewMetrics(time.Millisecond, time.Second)
+	m.AddObserver(metrics)
+	w, err := NewWebPack(WebPackSetting{Metrics: metrics}, m)
 	if err != nil {
-		t.Error(err)
-		return
+		t.Fatal(err)
+	}
+	engine := gin.New()
+	w.RegisterMetrics(engine)
+	server := httptest.NewServer(engine)
+	defer server.Close()
+	_ = m.Set("secret.key", ToUnit("v", ValueTypeString))
+	_, _ = m.Get("secret.key")
+	_, _ = m.Get("none")
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	text := string(body)
+	for _, want := range []string{
+		"# TYPE xstorage_ops_total counter",
+		`xstorage_ops_total{op="get",source="cache",result="ok"} 1`,
+		`xstorage_ops_total{op="get",source="cache",result="miss"} 1`,
+		`xstorage_ops_total{op="set",source="cache",result="ok"} 1`,
+		"# TYPE xstorage_op_duration_seconds histogram",
+		`xstorage_op_duration_seconds_bucket{op="get",source="cache",le="0.001"}`,
+		`xstorage_op_duration_seconds_bucket{op="get",source="cache",le="+Inf"} 2`,
+		`xstorage_op_duration_seconds_count{op="set",source="cache"} 1`,
+	} {
+		if !strings.Contains(text, want) {
+			t.Fatalf("metrics should contain %s\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "secret") || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("metrics error %s", text)
 	}
 }
@@ -0,0 +1,458 @@
+package xstorage
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/intmian/mian_go_lib/tool/token"
+)
+
+/*
+管理页面，注册在StartWeb中，也可以通过RegisterUI注册到自己的gin路由上，浏览器打开 /ui 即可。
+页面本身不需要token，接口 /ui/api/* 与旧接口一样需要AdminPermission，token在页面中填写后保存在浏览器里。
+	GET    /ui/api/tree?prefix=   按Split拆分后的树
+	GET    /ui/api/search?q=      key或值中包含q的数据
+	PUT    /ui/api/key            写入，body同REST接口，额外带上key
+	DELETE /ui/api/key?key=       删除
+	GET    /ui/api/changes        存储的修改记录，新的在前，通过web做出的修改带有用户与来源
+	GET    /ui/api/cfg            WebPackSetting.Cfg中的参数、默认值、当前值与用户配置
+	PUT    /ui/api/cfg            修改参数，body为 {"key":"a","user":"","value":"json","comment":""}，user为空时修改全局配置
+	GET    /ui/api/cfg/schema     参数的json schema
+*/
+
+//go:embed webui/index.html
+var webUIIndex []byte
+
+const (
+	defaultChangeLogSize = 200
+	ginTokenKey          = "xstorage.token"
+)
+
+// WebChange 一次提交成功的修改，来自Watch("")，所以也包括直接通过XStorage、CfgExt做出的修改
+type WebChange struct {
+	Time   int64      `json:"time"`   // 毫秒
+	User   string     `json:"user"`   // token中的用户，没有设置JwtMgr时为请求的ip，不是通过web做出的修改为空
+	Source string     `json:"source"` // rest、ui、cfg、web（旧接口），不是通过web做出的修改为storage
+	Key    string     `json:"key"`    // 存储中实际的key
+	Old    *ValueUnit `json:"old"`
+	New    *ValueUnit `json:"new"` // 删除时为nil
+}
+
+// changeNote web请求对修改的标注，在写入前登记，收到对应key的事件时取出
+type changeNote struct {
+	user   string
+	source string
+}
+
+// changeLog 只保存最近的size条修改
+type changeLog struct {
+	lock    sync.Mutex
+	size    int
+	changes []WebChange
+	notes   map[string][]*changeNote // 按key排队的标注
+	watcher *Watcher
+}
+
+// note 为keys登记标注，返回的函数在写入没有提交时取消标注
+func (l *changeLog) note(user string, source string, keys ...string) func(committed bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.notes == nil {
+		l.notes = make(map[string][]*changeNote)
+	}
+	n := &changeNote{user: user, source: source}
+	for _, key := range keys {
+		l.notes[key] = append(l.notes[key], n)
+	}
+	return func(committed bool) {
+		if committed {
+			return
+		}
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		for _, key := range keys {
+			notes := l.notes[key]
+			for i, o := range notes {
+				if o == n {
+					notes = append(notes[:i], notes[i+1:]...)
+					break
+				}
+			}
+			if len(notes) == 0 {
+				delete(l.notes, key)
+			} else {
+				l.notes[key] = notes
+			}
+		}
+	}
+}
+
+// onEvent 将事件加入记录，内部的key（例如配置的修改历史）不记录
+func (l *changeLog) onEvent(e WatchEvent) {
+	if internalPrefixOf(e.Key) != "" {
+		return
+	}
+	change := WebChange{
+		Time:   e.Time,
+		Source: "storage",
+		Key:    e.Key,
+		Old:    e.OldValue,
+		New:    e.NewValue,
+	}
+	l.lock.Lock()
+	if notes := l.notes[e.Key]; len(notes) > 0 {
+		change.User = notes[0].user
+		change.Source = notes[0].source
+		if len(notes) == 1 {
+			delete(l.notes, e.Key)
+		} else {
+			l.notes[e.Key] = notes[1:]
+		}
+	}
+	l.lock.Unlock()
+	l.add(change)
+}
+
+func (l *changeLog) add(change WebChange) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	size := l.size
+	if size <= 0 {
+		size = defaultChangeLogSize
+	}
+	l.changes = append(l.changes, change)
+	if len(l.changes) > size {
+		l.changes = append(l.changes[:0], l.changes[len(l.changes)-size:]...)
+	}
+}
+
+// list 返回修改记录，新的在前
+func (l *changeLog) list() []WebChange {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	ret := make([]WebChange, len(l.changes))
+	for i, change := range l.changes {
+		ret[len(ret)-1-i] = change
+	}
+	return ret
+}
+
+// Changes 返回修改记录，新的在前。记录在后台按提交顺序加入，写入返回后可能需要稍等才能读到
+func (w *WebPack) Changes() []WebChange {
+	return w.changes.list()
+}
+
+// requestUser 返回请求的用户，用于记录修改
+func (w *WebPack) requestUser(c *gin.Context) string {
+	if v, ok := c.Get(ginTokenKey); ok {
+		if data, ok := v.(*token.Data); ok && data != nil {
+			return data.User
+		}
+	}
+	return c.ClientIP()
+}
+
+// noteChange 在写入前为请求登记用户与来源，写入没有提交时需要以false调用返回的函数
+func (w *WebPack) noteChange(c *gin.Context, source string, keys ...string) func(committed bool) {
+	return w.changes.note(w.requestUser(c), source, keys...)
+}
+
+// RegisterUI 注册管理页面
+func (w *WebPack) RegisterUI(r gin.IRouter) {
+	r.GET("/ui", w.UIIndex)
+	api := r.Group("/ui/api", w.adminAuth)
+	api.GET("/tree", w.UITree)
+	api.GET("/search", w.UISearch)
+	api.PUT("/key", w.UISet)
+	api.DELETE("/key", w.UIDelete)
+	api.GET("/changes", w.UIChanges)
+	api.GET("/cfg", w.UICfg)
+	api.PUT("/cfg", w.UISetCfg)
+	api.GET("/cfg/schema", w.UICfgSchema)
+}
+
+func (w *WebPack) UIIndex(c *gin.Context) {
+	c.Data(http.StatusOK, "text/html; charset=utf-8", webUIIndex)
+}
+
+// WebTreeNode 按Split拆分key后的树的节点，一个节点可以同时有值和子节点，例如 a 与 a.b
+type WebTreeNode struct {
+	Name     string         `json:"name"`
+	Key      string         `json:"key"` // 命名空间中的完整key
+	TypeName string         `json:"typeName,omitempty"`
+	Value    *ValueUnit     `json:"value,omitempty"`
+	Children []*WebTreeNode `json:"children,omitempty"`
+}
+
+func buildTree(pairs []KVPair) *WebTreeNode {
+	root := &WebTreeNode{}
+	for _, pair := range pairs {
+		node := root
+		for i, name := range Split(pair.Key) {
+			var child *WebTreeNode
+			for _, c := range node.Children {
+				if c.Name == name {
+					child = c
+					break
+				}
+			}
+			if child == nil {
+				child = &WebTreeNode{
+					Name: name,
+					Key:  Join(Split(pair.Key)[:i+1]...),
+				}
+				node.Children = append(node.Children, child)
+			}
+			node = child
+		}
+		node.Value = pair.Value
+		node.TypeName = valueTypeName(pair.Value.Type)
+	}
+	return root
+}
+
+func valueTypeName(t ValueType) string {
+	switch t {
+	case ValueTypeString:
+		return "string"
+	case ValueTypeInt:
+		return "int"
+	case ValueTypeFloat:
+		return "float"
+	case ValueTypeBool:
+		return "bool"
+	case ValueTypeInt64:
+		return "int64"
+	case ValueTypeFloat64:
+		return "float64"
+	case ValueTypeTime:
+		return "time"
+	case ValueTypeMapString:
+		return "map[string]string"
+	case ValueTypeMapInt:
+		return "map[string]int"
+	case ValueTypeSliceString:
+		return "[]string"
+	case ValueTypeSliceInt:
+		return "[]int"
+	case ValueTypeSliceFloat:
+		return "[]float"
+	case ValueTypeSliceBool:
+		return "[]bool"
+	default:
+		return "unknown"
+	}
+}
+
+func (w *WebPack) UITree(c *gin.Context) {
+	if !w.IsInitialized() {
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	pairs, err := w.namespace(c).GetByPrefix(c.Query("prefix"))
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:UITree:get value error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	w.restSuc(c, buildTree(pairs))
+}
+
+// UISearch 搜索key或值的json中包含q的数据，不区分大小写
+func (w *WebPack) UISearch(c *gin.Context) {
+	if !w.IsInitialized() {
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	q := strings.ToLower(c.Query("q"))
+	all, err := w.namespace(c).GetAll()
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:UISearch:get all value error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	pairs := make([]KVPair, 0)
+	for k, v := range all {
+		data, _ := json.Marshal(v.Data)
+		if strings.Contains(strings.ToLower(k), q) || strings.Contains(strings.ToLower(string(data)), q) {
+			pairs = append(pairs, KVPair{Key: k, Value: v})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+	w.restSuc(c, pairs)
+}
+
+func (w *WebPack) UISet(c *gin.Context) {
+	if !w.IsInitialized() {
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	var req struct {
+		Key string `json:"key"`
+		restValue
+	}
+	err := c.ShouldBindJSON(&req)
+	if err != nil || req.Key == "" {
+		w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+		return
+	}
+	value := req.toUnit()
+	if value == nil {
+		w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+		return
+	}
+	n := w.namespace(c)
+	done := w.noteChange(c, "ui", n.Key(req.Key))
+	err = n.Set(req.Key, value)
+	done(err == nil)
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:UISet:set value error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	w.restSuc(c, nil)
+}
+
+func (w *WebPack) UIDelete(c *gin.Context) {
+	if !w.IsInitialized() {
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	key := c.Query("key")
+	if key == "" {
+		w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+		return
+	}
+	n := w.namespace(c)
+	done := w.noteChange(c, "ui", n.Key(key))
+	err := n.Delete(key)
+	done(err == nil)
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:UIDelete:delete value error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	w.restSuc(c, nil)
+}
+
+func (w *WebPack) UIChanges(c *gin.Context) {
+	w.restSuc(c, w.Changes())
+}
+
+// WebCfgParam 管理页面中展示的配置参数
+type WebCfgParam struct {
+	Key      string               `json:"key"`
+	RealKey  string               `json:"realKey"`
+	TypeName string               `json:"typeName"`
+	Type     ValueType            `json:"type"`
+	CanUser  bool                 `json:"canUser"`
+	Default  *ValueUnit           `json:"default"` // 没有设置默认值时为nil
+	Value    *ValueUnit           `json:"value"`   // 存储中的值，没有设置时为nil
+	Users    map[string]ValueUnit `json:"users"`
+	// Effective 按CfgExt的层级解析后实际生效的全局值，Source为其来源
+	Effective *ValueUnit `json:"effective"`
+	Source    string     `json:"source"`
+}
+
+func (w *WebPack) UICfg(c *gin.Context) {
+	cfg := w.setting.Cfg
+	if cfg == nil {
+		w.restSuc(c, []WebCfgParam{})
+		return
+	}
+	params := cfg.Params()
+	ret := make([]WebCfgParam, 0, len(params))
+	for _, p := range params {
+		param := WebCfgParam{
+			Key:      p.Key,
+			RealKey:  p.RealKey,
+			TypeName: valueTypeName(p.ValueType),
+			Type:     p.ValueType,
+			CanUser:  p.CanUser,
+		}
+		if p.Default.Type != 0 {
+			def := p.Default
+			param.Default = &def
+		}
+		value, err := w.storageCore.Get(p.RealKey)
+		if err == nil {
+			param.Value = value
+		}
+		effective, source, err := cfg.GetWithSource("", p.Key)
+		if err == nil {
+			param.Effective = effective
+			param.Source = source.String()
+		}
+		param.Users, err = cfg.UserValues(p.Key)
+		if err != nil {
+			w.log.Error(w.setting.LogFrom, "xStorage:UICfg:get user value error:"+err.Error())
+			w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+			return
+		}
+		ret = append(ret, param)
+	}
+	w.restSuc(c, ret)
+}
+
+func (w *WebPack) UISetCfg(c *gin.Context) {
+	cfg := w.setting.Cfg
+	if cfg == nil {
+		w.restFail(c, http.StatusNotFound, WebFailReasonNotFound)
+		return
+	}
+	var req struct {
+		Key     string `json:"key"`
+		User    string `json:"user"`
+		Value   string `json:"value"`
+		Comment string `json:"comment"`
+	}
+	err := c.ShouldBindJSON(&req)
+	if err != nil {
+		w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+		return
+	}
+	param := cfg.paramMap.GetParam(req.Key)
+	if param == nil {
+		w.restFail(c, http.StatusNotFound, WebFailReasonNotFound)
+		return
+	}
+	realKey := param.RealKey
+	if req.User != "" {
+		realKey = Join(param.RealKey, req.User)
+	}
+	done := w.noteChange(c, "cfg", realKey)
+	if req.User == "" {
+		err = cfg.SetBy(w.requestUser(c), req.Comment, req.Key, req.Value)
+	} else {
+		err = cfg.SetUserBy(w.requestUser(c), req.Comment, req.User, req.Key, req.Value)
+	}
+	done(err == nil)
+	if err != nil {
+		w.restFail(c, http.StatusBadRequest, WebFailReasonNoLegalParam)
+		return
+	}
+	w.restSuc(c, nil)
+}
+
+// UICfgSchema 返回CfgExt.JSONSchema，供前端生成表单
+func (w *WebPack) UICfgSchema(c *gin.Context) {
+	cfg := w.setting.Cfg
+	if cfg == nil {
+		w.restFail(c, http.StatusNotFound, WebFailReasonNotFound)
+		return
+	}
+	schema, err := cfg.JSONSchema()
+	if err != nil {
+		w.log.Error(w.setting.LogFrom, "xStorage:UICfgSchema:export schema error:"+err.Error())
+		w.restFail(c, http.StatusInternalServerError, WebFailReasonInnerError)
+		return
+	}
+	w.restSuc(c, json.RawMessage(schema))
+}